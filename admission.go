@@ -0,0 +1,137 @@
+package detka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/metrics"
+	"golang.org/x/net/context"
+)
+
+type AdmissionConfig struct {
+	// Once the lag reaches SoftLag each account may only use AccountShare percent of the
+	// remaining headroom (HardLag - lag) within each Window
+	SoftLag int64
+	// Once the lag reaches HardLag every new message is rejected, 0 disables admission control
+	HardLag      int64
+	AccountShare int
+	Window       time.Duration
+	// Suggested to clients in the 'Retry-After' header
+	RetryAfter time.Duration
+}
+
+func AdmissionConfigFromOpts(opts *args.Options) AdmissionConfig {
+	return AdmissionConfig{
+		SoftLag:      int64(opts.Int("backpressure-soft-lag")),
+		HardLag:      int64(opts.Int("backpressure-hard-lag")),
+		AccountShare: opts.Int("backpressure-account-share"),
+		Window:       LagInterval,
+		RetryAfter:   time.Duration(opts.Int("backpressure-retry-after")) * time.Second,
+	}
+}
+
+// Returned by Admission.Admit() when the API should not accept new messages
+type OverCapacity struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (self *OverCapacity) Error() string {
+	return fmt.Sprintf("Over capacity (%s), retry after %d seconds", self.Reason, int(self.RetryAfter.Seconds()))
+}
+
+// Reports the number of queued messages the workers have yet to handle
+type Lagger interface {
+	Lag() int64
+}
+
+// Decides if the API should accept new messages given how far behind the workers are
+type Admission struct {
+	mutex    sync.Mutex
+	conf     AdmissionConfig
+	lag      Lagger
+	accounts map[string]int64
+	window   time.Time
+}
+
+func NewAdmission(conf AdmissionConfig, lag Lagger) *Admission {
+	return &Admission{
+		conf:     conf,
+		lag:      lag,
+		accounts: make(map[string]int64),
+		window:   time.Now(),
+	}
+}
+
+// Replace the config, IE: the config file was reloaded
+func (self *Admission) SetConfig(conf AdmissionConfig) {
+	self.mutex.Lock()
+	self.conf = conf
+	self.mutex.Unlock()
+}
+
+// Returns *OverCapacity if a new message for 'account' should be rejected
+func (self *Admission) Admit(account string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.conf.HardLag == 0 {
+		return nil
+	}
+
+	// Start a new fairness window
+	if time.Now().Sub(self.window) >= self.conf.Window {
+		self.accounts = make(map[string]int64)
+		self.window = time.Now()
+	}
+
+	lag := self.lag.Lag()
+	if lag >= self.conf.HardLag {
+		return self.reject("lag")
+	}
+
+	if lag >= self.conf.SoftLag {
+		// Each account gets a share of what remains before the hard limit
+		allowed := (self.conf.HardLag - lag) * int64(self.conf.AccountShare) / 100
+		if allowed < 1 {
+			allowed = 1
+		}
+		if self.accounts[account] >= allowed {
+			return self.reject("account")
+		}
+	}
+	self.accounts[account]++
+	return nil
+}
+
+// Returns *OverCapacity because a dependency (IE: the store) is not available
+func (self *Admission) Unavailable(reason string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.conf.HardLag == 0 {
+		return nil
+	}
+	return self.reject(reason)
+}
+
+func (self *Admission) reject(reason string) error {
+	metrics.AdmissionRejected.WithLabelValues(reason).Inc()
+	return &OverCapacity{Reason: reason, RetryAfter: self.conf.RetryAfter}
+}
+
+type admissionContextKey int
+
+const admissionKey admissionContextKey = 1
+
+func SetAdmission(ctx context.Context, admission *Admission) context.Context {
+	return context.WithValue(ctx, admissionKey, admission)
+}
+
+// Returns the Admission in the context, nil if none was injected
+func GetAdmission(ctx context.Context) *Admission {
+	obj, _ := ctx.Value(admissionKey).(*Admission)
+	return obj
+}
@@ -0,0 +1,64 @@
+package detka_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka"
+)
+
+type fixedLag int64
+
+func (self fixedLag) Lag() int64 {
+	return int64(self)
+}
+
+var _ = Describe("Admission", func() {
+	conf := detka.AdmissionConfig{
+		SoftLag:      100,
+		HardLag:      200,
+		AccountShare: 10,
+		Window:       time.Minute,
+		RetryAfter:   30 * time.Second,
+	}
+
+	Context("When the lag is below the soft limit", func() {
+		It("should admit every message", func() {
+			admission := detka.NewAdmission(conf, fixedLag(99))
+			for i := 0; i < 1000; i++ {
+				Expect(admission.Admit("account-1")).To(BeNil())
+			}
+		})
+	})
+	Context("When the lag is between the soft and hard limit", func() {
+		It("should limit each account to its share of the headroom", func() {
+			// 10% of the 50 messages of headroom
+			admission := detka.NewAdmission(conf, fixedLag(150))
+			for i := 0; i < 5; i++ {
+				Expect(admission.Admit("account-1")).To(BeNil())
+			}
+			err := admission.Admit("account-1")
+			Expect(err).To(BeAssignableToTypeOf(&detka.OverCapacity{}))
+			Expect(err.(*detka.OverCapacity).Reason).To(Equal("account"))
+
+			// Other accounts still have their share
+			Expect(admission.Admit("account-2")).To(BeNil())
+		})
+	})
+	Context("When the lag reaches the hard limit", func() {
+		It("should reject every message", func() {
+			admission := detka.NewAdmission(conf, fixedLag(200))
+			err := admission.Admit("account-1")
+			Expect(err).To(BeAssignableToTypeOf(&detka.OverCapacity{}))
+			Expect(err.(*detka.OverCapacity).RetryAfter).To(Equal(30 * time.Second))
+		})
+	})
+	Context("When admission control is disabled", func() {
+		It("should admit every message", func() {
+			admission := detka.NewAdmission(detka.AdmissionConfig{}, fixedLag(1000000))
+			Expect(admission.Admit("account-1")).To(BeNil())
+			Expect(admission.Unavailable("store")).To(BeNil())
+		})
+	})
+})
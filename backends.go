@@ -0,0 +1,68 @@
+package detka
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/blob"
+	"github.com/thrawn01/detka/disk"
+	"github.com/thrawn01/detka/envelope"
+	"github.com/thrawn01/detka/kafka"
+	"github.com/thrawn01/detka/queue"
+	"github.com/thrawn01/detka/sqldb"
+	"github.com/thrawn01/detka/store"
+)
+
+// Create the queue chosen by the 'queue-backend' option
+func NewQueue(parser *args.ArgParser) (queue.Queue, error) {
+	opts := parser.GetOpts()
+	switch opts.String("queue-backend") {
+	case "kafka":
+		return kafka.NewQueue(parser), nil
+	case "disk":
+		return disk.NewQueue(disk.ConfigFromOpts(opts))
+	}
+	return nil, errors.Errorf("invalid queue backend '%s' - must be one of [kafka disk]",
+		opts.String("queue-backend"))
+}
+
+// Create the store chosen by the 'store-backend' option, with large bodies kept in the
+// 'blob-backend' if chosen and encrypted if an 'encryption-key-provider' is chosen
+func NewStore(parser *args.ArgParser) (store.Store, error) {
+	opts := parser.GetOpts()
+	master, err := envelope.NewMasterKey(envelope.ConfigFromOpts(opts))
+	if err != nil {
+		return nil, err
+	}
+	blobConf := blob.ConfigFromOpts(opts)
+	blobs, err := blob.New(blobConf)
+	if err != nil {
+		return nil, err
+	}
+
+	var dbStore store.Store
+	switch opts.String("store-backend") {
+	case "rethink":
+		dbStore = store.NewRethinkStore(parser, nil)
+	case sqldb.Postgres, sqldb.SQLite:
+		if dbStore, err = store.NewSQLStore(parser, nil); err != nil {
+			return nil, err
+		}
+	case "bolt":
+		dbStore = store.NewBoltStore(parser, nil)
+	default:
+		return nil, errors.Errorf("invalid store backend '%s' - must be one of [rethink postgres sqlite bolt]",
+			opts.String("store-backend"))
+	}
+
+	// Bodies are encrypted before they are offloaded
+	if blobs != nil {
+		dbStore = store.NewOffloadStore(dbStore, blobs, blobConf.Threshold)
+	}
+	if master == nil {
+		return dbStore, nil
+	}
+	return store.NewEncryptedStore(dbStore, master,
+		time.Duration(opts.Int("encryption-rotate-interval"))*time.Minute), nil
+}
@@ -0,0 +1,80 @@
+package blob
+
+import (
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thrawn01/args"
+	"golang.org/x/net/context"
+)
+
+// Blob store backends
+const (
+	BackendNone = "none"
+	BackendFile = "file"
+	BackendS3   = "s3"
+)
+
+// Returned by Open() when the key does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// Keeps message bodies too large to store with the message
+type Store interface {
+	// Write 'size' bytes read from 'body' to 'key', replacing any existing blob. The blob
+	// only exists once Put() returns without error
+	Put(ctx context.Context, key string, body io.Reader, size int64) error
+	// Returns ErrNotFound if the key does not exist
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Keys that don't exist are ignored
+	Delete(ctx context.Context, key string) error
+}
+
+type Config struct {
+	// BackendNone disables the blob store
+	Backend string
+	// Message bodies larger than this many bytes are kept in the blob store
+	Threshold int
+	// Directory the BackendFile backend keeps blobs in
+	Dir string
+	// URL of the S3 compatible service, IE: 'https://s3.us-east-1.amazonaws.com'
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+}
+
+func ConfigFromOpts(opts *args.Options) Config {
+	return Config{
+		Backend:     opts.String("blob-backend"),
+		Threshold:   opts.Int("blob-threshold"),
+		Dir:         opts.String("blob-dir"),
+		S3Endpoint:  opts.String("blob-s3-endpoint"),
+		S3Bucket:    opts.String("blob-s3-bucket"),
+		S3Region:    opts.String("blob-s3-region"),
+		S3AccessKey: opts.String("blob-s3-access-key"),
+		S3SecretKey: opts.String("blob-s3-secret-key"),
+	}
+}
+
+// Returns the blob store of the configured backend, nil if disabled
+func New(conf Config) (Store, error) {
+	switch conf.Backend {
+	case BackendNone, "":
+		return nil, nil
+	case BackendFile:
+		return NewFileStore(conf.Dir)
+	case BackendS3:
+		return NewS3Store(conf)
+	}
+	return nil, errors.Errorf("invalid blob backend '%s' - must be one of [none file s3]", conf.Backend)
+}
+
+// Keys are used as file names and URL paths
+func validKey(key string) error {
+	if key == "" || strings.ContainsAny(key, "/\\") || strings.HasPrefix(key, ".") {
+		return errors.Errorf("invalid blob key '%s'", key)
+	}
+	return nil
+}
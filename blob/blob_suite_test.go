@@ -0,0 +1,13 @@
+package blob_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestBlob(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Blob Suite")
+}
@@ -0,0 +1,122 @@
+package blob_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/blob"
+	"golang.org/x/net/context"
+)
+
+// A stand-in for an S3 compatible service, keeps objects in memory and rejects unsigned requests
+type s3Server struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (self *s3Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") ||
+		req.Header.Get("X-Amz-Date") == "" {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	switch req.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(req.Body)
+		self.objects[req.URL.Path] = body
+	case "GET":
+		body, ok := self.objects[req.URL.Path]
+		if !ok {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.Write(body)
+	case "DELETE":
+		delete(self.objects, req.URL.Path)
+		resp.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// The behaviour every blob.Store must have
+func describeStore(newStore func() blob.Store) {
+	It("should read back what was written", func() {
+		store := newStore()
+		ctx := context.Background()
+		Expect(store.Put(ctx, "id-1", strings.NewReader("hello"), 5)).To(BeNil())
+
+		reader, err := store.Open(ctx, "id-1")
+		Expect(err).To(BeNil())
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		Expect(err).To(BeNil())
+		Expect(string(content)).To(Equal("hello"))
+	})
+
+	It("should return ErrNotFound once deleted", func() {
+		store := newStore()
+		ctx := context.Background()
+		Expect(store.Put(ctx, "id-1", strings.NewReader("hello"), 5)).To(BeNil())
+		Expect(store.Delete(ctx, "id-1")).To(BeNil())
+		Expect(store.Delete(ctx, "id-1")).To(BeNil())
+
+		_, err := store.Open(ctx, "id-1")
+		Expect(err).To(Equal(blob.ErrNotFound))
+	})
+
+	It("should reject keys that are not a single path element", func() {
+		_, err := newStore().Open(context.Background(), "../id-1")
+		Expect(err).NotTo(BeNil())
+	})
+}
+
+var _ = Describe("FileStore", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-blob")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	describeStore(func() blob.Store {
+		store, err := blob.NewFileStore(dir)
+		Expect(err).To(BeNil())
+		return store
+	})
+})
+
+var _ = Describe("S3Store", func() {
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		server = httptest.NewServer(&s3Server{objects: make(map[string][]byte)})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	describeStore(func() blob.Store {
+		store, err := blob.NewS3Store(blob.Config{
+			S3Endpoint:  server.URL,
+			S3Bucket:    "detka",
+			S3AccessKey: "access",
+			S3SecretKey: "secret",
+		})
+		Expect(err).To(BeNil())
+		return store
+	})
+})
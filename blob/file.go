@@ -0,0 +1,80 @@
+package blob
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Keeps each blob in a file, for single host deployments and testing
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, errors.New("the 'file' blob backend requires a directory")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "while creating blob dir")
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// The blob is written to a temporary file and renamed once it is on disk
+func (self *FileStore) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(self.dir, ".tmp-"+key)
+	if err != nil {
+		return errors.Wrap(err, "while creating blob file")
+	}
+
+	written, err := io.Copy(file, body)
+	if err == nil && written != size {
+		err = errors.Errorf("expected %d bytes got %d", size, written)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path.Join(self.dir, key))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.Wrapf(err, "while writing blob '%s'", key)
+	}
+	return nil
+}
+
+func (self *FileStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path.Join(self.dir, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "while opening blob '%s'", key)
+	}
+	return file, nil
+}
+
+func (self *FileStore) Delete(ctx context.Context, key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	if err := os.Remove(path.Join(self.dir, key)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "while deleting blob '%s'", key)
+	}
+	return nil
+}
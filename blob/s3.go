@@ -0,0 +1,222 @@
+package blob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Streamed bodies are not hashed before they are sent, S3 verifies them with the Content-Length
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Keeps each blob in an object of an S3 compatible service (AWS S3, MinIO, Ceph), requests
+// are signed with AWS Signature Version 4 and address the bucket in the path
+type S3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3Store(conf Config) (*S3Store, error) {
+	if conf.S3Endpoint == "" || conf.S3Bucket == "" {
+		return nil, errors.New("the 's3' blob backend requires an endpoint and bucket")
+	}
+	endpoint, err := url.Parse(conf.S3Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.Errorf("invalid s3 endpoint '%s'", conf.S3Endpoint)
+	}
+	region := conf.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Store{
+		endpoint:  endpoint,
+		bucket:    conf.S3Bucket,
+		region:    region,
+		accessKey: conf.S3AccessKey,
+		secretKey: conf.S3SecretKey,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (self *S3Store) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	req, err := self.newRequest(ctx, "PUT", key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := self.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "while writing blob '%s'", key)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (self *S3Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := self.newRequest(ctx, "GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := self.do(req)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrapf(err, "while opening blob '%s'", key)
+	}
+	return resp.Body, nil
+}
+
+func (self *S3Store) Delete(ctx context.Context, key string) error {
+	req, err := self.newRequest(ctx, "DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := self.do(req)
+	if err != nil && err != ErrNotFound {
+		return errors.Wrapf(err, "while deleting blob '%s'", key)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (self *S3Store) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	target := *self.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + self.bucket + "/" + key
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "while creating s3 request")
+	}
+	return req.WithContext(ctx), nil
+}
+
+// Sign and send the request, returns ErrNotFound for a 404 and an error for any other
+// unsuccessful status
+func (self *S3Store) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	signV4(req, self.accessKey, self.secretKey, self.region, time.Now())
+
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, errors.Errorf("s3 responded with '%s' - %s", resp.Status, message)
+}
+
+// Add the AWS Signature Version 4 'Authorization' header, every header of the request is
+// signed. The 'X-Amz-Content-Sha256' header must be set
+func signV4(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method,
+		escapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonical.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hashHex(request)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, escape(name)+"="+escape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func escapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = escape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Percent encode everything but the RFC 3986 unreserved characters
+func escape(value string) string {
+	var result strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			result.WriteByte(b)
+		} else {
+			fmt.Fprintf(&result, "%%%02X", b)
+		}
+	}
+	return result.String()
+}
+
+func hashHex(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,247 @@
+package boltdb
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/connection"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets created when the database is opened
+var (
+	MessagesBucket       = []byte("messages")
+	StatusIndexBucket    = []byte("index-status")
+	CreatedIndexBucket   = []byte("index-created")
+	RecipientIndexBucket = []byte("index-recipient")
+)
+
+type Config struct {
+	// Path of the database file, only one process may open the file at a time
+	Path string
+	// Rewrite the database file to reclaim free pages before opening it
+	CompactOnStart bool
+	// Periodically write a consistent copy of the database to this file, disabled if empty
+	BackupPath     string
+	BackupInterval time.Duration
+	// How to retry a failed open, the zero value uses connection.DefaultBackoff()
+	Backoff connection.Backoff
+}
+
+func ConfigFromOpts(opts *args.Options) Config {
+	return Config{
+		Path:           opts.String("bolt-path"),
+		CompactOnStart: opts.Bool("bolt-compact-on-start"),
+		BackupPath:     opts.String("bolt-backup-path"),
+		BackupInterval: time.Duration(opts.Int("bolt-backup-interval")) * time.Minute,
+		Backoff:        connection.BackoffFromOpts(opts),
+	}
+}
+
+type Manager struct {
+	*connection.Manager
+	config func() Config
+	db     *bolt.DB
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Create a manager for the 'bolt-path' database, the options are read again
+// on every reconnect. Call Start() to open the database
+func NewManager(parser *args.ArgParser) *Manager {
+	return newManager(func() Config { return ConfigFromOpts(parser.GetOpts()) })
+}
+
+// Create a manager that always opens the database using 'conf'
+func NewManagerFromConfig(conf Config) *Manager {
+	return newManager(func() Config { return conf })
+}
+
+func newManager(config func() Config) *Manager {
+	return &Manager{
+		Manager: connection.NewManager("bolt", connection.Backoff{}),
+		config:  config,
+	}
+}
+
+func (self *Manager) GetDB() (result *bolt.DB) {
+	self.WithLock(func() {
+		result = self.db
+	})
+	return
+}
+
+func (self *Manager) Start() {
+	self.done = make(chan struct{})
+	conf := self.config()
+	self.Manager.Reconfigure(conf.Path)
+	// run connect(), if it fails try again as the backoff config says
+	self.SetBackoff(conf.Backoff)
+	self.Begin(self.connect)
+
+	self.wg.Add(1)
+	go self.backupLoop()
+}
+
+// Apply the current config, reopens the database only if the path changed
+func (self *Manager) Reconfigure() bool {
+	conf := self.config()
+	self.SetBackoff(conf.Backoff)
+	return self.Manager.Reconfigure(conf.Path)
+}
+
+func (self *Manager) Stop() {
+	close(self.done)
+	self.wg.Wait()
+	self.End()
+	self.setDB(nil)
+}
+
+// Replace the current database, closing the previous database
+func (self *Manager) setDB(db *bolt.DB) {
+	var prev *bolt.DB
+	self.WithLock(func() {
+		prev = self.db
+		self.db = db
+	})
+	if prev != nil {
+		prev.Close()
+	}
+}
+
+func (self *Manager) connect() bool {
+	conf := self.config()
+	// Release the file lock before opening the database again
+	self.setDB(nil)
+
+	if conf.CompactOnStart {
+		if err := compact(conf.Path); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"type":   "bolt",
+				"method": "Manager.connect()",
+			}).Errorf("Compaction Failed - %s", err.Error())
+		}
+	}
+
+	logrus.Info("Opening bolt database ", conf.Path)
+	// Fail instead of waiting forever if another process holds the file lock
+	db, err := bolt.Open(conf.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"type":   "bolt",
+			"method": "Manager.connect()",
+		}).Errorf("Open Failed - %s", err.Error())
+		return false
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{MessagesBucket, StatusIndexBucket, CreatedIndexBucket,
+			RecipientIndexBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return errors.Wrapf(err, "while creating bucket '%s'", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"type":   "bolt",
+			"method": "Manager.connect()",
+		}).Error(err.Error())
+		db.Close()
+		return false
+	}
+
+	self.setDB(db)
+	return true
+}
+
+// Write a consistent copy of the open database to 'path' without blocking writers
+func (self *Manager) Backup(path string) error {
+	db := self.GetDB()
+	if db == nil {
+		return errors.New("Backup() Not Connected")
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "while creating backup file")
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(file)
+		return err
+	})
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "while writing backup")
+	}
+	// Replace the previous backup only once the new backup is complete
+	return errors.Wrap(os.Rename(tmp, path), "while renaming backup")
+}
+
+func (self *Manager) backupLoop() {
+	defer self.wg.Done()
+
+	conf := self.config()
+	if conf.BackupPath == "" || conf.BackupInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(conf.BackupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := self.Backup(conf.BackupPath); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"type":   "bolt",
+					"method": "Manager.backupLoop()",
+				}).Error(err.Error())
+			}
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// Copy the database at 'path' into a new file, leaving behind the free pages
+func compact(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	src, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "while opening database")
+	}
+	defer src.Close()
+
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return errors.Wrap(err, "while creating compacted database")
+	}
+
+	err = bolt.Compact(dst, src, 64*1024*1024)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "bolt.Compact()")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "while replacing database")
+}
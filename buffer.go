@@ -0,0 +1,252 @@
+package detka
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/disk"
+	"github.com/thrawn01/detka/envelope"
+	"github.com/thrawn01/detka/metrics"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+const bufferTopic = "messages"
+
+// Returned by StoreBuffer.Append() when the buffer has reached its size limit
+var ErrBufferFull = errors.New("store buffer is full")
+
+type StoreBufferConfig struct {
+	// Directory the buffer is stored in, an empty Dir disables the buffer
+	Dir string
+	// Append() returns ErrBufferFull once the buffered messages reach this size in bytes
+	MaxSize int64
+	// How long to wait before retrying a message that failed to replay
+	RetryInterval time.Duration
+	// Encrypts the buffered messages, nil buffers them in plaintext
+	Master envelope.MasterKey
+}
+
+func StoreBufferConfigFromOpts(opts *args.Options) StoreBufferConfig {
+	return StoreBufferConfig{
+		Dir:           opts.String("store-buffer-dir"),
+		MaxSize:       int64(opts.Int("store-buffer-max-size")) * 1024 * 1024,
+		RetryInterval: time.Second,
+	}
+}
+
+// A write ahead log of new messages the API accepted while the store was disconnected. Every
+// message is fsynced before Append() returns, encrypted with StoreBufferConfig.Master if set.
+// Once the store reconnects the messages are inserted into the store and queued for the workers
+// in the order they were accepted. A message is removed from the buffer only after it was
+// queued, so a crash while replaying may queue a message more than once
+type StoreBuffer struct {
+	conf    StoreBufferConfig
+	log     *disk.Queue
+	store   store.Store
+	queue   queue.Queue
+	keyFunc queue.KeyFunc
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewStoreBuffer(conf StoreBufferConfig, dbStore store.Store, msgQueue queue.Queue,
+	keyFunc queue.KeyFunc) (*StoreBuffer, error) {
+
+	log, err := disk.NewQueue(disk.Config{
+		Dir:            conf.Dir,
+		Group:          "replay",
+		Fsync:          disk.FsyncAlways,
+		SegmentSize:    4 * 1024 * 1024,
+		PollInterval:   100 * time.Millisecond,
+		CommitInterval: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Resumes replay of any messages buffered before we were restarted
+	records, err := log.Subscribe(bufferTopic)
+	if err != nil {
+		log.Stop()
+		return nil, err
+	}
+
+	self := &StoreBuffer{
+		conf:    conf,
+		log:     log,
+		store:   dbStore,
+		queue:   msgQueue,
+		keyFunc: keyFunc,
+		done:    make(chan struct{}),
+	}
+	self.updateSize()
+
+	self.wg.Add(1)
+	go self.replay(records)
+	return self, nil
+}
+
+// Durably buffer the message until the store is connected
+func (self *StoreBuffer) Append(msg *models.Message) error {
+	size, err := self.log.Size(bufferTopic)
+	if err != nil {
+		return err
+	}
+	if size >= self.conf.MaxSize {
+		metrics.StoreBufferRejected.Inc()
+		return ErrBufferFull
+	}
+
+	if len(msg.Id) == 0 {
+		msg.Id = models.NewId()
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal()")
+	}
+	// Bound to the message id, so a buffered message can't be replayed as another
+	if self.conf.Master != nil {
+		encrypted, err := envelope.Encrypt(self.conf.Master, string(payload), msg.Id)
+		if err != nil {
+			return err
+		}
+		payload = []byte(encrypted)
+	}
+
+	record := queue.Record{Topic: bufferTopic, Key: []byte(msg.Id), Value: payload}
+	if err := self.log.Publish(&record); err != nil {
+		return err
+	}
+	metrics.StoreBufferAppended.Inc()
+	self.updateSize()
+	return nil
+}
+
+func (self *StoreBuffer) replay(records <-chan *queue.Record) {
+	defer self.wg.Done()
+
+	for {
+		select {
+		case record := <-records:
+			msg, err := self.decode(record)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"method": "StoreBuffer.replay()",
+					"type":   "buffer",
+					"result": "discarded",
+				}).Error(fmt.Sprintf("%s - buffered message '%s'", err.Error(), string(record.Key)))
+				self.log.Ack(record)
+				continue
+			}
+
+			if !self.retry(func() error { return self.insert(msg) }) {
+				return
+			}
+			if !self.retry(func() error { return Enqueue(context.Background(), self.queue, self.keyFunc, msg) }) {
+				return
+			}
+
+			self.log.Ack(record)
+			metrics.StoreBufferReplayed.Inc()
+			self.updateSize()
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// Decrypts the record if it was encrypted, messages buffered before encryption was enabled
+// are plaintext
+func (self *StoreBuffer) decode(record *queue.Record) (*models.Message, error) {
+	payload := string(record.Value)
+	if envelope.IsEncrypted(payload) {
+		if self.conf.Master == nil {
+			return nil, errors.New("message is encrypted and no master key is configured")
+		}
+		var err error
+		if payload, err = envelope.Decrypt(self.conf.Master, payload, string(record.Key)); err != nil {
+			return nil, err
+		}
+	}
+
+	var msg models.Message
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal()")
+	}
+	return &msg, nil
+}
+
+// Insert the message unless a previous replay already inserted it
+func (self *StoreBuffer) insert(msg *models.Message) error {
+	if !self.store.IsConnected() {
+		return errors.New("store not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	_, err := self.store.GetMessage(ctx, msg.Id)
+	if err == nil {
+		return nil
+	}
+	if !store.IsNotFound(err) {
+		return err
+	}
+	return self.store.InsertMessage(ctx, msg)
+}
+
+// Call 'operation' until it succeeds, returns false if the buffer was stopped
+func (self *StoreBuffer) retry(operation func() error) bool {
+	for {
+		err := operation()
+		if err == nil {
+			return true
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"method": "StoreBuffer.replay()",
+			"type":   "buffer",
+			"result": "retry",
+		}).Debug(err.Error())
+
+		select {
+		case <-time.After(self.conf.RetryInterval):
+		case <-self.done:
+			return false
+		}
+	}
+}
+
+func (self *StoreBuffer) updateSize() {
+	if size, err := self.log.Size(bufferTopic); err == nil {
+		metrics.StoreBufferSize.Set(float64(size))
+	}
+}
+
+func (self *StoreBuffer) Stop() {
+	close(self.done)
+	self.wg.Wait()
+	self.log.Stop()
+}
+
+type bufferContextKey int
+
+const storeBufferKey bufferContextKey = 1
+
+func SetStoreBuffer(ctx context.Context, buffer *StoreBuffer) context.Context {
+	return context.WithValue(ctx, storeBufferKey, buffer)
+}
+
+// Returns the StoreBuffer in the context, nil if none was injected
+func GetStoreBuffer(ctx context.Context) *StoreBuffer {
+	obj, _ := ctx.Value(storeBufferKey).(*StoreBuffer)
+	return obj
+}
@@ -0,0 +1,104 @@
+package detka_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka"
+	"github.com/thrawn01/detka/envelope"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("StoreBuffer", func() {
+	var dir string
+	var dbStore *store.MemoryStore
+	var msgQueue *queue.MemoryQueue
+	var buffer *detka.StoreBuffer
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-buffer")
+		Expect(err).To(BeNil())
+
+		dbStore = store.NewMemoryStore()
+		dbStore.SetConnected(false)
+		msgQueue = queue.NewMemoryQueue(10)
+		buffer, err = detka.NewStoreBuffer(detka.StoreBufferConfig{
+			Dir:           dir,
+			MaxSize:       1024 * 1024,
+			RetryInterval: 10 * time.Millisecond,
+		}, dbStore, msgQueue, queue.DomainKey)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		buffer.Stop()
+		msgQueue.Stop()
+		os.RemoveAll(dir)
+	})
+
+	Context("When the store reconnects", func() {
+		It("should insert and queue the buffered messages", func() {
+			records, _ := msgQueue.Subscribe("normal")
+			msg := models.Message{Id: "id-1", To: "devs@mailgun.net", Priority: "normal", Status: "NEW"}
+			Expect(buffer.Append(&msg)).To(BeNil())
+
+			Consistently(records, 50*time.Millisecond).ShouldNot(Receive())
+			dbStore.SetConnected(true)
+
+			var record *queue.Record
+			Eventually(records).Should(Receive(&record))
+			Expect(string(record.Key)).To(Equal("mailgun.net"))
+
+			inserted, err := dbStore.GetMessage(context.Background(), "id-1")
+			Expect(err).To(BeNil())
+			Expect(inserted.Status).To(Equal("NEW"))
+		})
+	})
+
+	Context("When encryption is enabled", func() {
+		It("should encrypt the buffered messages", func() {
+			buffer.Stop()
+			master, err := envelope.NewLocalKMS(path.Join(dir, "kms"))
+			Expect(err).To(BeNil())
+			buffer, err = detka.NewStoreBuffer(detka.StoreBufferConfig{
+				Dir:           path.Join(dir, "encrypted"),
+				MaxSize:       1024 * 1024,
+				RetryInterval: 10 * time.Millisecond,
+				Master:        master,
+			}, dbStore, msgQueue, queue.DomainKey)
+			Expect(err).To(BeNil())
+
+			msg := models.Message{Id: "id-1", To: "devs@mailgun.net", Text: "secret body", Status: "NEW"}
+			Expect(buffer.Append(&msg)).To(BeNil())
+
+			var plaintext bool
+			filepath.Walk(path.Join(dir, "encrypted"), func(name string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					content, _ := ioutil.ReadFile(name)
+					plaintext = plaintext || strings.Contains(string(content), "secret body")
+				}
+				return nil
+			})
+			Expect(plaintext).To(Equal(false))
+
+			dbStore.SetConnected(true)
+			Eventually(func() string {
+				inserted, _ := dbStore.GetMessage(context.Background(), "id-1")
+				if inserted == nil {
+					return ""
+				}
+				return inserted.Text
+			}).Should(Equal("secret body"))
+		})
+	})
+})
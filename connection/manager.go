@@ -1,15 +1,123 @@
 package connection
 
 import (
+	"math"
+	"math/rand"
+	"reflect"
 	"sync"
 	"time"
+
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/metrics"
+)
+
+// The states reported to observers as the manager connects
+type State string
+
+const (
+	Connecting   State = "connecting"
+	Connected    State = "connected"
+	Disconnected State = "disconnected"
+	// The manager gave up after Backoff.MaxAttempts, a Signal() tries again
+	Failed State = "failed"
 )
 
+var states = []State{Connecting, Connected, Disconnected, Failed}
+
+// Called with the name of the backend each time the state of the connection changes
+type Observer func(backend string, state State)
+
+// How Begin() waits between failed connect attempts
+type Backoff struct {
+	// The wait after the first failed attempt
+	Initial time.Duration
+	// The wait never grows past Max
+	Max time.Duration
+	// Each wait is the previous wait times Multiplier
+	Multiplier float64
+	// Percent of the wait that is randomized, 20 waits between 80% and 120% of the wait
+	Jitter int
+	// Report Failed and stop retrying after this many failed attempts in a row, 0 retries forever
+	MaxAttempts int
+}
+
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Initial:    time.Second,
+		Max:        time.Second * 30,
+		Multiplier: 2,
+		Jitter:     20,
+	}
+}
+
+// Options not set use the DefaultBackoff()
+func BackoffFromOpts(opts *args.Options) Backoff {
+	return Backoff{
+		Initial:     time.Duration(opts.Int("connect-backoff-initial")) * time.Millisecond,
+		Max:         time.Duration(opts.Int("connect-backoff-max")) * time.Millisecond,
+		Jitter:      opts.Int("connect-backoff-jitter"),
+		MaxAttempts: opts.Int("connect-max-attempts"),
+	}
+}
+
+// Returns the wait after 'attempt' failed attempts in a row
+func (self Backoff) Wait(attempt int) time.Duration {
+	self = self.withDefaults()
+	wait := float64(self.Initial) * math.Pow(self.Multiplier, float64(attempt-1))
+	if wait > float64(self.Max) {
+		wait = float64(self.Max)
+	}
+	if self.Jitter > 0 {
+		wait += wait * float64(self.Jitter) / 100 * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(wait)
+}
+
+func (self Backoff) withDefaults() Backoff {
+	defaults := DefaultBackoff()
+	if self.Initial <= 0 {
+		self.Initial = defaults.Initial
+	}
+	if self.Max < self.Initial {
+		self.Max = defaults.Max
+		if self.Max < self.Initial {
+			self.Max = self.Initial
+		}
+	}
+	if self.Multiplier < 1 {
+		self.Multiplier = defaults.Multiplier
+	}
+	return self
+}
+
+// Counts the users of a connection, so the connection is closed once they are done
+type lease struct {
+	value interface{}
+	users sync.WaitGroup
+}
+
+// Connects in the background and reconnects when signaled. The zero value reports no
+// metrics and uses the DefaultBackoff()
 type Manager struct {
 	done      chan struct{}
 	reconnect chan bool
 	mutex     sync.Mutex
-	value     interface{}
+	current   *lease
+	running   bool
+
+	backend string
+	backoff Backoff
+	// Guards state, observers and config, separate from 'mutex' so observers may call WithLock()
+	stateMutex sync.Mutex
+	state      State
+	observers  []Observer
+	config     interface{}
+	configured bool
+}
+
+// Create a manager that reports metrics for 'backend' and retries as 'backoff' says
+func NewManager(backend string, backoff Backoff) *Manager {
+	return &Manager{backend: backend, backoff: backoff}
 }
 
 func (self *Manager) WithLock(callBack func()) {
@@ -18,36 +126,187 @@ func (self *Manager) WithLock(callBack func()) {
 	self.mutex.Unlock()
 }
 
+// Run the callBack given to Begin() again, returns without waiting if the manager has ended
 func (self *Manager) Signal() {
-	self.reconnect <- true
+	var reconnect chan bool
+	var done chan struct{}
+	self.WithLock(func() {
+		reconnect, done = self.reconnect, self.done
+	})
+	select {
+	case reconnect <- true:
+	case <-done:
+	}
 }
 
-func (self *Manager) Begin(callBack func() bool, waitTime time.Duration) {
-	//fmt.Printf("Begin()\n")
-	self.reconnect = make(chan bool)
-	self.done = make(chan struct{})
+// Returns the connection given to Swap(), nil if not connected. The caller must call the
+// returned func once done with the connection, the connection is not closed until then
+func (self *Manager) Acquire() (interface{}, func()) {
+	self.mutex.Lock()
+	current := self.current
+	if current == nil {
+		self.mutex.Unlock()
+		return nil, func() {}
+	}
+	current.users.Add(1)
+	self.mutex.Unlock()
+
+	var once sync.Once
+	return current.value, func() { once.Do(current.users.Done) }
+}
+
+// Returns the connection given to Swap() without acquiring it, nil if not connected
+func (self *Manager) Current() (result interface{}) {
+	self.WithLock(func() {
+		if self.current != nil {
+			result = self.current.value
+		}
+	})
+	return
+}
+
+// Replace the current connection with 'value', nil to disconnect. Returns a func that waits
+// until the users that acquired the previous connection are done and then passes it to 'closer'
+func (self *Manager) Swap(value interface{}, closer func(interface{})) func() {
+	var previous *lease
+	self.WithLock(func() {
+		previous = self.current
+		self.current = nil
+		if value != nil {
+			self.current = &lease{value: value}
+		}
+	})
+	return func() {
+		if previous == nil {
+			return
+		}
+		previous.users.Wait()
+		closer(previous.value)
+	}
+}
+
+// Signals a reconnect if 'config' differs from the config given to the previous call, the
+// first call only records 'config'. Returns true if a reconnect was signaled. Embedders call
+// this with the options their connection depends on, so a config reload that leaves those
+// options alone keeps the current connection
+func (self *Manager) Reconfigure(config interface{}) bool {
+	self.stateMutex.Lock()
+	changed := self.configured && !reflect.DeepEqual(self.config, config)
+	self.config, self.configured = config, true
+	self.stateMutex.Unlock()
+
+	if changed {
+		self.Signal()
+	}
+	return changed
+}
+
+// Replace the backoff used after the next failed attempt
+func (self *Manager) SetBackoff(backoff Backoff) {
+	self.stateMutex.Lock()
+	self.backoff = backoff
+	self.stateMutex.Unlock()
+}
+
+// Call 'observer' on every change of state, observers are called in order from the
+// goroutine started by Begin() and must not block
+func (self *Manager) Observe(observer Observer) {
+	self.stateMutex.Lock()
+	self.observers = append(self.observers, observer)
+	self.stateMutex.Unlock()
+}
+
+// Returns the current state of the connection, empty before Begin()
+func (self *Manager) State() State {
+	self.stateMutex.Lock()
+	defer self.stateMutex.Unlock()
+	return self.state
+}
+
+func (self *Manager) setState(state State) {
+	self.stateMutex.Lock()
+	if self.state == state {
+		self.stateMutex.Unlock()
+		return
+	}
+	self.state = state
+	observers := make([]Observer, len(self.observers))
+	copy(observers, self.observers)
+	self.stateMutex.Unlock()
+
+	if self.backend != "" {
+		for _, other := range states {
+			value := 0.0
+			if other == state {
+				value = 1
+			}
+			metrics.ConnectionState.WithLabelValues(self.backend, string(other)).Set(value)
+		}
+	}
+	for _, observer := range observers {
+		observer(self.backend, state)
+	}
+}
+
+// Run 'callBack' until it returns true, waiting as the Backoff says between failed attempts.
+// A Signal() runs 'callBack' again. Returns once the first attempt finishes, calling Begin()
+// again ends the previous goroutine first
+func (self *Manager) Begin(callBack func() bool) {
+	self.End()
+
+	// The goroutine keeps its own copy of the channels, so the manager can Begin() again after End()
+	reconnect := make(chan bool)
+	done := make(chan struct{})
+	self.WithLock(func() {
+		self.reconnect = reconnect
+		self.done = done
+		self.running = true
+	})
 
 	var attemptedConnect sync.WaitGroup
+	attemptedConnect.Add(1)
 
 	go func() {
 		var once sync.Once
-		attemptedConnect.Add(1)
+		var timer <-chan time.Time
+		var attempts int
+		first := true
 
 		for {
-			var timer <-chan time.Time
-
 			select {
-			case <-self.reconnect:
-				goto connect
+			case <-reconnect:
+				if self.State() == Connected {
+					self.setState(Disconnected)
+				}
 			case <-timer:
-				goto connect
-			case <-self.done:
+			case <-done:
 				return
 			}
-		connect:
+			timer = nil
+
+			if !first && self.backend != "" {
+				metrics.ConnectionReconnects.WithLabelValues(self.backend).Inc()
+			}
+			first = false
+
 			// Attempt to connect, if we fail to connect, set a timer to try again
-			if !callBack() {
-				timer = time.NewTimer(waitTime).C
+			self.setState(Connecting)
+			if callBack() {
+				attempts = 0
+				self.setState(Connected)
+			} else {
+				self.stateMutex.Lock()
+				backoff := self.backoff
+				self.stateMutex.Unlock()
+
+				attempts++
+				if backoff.MaxAttempts != 0 && attempts >= backoff.MaxAttempts {
+					attempts = 0
+					self.setState(Failed)
+				} else {
+					self.setState(Disconnected)
+					timer = time.NewTimer(backoff.Wait(attempts)).C
+				}
 			}
 			once.Do(func() { attemptedConnect.Done() })
 		}
@@ -59,7 +318,12 @@ func (self *Manager) Begin(callBack func() bool, waitTime time.Duration) {
 	attemptedConnect.Wait()
 }
 
+// Stop the goroutine started by Begin(), does nothing if not running
 func (self *Manager) End() {
-	//fmt.Printf("Close()\n")
-	close(self.done)
+	self.WithLock(func() {
+		if self.running {
+			close(self.done)
+			self.running = false
+		}
+	})
 }
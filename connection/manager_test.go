@@ -0,0 +1,110 @@
+package connection_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/connection"
+)
+
+var _ = Describe("Backoff", func() {
+	It("should grow the wait until it reaches the max", func() {
+		backoff := connection.Backoff{Initial: time.Second, Max: time.Second * 5, Multiplier: 2}
+		Expect(backoff.Wait(1)).To(Equal(time.Second))
+		Expect(backoff.Wait(3)).To(Equal(time.Second * 4))
+		Expect(backoff.Wait(10)).To(Equal(time.Second * 5))
+	})
+
+	It("should randomize the wait by the jitter percent", func() {
+		backoff := connection.Backoff{Initial: time.Second, Max: time.Second, Multiplier: 2, Jitter: 20}
+		for i := 0; i < 100; i++ {
+			Expect(backoff.Wait(1)).To(BeNumerically("~", time.Second, time.Millisecond*200))
+		}
+	})
+})
+
+var _ = Describe("Manager", func() {
+	It("should retry until it reaches the max attempts then report failed", func() {
+		manager := connection.NewManager("", connection.Backoff{
+			Initial:     time.Millisecond,
+			MaxAttempts: 3,
+		})
+
+		var mutex sync.Mutex
+		var states []connection.State
+		manager.Observe(func(backend string, state connection.State) {
+			mutex.Lock()
+			states = append(states, state)
+			mutex.Unlock()
+		})
+
+		var attempts int
+		manager.Begin(func() bool {
+			mutex.Lock()
+			attempts++
+			mutex.Unlock()
+			return false
+		})
+		defer manager.End()
+
+		Eventually(manager.State).Should(Equal(connection.Failed))
+		mutex.Lock()
+		defer mutex.Unlock()
+		Expect(attempts).To(Equal(3))
+		Expect(states).To(Equal([]connection.State{
+			connection.Connecting, connection.Disconnected,
+			connection.Connecting, connection.Disconnected,
+			connection.Connecting, connection.Failed,
+		}))
+	})
+
+	It("should report disconnected when signaled to reconnect", func() {
+		manager := connection.NewManager("", connection.Backoff{})
+		first := true
+		manager.Begin(func() bool {
+			result := first
+			first = false
+			return result
+		})
+		defer manager.End()
+
+		Expect(manager.State()).To(Equal(connection.Connected))
+		manager.Signal()
+		Eventually(manager.State).Should(Equal(connection.Disconnected))
+	})
+
+	It("should reconnect only when the config changes", func() {
+		manager := connection.NewManager("", connection.Backoff{})
+		var attempts int32
+		manager.Begin(func() bool {
+			atomic.AddInt32(&attempts, 1)
+			return true
+		})
+		defer manager.End()
+
+		Expect(manager.Reconfigure([]string{"localhost:9092"})).To(BeFalse())
+		Expect(manager.Reconfigure([]string{"localhost:9092"})).To(BeFalse())
+		Expect(manager.Reconfigure([]string{"kafka:9092"})).To(BeTrue())
+		Eventually(func() int32 { return atomic.LoadInt32(&attempts) }).Should(Equal(int32(2)))
+	})
+
+	It("should close a replaced connection once its users are done", func() {
+		manager := connection.NewManager("", connection.Backoff{})
+		closed := make(chan interface{}, 1)
+		closer := func(value interface{}) { closed <- value }
+
+		manager.Swap("first", closer)()
+		value, release := manager.Acquire()
+		Expect(value).To(Equal("first"))
+
+		go manager.Swap("second", closer)()
+		Expect(manager.Current()).To(Equal("second"))
+		Consistently(closed).ShouldNot(Receive())
+
+		release()
+		Eventually(closed).Should(Receive(Equal("first")))
+	})
+})
@@ -0,0 +1,507 @@
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Each record in a segment is prefixed with the length and crc32 of the payload
+const headerSize = 8
+
+const segmentSuffix = ".log"
+
+// Fsync policies for Log.Append()
+const (
+	// Fsync every record before Append() returns
+	FsyncAlways = "always"
+	// Fsync the active segment every Config.FsyncInterval
+	FsyncInterval = "interval"
+	// Leave it up to the operating system
+	FsyncNever = "never"
+)
+
+var ErrCorrupt = errors.New("corrupt record")
+
+// An append-only log split into segment files. Segments are named after the byte offset
+// of their first record within the log, so the offset of any record is the base offset
+// of its segment plus its position within the segment. Multiple processes on the same
+// host may append to the same log, appends are serialized with an exclusive flock()
+type Log struct {
+	mutex       sync.Mutex
+	dir         string
+	segmentSize int64
+	fsync       string
+	lock        *os.File
+	file        *os.File
+	base        int64
+	done        chan struct{}
+}
+
+func OpenLog(dir string, fsync string, fsyncInterval time.Duration, segmentSize int64) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "MkdirAll('%s')", dir)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open lock file")
+	}
+
+	self := &Log{
+		dir:         dir,
+		segmentSize: segmentSize,
+		fsync:       fsync,
+		lock:        lock,
+		done:        make(chan struct{}),
+	}
+
+	if err := self.recover(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	if fsync == FsyncInterval {
+		go self.syncEvery(fsyncInterval)
+	}
+	return self, nil
+}
+
+// Append the payload to the log, returns the offset of the new record
+func (self *Log) Append(payload []byte) (int64, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.flock(); err != nil {
+		return 0, err
+	}
+	defer self.funlock()
+
+	size, err := self.activate()
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[headerSize:], payload)
+
+	if _, err := self.file.Write(buf); err != nil {
+		return 0, errors.Wrap(err, "segment write")
+	}
+
+	if self.fsync == FsyncAlways {
+		if err := self.file.Sync(); err != nil {
+			return 0, errors.Wrap(err, "segment fsync")
+		}
+	}
+	return self.base + size, nil
+}
+
+// Delete every segment that only contains records before 'offset', the active segment is never removed
+func (self *Log) Compact(offset int64) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.flock(); err != nil {
+		return err
+	}
+	defer self.funlock()
+
+	segments, err := listSegments(self.dir)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(segments)-1; i++ {
+		// The next segment begins where this segment ends
+		if segments[i+1] > offset {
+			return nil
+		}
+		if err := os.Remove(segmentPath(self.dir, segments[i])); err != nil {
+			return errors.Wrap(err, "remove segment")
+		}
+		logrus.Debugf("Compacted segment %d from '%s'", segments[i], self.dir)
+	}
+	return nil
+}
+
+// Returns the total size in bytes of every segment in the log
+func (self *Log) Size() (int64, error) {
+	files, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "ReadDir('%s')", self.dir)
+	}
+
+	var result int64
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), segmentSuffix) {
+			result += file.Size()
+		}
+	}
+	return result, nil
+}
+
+func (self *Log) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	close(self.done)
+	if self.file != nil {
+		self.file.Sync()
+		self.file.Close()
+		self.file = nil
+	}
+	return self.lock.Close()
+}
+
+// Open the last segment for writing (another process may have rolled to a new segment)
+// and roll to a new segment if the active segment is full. Returns the size of the segment
+func (self *Log) activate() (int64, error) {
+	segments, err := listSegments(self.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var base int64
+	if len(segments) != 0 {
+		base = segments[len(segments)-1]
+	}
+
+	if self.file == nil || self.base != base {
+		if err := self.openSegment(base); err != nil {
+			return 0, err
+		}
+	}
+
+	info, err := self.file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "segment stat")
+	}
+
+	if info.Size() < self.segmentSize {
+		return info.Size(), nil
+	}
+
+	// Roll to a new segment
+	if err := self.openSegment(base + info.Size()); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (self *Log) openSegment(base int64) error {
+	if self.file != nil {
+		self.file.Sync()
+		self.file.Close()
+		self.file = nil
+	}
+
+	file, err := os.OpenFile(segmentPath(self.dir, base), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open segment")
+	}
+	self.file = file
+	self.base = base
+	return nil
+}
+
+// Truncate a partially written record a crashed writer left at the end of the last segment.
+// Corrupt records that are complete are left for the readers to skip
+func (self *Log) recover() error {
+	if err := self.flock(); err != nil {
+		return err
+	}
+	defer self.funlock()
+
+	segments, err := listSegments(self.dir)
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+
+	base := segments[len(segments)-1]
+	file, err := os.OpenFile(segmentPath(self.dir, base), os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open segment")
+	}
+	defer file.Close()
+
+	var position int64
+	for {
+		_, next, err := readRecord(file, position)
+		if err == ErrCorrupt {
+			logrus.WithFields(logrus.Fields{
+				"method": "Log.recover()",
+				"type":   "disk",
+			}).Errorf("Corrupt record at offset %d in '%s'", base+position, self.dir)
+			position = next
+			continue
+		}
+		if err == nil {
+			position = next
+			continue
+		}
+
+		// The record is incomplete, either it is the torn last record or its length is
+		// corrupt. Only a torn last record is truncated, the records after a corrupt length
+		// were written and possibly fsynced, so they are kept
+		resync, err := findRecord(file, position+headerSize)
+		if err != nil {
+			return err
+		}
+		if resync == -1 {
+			break
+		}
+		logrus.WithFields(logrus.Fields{
+			"method": "Log.recover()",
+			"type":   "disk",
+		}).Errorf("Corrupt length of the record at offset %d in '%s', skipping %d bytes",
+			base+position, self.dir, resync-position)
+		if err := skipRecord(file, position, resync); err != nil {
+			return err
+		}
+		position = resync
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "segment stat")
+	}
+
+	if info.Size() != position {
+		logrus.WithFields(logrus.Fields{
+			"method": "Log.recover()",
+			"type":   "disk",
+		}).Errorf("Truncating %d bytes of torn records from segment %d in '%s'",
+			info.Size()-position, base, self.dir)
+		return errors.Wrap(file.Truncate(position), "segment truncate")
+	}
+	return nil
+}
+
+func (self *Log) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			self.mutex.Lock()
+			if self.file != nil {
+				self.file.Sync()
+			}
+			self.mutex.Unlock()
+		case <-self.done:
+			return
+		}
+	}
+}
+
+func (self *Log) flock() error {
+	return errors.Wrap(syscall.Flock(int(self.lock.Fd()), syscall.LOCK_EX), "flock")
+}
+
+func (self *Log) funlock() {
+	syscall.Flock(int(self.lock.Fd()), syscall.LOCK_UN)
+}
+
+// Reads records from a log, a log may have many readers in many processes
+type Reader struct {
+	dir  string
+	file *os.File
+	base int64
+}
+
+func NewReader(dir string) *Reader {
+	return &Reader{dir: dir}
+}
+
+// Read the record at 'offset'. Returns the payload, the offset of the record read and the
+// offset of the record after it. If 'offset' was compacted the oldest record is returned
+// instead, corrupt records are skipped. Returns io.EOF if there is no complete record at
+// 'offset' yet
+func (self *Reader) Read(offset int64) ([]byte, int64, int64, error) {
+	segments, err := listSegments(self.dir)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	for {
+		// Find the segment that contains the offset
+		idx := -1
+		for i, base := range segments {
+			if base > offset {
+				break
+			}
+			idx = i
+		}
+
+		if idx == -1 {
+			if len(segments) == 0 {
+				return nil, 0, 0, io.EOF
+			}
+			// Offset was compacted, resume from the oldest segment
+			idx, offset = 0, segments[0]
+		}
+
+		if err := self.open(segments[idx]); err != nil {
+			return nil, 0, 0, err
+		}
+
+		payload, next, err := readRecord(self.file, offset-self.base)
+		if err == nil {
+			return payload, offset, self.base + next, nil
+		}
+
+		// The length of a corrupt record is intact as far as we can tell, continue after it
+		if err == ErrCorrupt {
+			logrus.WithFields(logrus.Fields{
+				"method": "Reader.Read()",
+				"type":   "disk",
+			}).Errorf("Skipping corrupt record at offset %d in '%s'", offset, self.dir)
+			offset = self.base + next
+			continue
+		}
+
+		// Reached the end of a segment that was rolled, continue with the next segment
+		if idx+1 < len(segments) {
+			offset = segments[idx+1]
+			continue
+		}
+		return nil, 0, 0, io.EOF
+	}
+}
+
+func (self *Reader) open(base int64) error {
+	if self.file != nil && self.base == base {
+		return nil
+	}
+	self.Close()
+
+	file, err := os.Open(segmentPath(self.dir, base))
+	if err != nil {
+		return errors.Wrap(err, "open segment")
+	}
+	self.file = file
+	self.base = base
+	return nil
+}
+
+func (self *Reader) Close() {
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+}
+
+// Read the record at 'position' in the segment, returns the payload and the position of the next
+// record. Returns io.EOF if the record is incomplete and ErrCorrupt along with the position of the
+// next record if the checksum doesn't match
+func readRecord(file *os.File, position int64) ([]byte, int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, position); err != nil {
+		return nil, 0, io.EOF
+	}
+
+	// Avoid allocating the length of a torn header
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	info, err := file.Stat()
+	if err != nil || position+headerSize+length > info.Size() {
+		return nil, 0, io.EOF
+	}
+
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, position+headerSize); err != nil {
+		return nil, 0, io.EOF
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, position + headerSize + length, ErrCorrupt
+	}
+	return payload, position + headerSize + int64(len(payload)), nil
+}
+
+// Returns the position of the first intact record at or after 'from', -1 if there is none
+func findRecord(file *os.File, from int64) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "segment stat")
+	}
+	if from >= info.Size() {
+		return -1, nil
+	}
+
+	data := make([]byte, info.Size()-from)
+	if _, err := file.ReadAt(data, from); err != nil && err != io.EOF {
+		return 0, errors.Wrap(err, "segment read")
+	}
+
+	for i := 0; i+headerSize <= len(data); i++ {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		// Empty records are never appended, so a run of zeros is not mistaken for a record
+		if length == 0 || length > len(data)-i-headerSize {
+			continue
+		}
+		payload := data[i+headerSize : i+headerSize+length]
+		if crc32.ChecksumIEEE(payload) == binary.BigEndian.Uint32(data[i+4:i+8]) {
+			return from + int64(i), nil
+		}
+	}
+	return -1, nil
+}
+
+// Replace the header at 'position' with one that spans the bytes up to 'next' and fails the
+// crc32, so readers skip them as a corrupt record
+func skipRecord(file *os.File, position, next int64) error {
+	payload := make([]byte, next-position-headerSize)
+	if _, err := file.ReadAt(payload, position+headerSize); err != nil {
+		return errors.Wrap(err, "segment read")
+	}
+
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], ^crc32.ChecksumIEEE(payload))
+	if _, err := file.WriteAt(header, position); err != nil {
+		return errors.Wrap(err, "segment write")
+	}
+	return errors.Wrap(file.Sync(), "segment fsync")
+}
+
+// Returns the base offsets of all the segments in the directory in ascending order
+func listSegments(dir string) ([]int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ReadDir('%s')", dir)
+	}
+
+	var segments []int64
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, base)
+	}
+	// ReadDir() sorts by name, and the names are zero padded
+	return segments, nil
+}
+
+func segmentPath(dir string, base int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, segmentSuffix))
+}
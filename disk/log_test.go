@@ -0,0 +1,129 @@
+package disk_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/disk"
+)
+
+var _ = Describe("Log", func() {
+	var dir string
+	var log *disk.Log
+	var offsets []int64
+
+	// Flip the byte at 'position' of the first segment
+	flip := func(position int64) {
+		file, err := os.OpenFile(segments(dir)[0], os.O_RDWR, 0644)
+		Expect(err).To(BeNil())
+		defer file.Close()
+
+		buf := make([]byte, 1)
+		_, err = file.ReadAt(buf, position)
+		Expect(err).To(BeNil())
+		buf[0] ^= 0xff
+		_, err = file.WriteAt(buf, position)
+		Expect(err).To(BeNil())
+	}
+
+	// Flip a byte in the payload of the record at 'offset' of the first segment
+	corrupt := func(offset int64) {
+		flip(offset + 9)
+	}
+
+	readAll := func() []string {
+		reader := disk.NewReader(dir)
+		defer reader.Close()
+
+		var results []string
+		var offset int64
+		for {
+			payload, _, next, err := reader.Read(offset)
+			if err == io.EOF {
+				return results
+			}
+			Expect(err).To(BeNil())
+			results = append(results, string(payload))
+			offset = next
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-log")
+		Expect(err).To(BeNil())
+		log, err = disk.OpenLog(dir, disk.FsyncAlways, 0, 1024*1024)
+		Expect(err).To(BeNil())
+
+		offsets = nil
+		for _, payload := range []string{"record-1", "record-2", "record-3"} {
+			offset, err := log.Append([]byte(payload))
+			Expect(err).To(BeNil())
+			offsets = append(offsets, offset)
+		}
+	})
+
+	AfterEach(func() {
+		log.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("When a record in the middle of the active segment is corrupt", func() {
+		It("should skip the record and read the records after it", func() {
+			corrupt(offsets[1])
+			Expect(readAll()).To(Equal([]string{"record-1", "record-3"}))
+
+			_, err := log.Append([]byte("record-4"))
+			Expect(err).To(BeNil())
+			Expect(readAll()).To(Equal([]string{"record-1", "record-3", "record-4"}))
+		})
+
+		It("should not truncate the records after it when recovering", func() {
+			corrupt(offsets[1])
+			log.Close()
+
+			var err error
+			log, err = disk.OpenLog(dir, disk.FsyncAlways, 0, 1024*1024)
+			Expect(err).To(BeNil())
+			Expect(readAll()).To(Equal([]string{"record-1", "record-3"}))
+		})
+	})
+
+	Context("When the length of a record in the middle of the active segment is corrupt", func() {
+		It("should keep the records after it when recovering", func() {
+			// The length now points past the end of the segment
+			flip(offsets[1])
+			log.Close()
+
+			var err error
+			log, err = disk.OpenLog(dir, disk.FsyncAlways, 0, 1024*1024)
+			Expect(err).To(BeNil())
+			Expect(readAll()).To(Equal([]string{"record-1", "record-3"}))
+
+			_, err = log.Append([]byte("record-4"))
+			Expect(err).To(BeNil())
+			Expect(readAll()).To(Equal([]string{"record-1", "record-3", "record-4"}))
+		})
+	})
+
+	Context("When the last record in the segment is incomplete", func() {
+		It("should truncate the record when recovering", func() {
+			log.Close()
+			file, err := os.OpenFile(segments(dir)[0], os.O_WRONLY|os.O_APPEND, 0644)
+			Expect(err).To(BeNil())
+			// A header that claims a longer payload than was written
+			_, err = file.Write([]byte{0, 0, 1, 0, 0, 0, 0, 0, 't', 'o', 'r', 'n'})
+			Expect(err).To(BeNil())
+			file.Close()
+
+			log, err = disk.OpenLog(dir, disk.FsyncAlways, 0, 1024*1024)
+			Expect(err).To(BeNil())
+			_, err = log.Append([]byte("record-4"))
+			Expect(err).To(BeNil())
+			Expect(readAll()).To(Equal([]string{"record-1", "record-2", "record-3", "record-4"}))
+		})
+	})
+})
@@ -0,0 +1,477 @@
+package disk
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+)
+
+const offsetSuffix = ".offset"
+
+type Config struct {
+	// Directory the topic logs are stored in, each topic is a sub directory
+	Dir string
+	// The name our consumer offsets are committed under
+	Group string
+	// One of FsyncAlways, FsyncInterval or FsyncNever
+	Fsync         string
+	FsyncInterval time.Duration
+	// Roll to a new segment once the active segment reaches this size
+	SegmentSize int64
+	// How often subscribers check for new records once they reach the end of the log
+	PollInterval time.Duration
+	// How often acknowledged offsets are committed and consumed segments are compacted
+	CommitInterval time.Duration
+}
+
+func ConfigFromOpts(opts *args.Options) Config {
+	return Config{
+		Dir:            opts.String("disk-queue-dir"),
+		Group:          opts.String("disk-queue-consumer-group"),
+		Fsync:          opts.String("disk-queue-fsync"),
+		FsyncInterval:  time.Duration(opts.Int("disk-queue-fsync-interval")) * time.Millisecond,
+		SegmentSize:    int64(opts.Int("disk-queue-segment-size")) * 1024 * 1024,
+		PollInterval:   100 * time.Millisecond,
+		CommitInterval: time.Second,
+	}
+}
+
+// Implements queue.Queue with an append only segment log per topic on local disk.
+// Allows the API and Worker on the same host to pass messages without kafka
+type Queue struct {
+	mutex         sync.Mutex
+	conf          Config
+	logs          map[string]*Log
+	subscriptions map[string]*subscription
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+type subscription struct {
+	mutex     sync.Mutex
+	records   chan *queue.Record
+	committed int64
+	acked     int64
+	// Maps the offset of each delivered record to the offset of the record after it
+	pending map[int64]int64
+}
+
+// The encoded form of a queue.Record in the log
+type entry struct {
+	Key     []byte            `json:"key,omitempty"`
+	Value   []byte            `json:"value"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func NewQueue(conf Config) (*Queue, error) {
+	switch conf.Fsync {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, errors.Errorf("invalid fsync policy '%s' - must be one of [%s %s %s]",
+			conf.Fsync, FsyncAlways, FsyncInterval, FsyncNever)
+	}
+
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "MkdirAll('%s')", conf.Dir)
+	}
+
+	self := &Queue{
+		conf:          conf,
+		logs:          make(map[string]*Log),
+		subscriptions: make(map[string]*subscription),
+		done:          make(chan struct{}),
+	}
+
+	self.wg.Add(1)
+	go self.commitEvery(conf.CommitInterval)
+	return self, nil
+}
+
+func (self *Queue) getLog(topic string) (*Log, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if log, ok := self.logs[topic]; ok {
+		return log, nil
+	}
+
+	log, err := OpenLog(filepath.Join(self.conf.Dir, topic), self.conf.Fsync,
+		self.conf.FsyncInterval, self.conf.SegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	self.logs[topic] = log
+	return log, nil
+}
+
+func (self *Queue) Publish(record *queue.Record) error {
+	if !self.IsConnected() {
+		return errors.New("Not Connected")
+	}
+
+	payload, err := json.Marshal(entry{Key: record.Key, Value: record.Value, Headers: record.Headers})
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal()")
+	}
+
+	log, err := self.getLog(record.Topic)
+	if err != nil {
+		return err
+	}
+
+	_, err = log.Append(payload)
+	return err
+}
+
+// Subscribe to the topic resuming from the offset last committed by our group, or
+// from the oldest record in the log if our group has never committed an offset
+func (self *Queue) Subscribe(topic string) (<-chan *queue.Record, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if sub, ok := self.subscriptions[topic]; ok {
+		return sub.records, nil
+	}
+
+	dir := filepath.Join(self.conf.Dir, topic)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "MkdirAll('%s')", dir)
+	}
+
+	offset, err := readOffset(dir, self.conf.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{
+		records:   make(chan *queue.Record),
+		committed: offset,
+		acked:     offset,
+		pending:   make(map[int64]int64),
+	}
+	self.subscriptions[topic] = sub
+
+	self.wg.Add(1)
+	go self.consume(topic, dir, sub)
+	return sub.records, nil
+}
+
+func (self *Queue) consume(topic, dir string, sub *subscription) {
+	defer self.wg.Done()
+
+	reader := NewReader(dir)
+	defer reader.Close()
+
+	offset := sub.committed
+	for {
+		payload, current, next, err := reader.Read(offset)
+		if err != nil {
+			if err != io.EOF {
+				logrus.WithFields(logrus.Fields{
+					"method": "Queue.consume()",
+					"type":   "disk",
+					"topic":  topic,
+				}).Error(err.Error())
+			}
+
+			// Wait for more records
+			select {
+			case <-time.After(self.conf.PollInterval):
+				continue
+			case <-self.done:
+				return
+			}
+		}
+		offset = next
+
+		var record entry
+		if err := json.Unmarshal(payload, &record); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"method": "Queue.consume()",
+				"type":   "disk",
+				"topic":  topic,
+			}).Errorf("Skipping record at offset %d - %s", current, err.Error())
+			continue
+		}
+
+		sub.mutex.Lock()
+		sub.pending[current] = next
+		sub.mutex.Unlock()
+
+		select {
+		case sub.records <- &queue.Record{
+			Topic:   topic,
+			Key:     record.Key,
+			Value:   record.Value,
+			Headers: record.Headers,
+			Offset:  current,
+		}:
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// Acknowledge the record, records are expected to be acknowledged in the order they are delivered
+func (self *Queue) Ack(record *queue.Record) error {
+	self.mutex.Lock()
+	sub, ok := self.subscriptions[record.Topic]
+	self.mutex.Unlock()
+	if !ok {
+		return errors.Errorf("Not subscribed to topic '%s'", record.Topic)
+	}
+
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+
+	next, ok := sub.pending[record.Offset]
+	if !ok {
+		return errors.Errorf("Unknown offset '%d' for topic '%s'", record.Offset, record.Topic)
+	}
+	delete(sub.pending, record.Offset)
+
+	if next > sub.acked {
+		sub.acked = next
+	}
+	return nil
+}
+
+// Append the record to the end of the topic and acknowledge the original
+func (self *Queue) Nack(record *queue.Record) error {
+	if err := self.Publish(record); err != nil {
+		return err
+	}
+	return self.Ack(record)
+}
+
+func (self *Queue) commitEvery(interval time.Duration) {
+	defer self.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			self.commit()
+		case <-self.done:
+			self.commit()
+			return
+		}
+	}
+}
+
+// Commit the acknowledged offsets, then remove segments every group has consumed
+func (self *Queue) commit() {
+	self.mutex.Lock()
+	subscriptions := make(map[string]*subscription, len(self.subscriptions))
+	for topic, sub := range self.subscriptions {
+		subscriptions[topic] = sub
+	}
+	self.mutex.Unlock()
+
+	for topic, sub := range subscriptions {
+		sub.mutex.Lock()
+		acked, committed := sub.acked, sub.committed
+		sub.mutex.Unlock()
+
+		if acked == committed {
+			continue
+		}
+
+		dir := filepath.Join(self.conf.Dir, topic)
+		if err := writeOffset(dir, self.conf.Group, acked); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"method": "Queue.commit()",
+				"type":   "disk",
+				"topic":  topic,
+			}).Error(err.Error())
+			continue
+		}
+
+		sub.mutex.Lock()
+		sub.committed = acked
+		sub.mutex.Unlock()
+
+		if err := self.compact(topic, dir); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"method": "Queue.compact()",
+				"type":   "disk",
+				"topic":  topic,
+			}).Error(err.Error())
+		}
+	}
+}
+
+// Remove the segments that have been consumed by every consumer group
+func (self *Queue) compact(topic, dir string) error {
+	offset, err := minOffset(dir)
+	if err != nil {
+		return err
+	}
+
+	log, err := self.getLog(topic)
+	if err != nil {
+		return err
+	}
+	return log.Compact(offset)
+}
+
+// Returns the size in bytes of the segments of the topic that have yet to be compacted
+func (self *Queue) Size(topic string) (int64, error) {
+	log, err := self.getLog(topic)
+	if err != nil {
+		return 0, err
+	}
+	return log.Size()
+}
+
+// Returns the number of records on the priority lanes after the offset 'Group' last committed.
+// Counts the records of each lane, so the cost grows with the lag
+func (self *Queue) Lag() (int64, error) {
+	var result int64
+	for _, priority := range models.Priorities {
+		dir := filepath.Join(self.conf.Dir, queue.LaneTopic(priority))
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+
+		offset, err := readOffset(dir, self.conf.Group)
+		if err != nil {
+			return 0, err
+		}
+		count, err := countRecords(dir, offset)
+		if err != nil {
+			return 0, err
+		}
+		result += count
+	}
+	return result, nil
+}
+
+func (self *Queue) SignalReconnect() {}
+
+func (self *Queue) Stop() {
+	self.mutex.Lock()
+	select {
+	case <-self.done:
+		self.mutex.Unlock()
+		return
+	default:
+		close(self.done)
+	}
+	self.mutex.Unlock()
+
+	// Wait for the final commit
+	self.wg.Wait()
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, log := range self.logs {
+		log.Close()
+	}
+}
+
+func (self *Queue) IsConnected() bool {
+	select {
+	case <-self.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Returns the number of records in the log at 'dir' from 'offset' to the end of the log
+func countRecords(dir string, offset int64) (int64, error) {
+	reader := NewReader(dir)
+	defer reader.Close()
+
+	var result int64
+	for {
+		_, _, next, err := reader.Read(offset)
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		result++
+		offset = next
+	}
+}
+
+// Returns the committed offset for the group, or 0 if the group has never committed
+func readOffset(dir, group string) (int64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, group+offsetSuffix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "read offset")
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid offset for group '%s'", group)
+	}
+	return offset, nil
+}
+
+// Write the offset to a temp file and rename it, so a crash never leaves a partial offset
+func writeOffset(dir, group string, offset int64) error {
+	path := filepath.Join(dir, group+offsetSuffix)
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write offset")
+	}
+	if _, err := file.WriteString(strconv.FormatInt(offset, 10)); err != nil {
+		file.Close()
+		return errors.Wrap(err, "write offset")
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrap(err, "fsync offset")
+	}
+	file.Close()
+	return errors.Wrap(os.Rename(tmp, path), "rename offset")
+}
+
+// Returns the smallest offset committed by any group in the topic directory
+func minOffset(dir string) (int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "ReadDir('%s')", dir)
+	}
+
+	var result int64 = -1
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), offsetSuffix) {
+			continue
+		}
+		offset, err := readOffset(dir, strings.TrimSuffix(file.Name(), offsetSuffix))
+		if err != nil {
+			return 0, err
+		}
+		if result == -1 || offset < result {
+			result = offset
+		}
+	}
+
+	if result == -1 {
+		return 0, nil
+	}
+	return result, nil
+}
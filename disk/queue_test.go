@@ -0,0 +1,185 @@
+package disk_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/disk"
+	"github.com/thrawn01/detka/queue"
+)
+
+func newConfig(dir string) disk.Config {
+	return disk.Config{
+		Dir:            dir,
+		Group:          "detka-worker",
+		Fsync:          disk.FsyncAlways,
+		SegmentSize:    1024 * 1024,
+		PollInterval:   10 * time.Millisecond,
+		CommitInterval: 10 * time.Millisecond,
+	}
+}
+
+func segments(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	return files
+}
+
+var _ = Describe("Queue", func() {
+	var dir string
+	var conf disk.Config
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-disk")
+		Expect(err).To(BeNil())
+		conf = newConfig(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context("When a record is published by another queue on the same directory", func() {
+		It("should be delivered to the subscriber", func() {
+			producer, err := disk.NewQueue(conf)
+			Expect(err).To(BeNil())
+			defer producer.Stop()
+
+			consumer, err := disk.NewQueue(conf)
+			Expect(err).To(BeNil())
+			defer consumer.Stop()
+
+			records, err := consumer.Subscribe("normal")
+			Expect(err).To(BeNil())
+
+			err = producer.Publish(&queue.Record{
+				Topic:   "normal",
+				Key:     []byte("key"),
+				Value:   []byte("value"),
+				Headers: map[string]string{"schema": "1"},
+			})
+			Expect(err).To(BeNil())
+
+			var record *queue.Record
+			Eventually(records).Should(Receive(&record))
+			Expect(string(record.Key)).To(Equal("key"))
+			Expect(string(record.Value)).To(Equal("value"))
+			Expect(record.Headers).To(Equal(map[string]string{"schema": "1"}))
+			Expect(consumer.Ack(record)).To(BeNil())
+		})
+	})
+
+	Context("When records on the priority lanes are not acknowledged", func() {
+		It("should report them as lag", func() {
+			conf.CommitInterval = time.Hour
+			msgQueue, err := disk.NewQueue(conf)
+			Expect(err).To(BeNil())
+
+			for _, topic := range []string{"high", "normal", "normal", "dead-letter"} {
+				Expect(msgQueue.Publish(&queue.Record{Topic: topic, Value: []byte("value")})).To(BeNil())
+			}
+			Expect(msgQueue.Lag()).To(Equal(int64(3)))
+
+			records, _ := msgQueue.Subscribe("normal")
+			var record *queue.Record
+			Eventually(records).Should(Receive(&record))
+			Expect(msgQueue.Ack(record)).To(BeNil())
+			// Stop commits the acknowledged offset
+			msgQueue.Stop()
+
+			msgQueue, err = disk.NewQueue(conf)
+			Expect(err).To(BeNil())
+			defer msgQueue.Stop()
+			Expect(msgQueue.Lag()).To(Equal(int64(2)))
+		})
+	})
+
+	Context("When the consumer restarts", func() {
+		It("should resume after the last acknowledged record", func() {
+			msgQueue, err := disk.NewQueue(conf)
+			Expect(err).To(BeNil())
+
+			for _, value := range []string{"one", "two", "three"} {
+				Expect(msgQueue.Publish(&queue.Record{Topic: "bulk", Value: []byte(value)})).To(BeNil())
+			}
+
+			records, _ := msgQueue.Subscribe("bulk")
+			var record *queue.Record
+			Eventually(records).Should(Receive(&record))
+			Expect(string(record.Value)).To(Equal("one"))
+			Expect(msgQueue.Ack(record)).To(BeNil())
+			msgQueue.Stop()
+
+			msgQueue, err = disk.NewQueue(conf)
+			Expect(err).To(BeNil())
+			defer msgQueue.Stop()
+
+			records, _ = msgQueue.Subscribe("bulk")
+			Eventually(records).Should(Receive(&record))
+			Expect(string(record.Value)).To(Equal("two"))
+		})
+	})
+
+	Context("When every record in a segment is acknowledged", func() {
+		It("should remove the segment", func() {
+			conf.SegmentSize = 16
+			msgQueue, err := disk.NewQueue(conf)
+			Expect(err).To(BeNil())
+			defer msgQueue.Stop()
+
+			for _, value := range []string{"one", "two", "three"} {
+				Expect(msgQueue.Publish(&queue.Record{Topic: "high", Value: []byte(value)})).To(BeNil())
+			}
+			Expect(len(segments(filepath.Join(dir, "high")))).To(Equal(3))
+
+			records, _ := msgQueue.Subscribe("high")
+			for i := 0; i < 2; i++ {
+				var record *queue.Record
+				Eventually(records).Should(Receive(&record))
+				Expect(msgQueue.Ack(record)).To(BeNil())
+			}
+			Eventually(func() int {
+				return len(segments(filepath.Join(dir, "high")))
+			}).Should(Equal(1))
+		})
+	})
+
+	Context("When a writer crashed part way through a record", func() {
+		It("should truncate the torn record on open", func() {
+			msgQueue, err := disk.NewQueue(conf)
+			Expect(err).To(BeNil())
+			Expect(msgQueue.Publish(&queue.Record{Topic: "normal", Value: []byte("one")})).To(BeNil())
+			msgQueue.Stop()
+
+			segment := segments(filepath.Join(dir, "normal"))[0]
+			file, _ := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+			file.Write([]byte{0, 0, 0, 100, 1, 2})
+			file.Close()
+
+			msgQueue, err = disk.NewQueue(conf)
+			Expect(err).To(BeNil())
+			defer msgQueue.Stop()
+			Expect(msgQueue.Publish(&queue.Record{Topic: "normal", Value: []byte("two")})).To(BeNil())
+
+			records, _ := msgQueue.Subscribe("normal")
+			var record *queue.Record
+			Eventually(records).Should(Receive(&record))
+			Expect(string(record.Value)).To(Equal("one"))
+			Expect(msgQueue.Ack(record)).To(BeNil())
+			Eventually(records).Should(Receive(&record))
+			Expect(string(record.Value)).To(Equal("two"))
+		})
+	})
+
+	Context("When the fsync policy is unknown", func() {
+		It("should return an error", func() {
+			conf.Fsync = "sometimes"
+			_, err := disk.NewQueue(conf)
+			Expect(err).To(Not(BeNil()))
+		})
+	})
+})
@@ -0,0 +1,182 @@
+package detka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+// The outcome of handling a queue message
+const (
+	// The message was handled
+	OutcomeDelivered = "delivered"
+	// The message could not be handled and will not be retried
+	OutcomeFailed = "failed"
+	// The message was dropped without being handled, IE: it no longer exists in the store
+	OutcomeDiscarded = "discarded"
+	// The handler returned an error, the message will be retried
+	OutcomeDeferred = "deferred"
+)
+
+type outcomeError struct {
+	outcome string
+	err     error
+}
+
+func (self *outcomeError) Error() string {
+	return self.err.Error()
+}
+
+// Returned by a handler when the message should not be retried
+func Fail(err error) error {
+	return &outcomeError{OutcomeFailed, err}
+}
+
+// Returned by a handler when the message was dropped without being handled
+func Discard(err error) error {
+	return &outcomeError{OutcomeDiscarded, err}
+}
+
+// Returns the outcome of handling a message given the error returned by the handler
+func Outcome(err error) string {
+	if err == nil {
+		return OutcomeDelivered
+	}
+	if obj, ok := errors.Cause(err).(*outcomeError); ok {
+		return obj.outcome
+	}
+	return OutcomeDeferred
+}
+
+// Handles a single type of queue message
+type Handler interface {
+	// The context carries the trace of the message
+	Handle(context.Context, *models.QueueMessage) error
+}
+
+// Allows the use of ordinary functions as queue message handlers
+type HandlerFunc func(context.Context, *models.QueueMessage) error
+
+func (self HandlerFunc) Handle(ctx context.Context, msg *models.QueueMessage) error {
+	return self(ctx, msg)
+}
+
+// Receives messages the worker could not decode or has no handler for
+type DeadLetter interface {
+	Send(ctx context.Context, record *queue.Record, msg *models.QueueMessage, reason error)
+}
+
+// Routes queue messages to the handler registered for QueueMessage.Type
+type Dispatcher struct {
+	mutex      sync.Mutex
+	handlers   map[string]Handler
+	deadLetter DeadLetter
+}
+
+func NewDispatcher(deadLetter DeadLetter) *Dispatcher {
+	return &Dispatcher{
+		handlers:   make(map[string]Handler),
+		deadLetter: deadLetter,
+	}
+}
+
+// Register a handler for the message type, replaces any existing handler for the type
+func (self *Dispatcher) Register(kind string, handler Handler) {
+	self.mutex.Lock()
+	self.handlers[kind] = handler
+	self.mutex.Unlock()
+}
+
+func (self *Dispatcher) getHandler(kind string) (Handler, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	handler, ok := self.handlers[kind]
+	return handler, ok
+}
+
+// Hand the message to the registered handler, messages of an unknown type
+// or an unsupported envelope version are sent to the dead letter
+func (self *Dispatcher) Dispatch(ctx context.Context, record *queue.Record, msg *models.QueueMessage) error {
+	if msg.Version > models.QueueMessageVersion {
+		err := errors.Errorf("unsupported envelope version '%d'", msg.Version)
+		self.DeadLetter(ctx, record, msg, err)
+		return Fail(err)
+	}
+
+	handler, ok := self.getHandler(msg.Type)
+	if !ok {
+		err := errors.Errorf("no handler for message type '%s'", msg.Type)
+		self.DeadLetter(ctx, record, msg, err)
+		return Fail(err)
+	}
+	return handler.Handle(ctx, msg)
+}
+
+func (self *Dispatcher) DeadLetter(ctx context.Context, record *queue.Record, msg *models.QueueMessage,
+	reason error) {
+	if self.deadLetter != nil {
+		self.deadLetter.Send(ctx, record, msg, reason)
+	}
+}
+
+// Logs the dead message, publishes it to the dead letter topic and marks the
+// email of an 'email' envelope as 'DEAD-LETTER' so the status is visible to the user
+type QueueDeadLetter struct {
+	queue queue.Queue
+	store store.Store
+}
+
+func NewQueueDeadLetter(msgQueue queue.Queue, dbStore store.Store) DeadLetter {
+	return &QueueDeadLetter{queue: msgQueue, store: dbStore}
+}
+
+func (self *QueueDeadLetter) Send(ctx context.Context, record *queue.Record, msg *models.QueueMessage,
+	reason error) {
+	logrus.WithFields(logrus.Fields{
+		"method": "DeadLetter.Send()",
+		"type":   "dispatch",
+		"result": "dead-letter",
+	}).Error(fmt.Sprintf("%s - %q", reason.Error(), string(record.Value)))
+
+	// Keep the content type and schema version so the payload can still be decoded
+	headers := map[string]string{"dead-letter-reason": reason.Error()}
+	for key, value := range record.Headers {
+		headers[key] = value
+	}
+
+	err := self.queue.Publish(&queue.Record{
+		Topic:   queue.DeadLetterTopic,
+		Key:     record.Key,
+		Value:   record.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"method": "DeadLetter.Send()",
+			"type":   "queue",
+		}).Error(err.Error())
+	}
+
+	// Other envelopes ('webhook', 'bounce') refer to an email that already has a final status
+	if msg == nil || len(msg.Id) == 0 || msg.Type != "email" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StoreTimeout)
+	defer cancel()
+	err = self.store.UpdateMessage(ctx, msg.Id, map[string]interface{}{
+		"Status": "DEAD-LETTER",
+	})
+	if err != nil && !store.IsNotFound(err) {
+		logrus.WithFields(logrus.Fields{
+			"method": "DeadLetter.Send()",
+			"type":   "store",
+		}).Error(err.Error())
+	}
+}
@@ -0,0 +1,106 @@
+package detka_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Dispatcher", func() {
+	var dbStore *store.MemoryStore
+	var msgQueue *queue.MemoryQueue
+	var deadLetters <-chan *queue.Record
+	var dispatcher *detka.Dispatcher
+
+	dispatch := func(msg models.QueueMessage) error {
+		record, err := queue.NewRecord(msg)
+		Expect(err).To(BeNil())
+		return dispatcher.Dispatch(context.Background(), record, &msg)
+	}
+
+	status := func(id string) string {
+		stored, err := dbStore.GetMessage(context.Background(), id)
+		Expect(err).To(BeNil())
+		return stored.Status
+	}
+
+	BeforeEach(func() {
+		dbStore = store.NewMemoryStore()
+		msgQueue = queue.NewMemoryQueue(10)
+		deadLetters, _ = msgQueue.Subscribe(queue.DeadLetterTopic)
+		dispatcher = detka.NewDispatcher(detka.NewQueueDeadLetter(msgQueue, dbStore))
+
+		msg := models.Message{Id: "id-1", To: "devs@mailgun.net", Status: "NEW"}
+		Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+	})
+
+	AfterEach(func() {
+		msgQueue.Stop()
+	})
+
+	It("should hand the message to the handler registered for its type", func() {
+		var handled *models.QueueMessage
+		dispatcher.Register("webhook", detka.HandlerFunc(func(ctx context.Context, msg *models.QueueMessage) error {
+			handled = msg
+			return nil
+		}))
+
+		err := dispatch(models.NewQueueMessage("webhook", "id-1"))
+		Expect(err).To(BeNil())
+		Expect(detka.Outcome(err)).To(Equal(detka.OutcomeDelivered))
+		Expect(handled.Id).To(Equal("id-1"))
+		Consistently(deadLetters).ShouldNot(Receive())
+	})
+
+	It("should dead letter a message of an unknown type", func() {
+		err := dispatch(models.NewQueueMessage("fax", "id-1"))
+		Expect(detka.Outcome(err)).To(Equal(detka.OutcomeFailed))
+
+		var record *queue.Record
+		Eventually(deadLetters).Should(Receive(&record))
+		Expect(record.Headers["dead-letter-reason"]).To(ContainSubstring("no handler"))
+		// Only an 'email' envelope owns the status of its message
+		Expect(status("id-1")).To(Equal("NEW"))
+	})
+
+	It("should dead letter an envelope newer than the worker understands", func() {
+		dispatcher.Register("email", detka.HandlerFunc(func(context.Context, *models.QueueMessage) error {
+			Fail("handler called with an unsupported envelope")
+			return nil
+		}))
+
+		msg := models.NewQueueMessage("email", "id-1")
+		msg.Version = models.QueueMessageVersion + 1
+		err := dispatch(msg)
+		Expect(detka.Outcome(err)).To(Equal(detka.OutcomeFailed))
+
+		var record *queue.Record
+		Eventually(deadLetters).Should(Receive(&record))
+		Expect(record.Headers["dead-letter-reason"]).To(ContainSubstring("unsupported envelope version"))
+		Expect(status("id-1")).To(Equal("DEAD-LETTER"))
+	})
+
+	It("should report the outcome the handler returned", func() {
+		outcomes := map[string]error{
+			detka.OutcomeFailed:    detka.Fail(errors.New("rejected")),
+			detka.OutcomeDiscarded: detka.Discard(errors.New("not found")),
+			detka.OutcomeDeferred:  errors.New("store timeout"),
+		}
+		for outcome, result := range outcomes {
+			result := result
+			dispatcher.Register("email", detka.HandlerFunc(func(context.Context, *models.QueueMessage) error {
+				return result
+			}))
+			Expect(detka.Outcome(dispatch(models.NewQueueMessage("email", "id-1")))).To(Equal(outcome))
+		}
+		// Only the dispatcher dead letters, the outcome of a handler is up to the worker
+		Consistently(deadLetters).ShouldNot(Receive())
+		Expect(status("id-1")).To(Equal("NEW"))
+	})
+})
@@ -1,44 +1,56 @@
 package detka
 
 import (
+	"io"
+	"io/ioutil"
 	"net/http"
 	"time"
 
 	"fmt"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/pressly/chi"
 	"github.com/pressly/chi/middleware"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/thrawn01/detka/kafka"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/detka/metrics"
 	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
 	"github.com/thrawn01/detka/store"
+	"github.com/thrawn01/detka/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 )
 
-func NewHandler(producerManager *kafka.ProducerManager, dbStore store.Store) http.Handler {
+// The largest offloaded body GET /messages/{id} returns in 'text'
+var MaxResponseBody int64 = 10 * 1024 * 1024
+
+func NewHandler(msgQueue queue.Queue, dbStore store.Store, keyFunc queue.KeyFunc,
+	admission *Admission, buffer *StoreBuffer, erasure *Erasure) http.Handler {
 	router := chi.NewRouter()
 
 	// Log Every Request
 	router.Use(Logger)
+	// Trace Every Request
+	router.Use(tracing.Middleware)
 	// Recover from panic's
 	router.Use(middleware.Recoverer)
-	// Timeout in 1 second
-	router.Use(middleware.Timeout(1 * time.Second))
 	// Set JSON headers for every request
 	router.Use(MimeJson)
 	// Record Metrics for every request
 	router.Use(RecordMetrics)
-	// Pass the kafka context into every request
-	router.Use(kafka.Middleware(producerManager))
+	// Pass the queue context into every request
+	router.Use(queue.Middleware(msgQueue))
+	// Pass the partition key strategy into every request
+	router.Use(queue.KeyMiddleware(keyFunc))
 	// Pass the store context into every request
 	router.Use(store.Middleware(dbStore))
 
-	// TODO: Add API Throttling
-
-	// Expose the metrics we have collected
-	router.Get("/metrics", prometheus.Handler())
-	router.Get("/healthz", Healthz)
+	// Reject new messages when the workers fall behind
+	router.Use(AdmissionMiddleware(admission))
+	// Buffer new messages while the store is disconnected
+	router.Use(StoreBufferMiddleware(buffer))
+	// Pass the erasure into every request, the admin endpoints are disabled if nil
+	router.Use(ErasureMiddleware(erasure))
 
 	// Handle not found message in json
 	router.NotFound(func(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
@@ -46,8 +58,20 @@ func NewHandler(producerManager *kafka.ProducerManager, dbStore store.Store) htt
 		resp.Write([]byte(fmt.Sprintf(`{"error" : "Path '%s' Not Found"}`, req.URL.RequestURI())))
 	})
 
-	router.Post("/messages", NewMessages)
-	router.Get("/messages/:messageId", GetMessage)
+	router.Group(func(router chi.Router) {
+		// Timeout in 1 second
+		router.Use(middleware.Timeout(1 * time.Second))
+
+		// Expose the metrics we have collected
+		router.Get("/metrics", prometheus.Handler())
+		router.Get("/healthz", Healthz)
+
+		router.Post("/messages", NewMessages)
+		router.Get("/messages/:messageId", GetMessage)
+	})
+
+	// An erasure may take longer than the request timeout, the response has the audit entry
+	router.Post("/admin/erasure", Erase)
 
 	return router
 }
@@ -64,25 +88,67 @@ func GetMessage(ctx context.Context, resp http.ResponseWriter, req *http.Request
 	db := store.GetStore(ctx)
 
 	var message *models.Message
-	message, err := db.GetMessage(id)
+	storeCtx, span := tracing.Start(ctx, "Store.GetMessage")
+	message, err := db.GetMessage(storeCtx, id)
+	tracing.End(span, err)
 	if err != nil {
 		StoreError(resp, err, logrus.Fields{"method": "GetMessage", "type": "store"})
 		return
 	}
 
+	if err := readBody(ctx, db, message); err != nil {
+		StoreError(resp, err, logrus.Fields{"method": "GetMessage", "type": "blob"})
+		return
+	}
 	ToJson(resp, message)
 }
 
+// Read an offloaded body into Text so the response is the same as for a body kept in the
+// store. Bodies larger than MaxResponseBody are left in the blob store and returned by reference
+func readBody(ctx context.Context, db store.Store, message *models.Message) error {
+	opener, ok := db.(store.BodyOpener)
+	if message.BodyRef == "" || !ok {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "Store.OpenBody")
+	reader, err := opener.OpenBody(ctx, message)
+	if err != nil {
+		tracing.End(span, err)
+		return err
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(reader, MaxResponseBody+1))
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) > MaxResponseBody {
+		return nil
+	}
+
+	message.Text = string(content)
+	message.BodyRef, message.BodyChecksum = "", ""
+	return nil
+}
+
 func NewMessages(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
 	// TODO: Authenticate User has access to create emails?
 
 	req.ParseForm()
 
 	msg := models.Message{
-		Subject: req.FormValue("subject"),
-		Text:    req.FormValue("text"),
-		From:    req.FormValue("from"),
-		To:      req.FormValue("to"),
+		Subject:  req.FormValue("subject"),
+		Text:     req.FormValue("text"),
+		From:     req.FormValue("from"),
+		To:       req.FormValue("to"),
+		Priority: req.FormValue("priority"),
+		Account:  req.FormValue("account"),
+	}
+
+	// Messages without a priority are queued on the normal lane
+	if len(msg.Priority) == 0 {
+		msg.Priority = models.PriorityNormal
 	}
 
 	logrus.Debugf("-> %+v\n", msg)
@@ -93,21 +159,54 @@ func NewMessages(ctx context.Context, resp http.ResponseWriter, req *http.Reques
 		return
 	}
 
+	// Apply backpressure if the delivery pipeline is saturated
+	dbStore := store.GetStore(ctx)
+	buffer := GetStoreBuffer(ctx)
+	if admission := GetAdmission(ctx); admission != nil {
+		var err error
+		if !dbStore.IsConnected() && buffer == nil {
+			err = admission.Unavailable("store")
+		} else {
+			err = admission.Admit(accountOf(&msg))
+		}
+		if obj, ok := err.(*OverCapacity); ok {
+			ServiceUnavailable(resp, obj.Error(), obj.RetryAfter,
+				logrus.Fields{"method": "NewMessages", "type": "admission"})
+			return
+		}
+	}
+
 	// Generate a new id
 	msg.Id = models.NewId()
 	msg.Status = "NEW"
 
 	// Persist the email to the database before queuing
-	dbStore := store.GetStore(ctx)
-	if err := dbStore.InsertMessage(&msg); err != nil {
-		InternalError(resp, err.Error(), logrus.Fields{"method": "NewMessages", "type": "store"})
+	storeCtx, span := tracing.Start(ctx, "Store.InsertMessage")
+	err := dbStore.InsertMessage(storeCtx, &msg)
+	tracing.End(span, err)
+	if err != nil {
+		if buffer == nil || dbStore.IsConnected() {
+			StoreError(resp, err, logrus.Fields{"method": "NewMessages", "type": "store"})
+			return
+		}
+
+		// The store is down, the buffer inserts and queues the message once the store reconnects
+		if err := buffer.Append(&msg); err != nil {
+			if err == ErrBufferFull {
+				ServiceUnavailable(resp, err.Error(), 30*time.Second,
+					logrus.Fields{"method": "NewMessages", "type": "buffer"})
+				return
+			}
+			InternalError(resp, err.Error(), logrus.Fields{"method": "NewMessages", "type": "buffer"})
+			return
+		}
+		ToJson(resp, models.NewMessageResponse{Id: msg.Id, Message: "Queued, Thank you."})
 		return
 	}
 
 	// Send the email request to the queue to be processed
-	producer := kafka.GetProducer(ctx)
-	if err := producer.Send(models.QueueMessage{Id: msg.Id, Type: "email"}); err != nil {
-		InternalError(resp, err.Error(), logrus.Fields{"method": "NewMessages", "type": "kafka"})
+	if err := Enqueue(ctx, queue.GetQueue(ctx), queue.GetKeyFunc(ctx), &msg); err != nil {
+		InternalError(resp, err.Error(), logrus.Fields{"method": "NewMessages", "type": "queue"})
 		return
 	}
 
@@ -115,27 +214,113 @@ func NewMessages(ctx context.Context, resp http.ResponseWriter, req *http.Reques
 	ToJson(resp, models.NewMessageResponse{Id: msg.Id, Message: "Queued, Thank you."})
 }
 
-func Healthz(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
-	// Validate the health of kafka producer
-	producer := kafka.GetProducer(ctx)
+func Erase(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	erasure := GetErasure(ctx)
+	if erasure == nil {
+		NotFound(resp, "Path '/admin/erasure' Not Found", logrus.Fields{"method": "Erase", "type": "admin"})
+		return
+	}
+	if !erasure.Authorized(req) {
+		Unauthorized(resp, "Invalid or missing admin token", logrus.Fields{"method": "Erase", "type": "admin"})
+		return
+	}
 
-	notReady := func() {
-		resp.WriteHeader(500)
-		resp.Write([]byte(`{"ready" : false}`))
+	req.ParseForm()
+	request := ErasureRequest{
+		Recipient:   req.FormValue("recipient"),
+		Mode:        req.FormValue("mode"),
+		RequestedBy: req.FormValue("requested_by"),
+	}
+	if len(request.Mode) == 0 {
+		request.Mode = ErasureDelete
 	}
 
-	if err := producer.Send(models.QueueMessage{Type: "ping"}); err != nil {
-		notReady()
+	// The erasure continues if the client goes away
+	record, err := erasure.Erase(context.Background(), request)
+	if err != nil {
+		if record == nil {
+			BadRequest(resp, err.Error(), logrus.Fields{"method": "Erase", "type": "validate"})
+			return
+		}
+		StoreError(resp, err, logrus.Fields{"method": "Erase", "type": "store"})
 		return
 	}
+	ToJson(resp, record)
+}
+
+func Healthz(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	msgQueue := queue.GetQueue(ctx)
+	reasons := queue.Diagnose(msgQueue)
+	if reasons == nil {
+		reasons = make(map[string]string)
+	}
+
+	// Validate the health of the queue
+	record, err := queue.NewRecord(models.NewQueueMessage("ping", ""))
+	if err != nil {
+		reasons["queue"] = err.Error()
+	} else if err := msgQueue.Publish(record); err != nil && len(reasons) == 0 {
+		reasons["queue"] = err.Error()
+	}
 
 	// Validate the health of rethink
 	dbStore := store.GetStore(ctx)
 	if !dbStore.IsConnected() {
-		notReady()
+		reasons["store"] = "not connected"
+		for backend, state := range store.Diagnose(dbStore) {
+			reasons[backend] = state
+		}
+	}
+
+	if len(reasons) != 0 {
+		NotReady(resp, reasons)
 		return
 	}
 
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"ready" : true}`))
 }
+
+// Queue the message for delivery by the workers on the priority lane of the message,
+// the trace in 'ctx' is continued by the worker
+func Enqueue(ctx context.Context, msgQueue queue.Queue, keyFunc queue.KeyFunc, msg *models.Message) error {
+	return enqueueType(ctx, msgQueue, keyFunc, "email", msg)
+}
+
+// Queue a message of type 'kind' that refers to 'msg' on the lane of the message
+func enqueueType(ctx context.Context, msgQueue queue.Queue, keyFunc queue.KeyFunc, kind string,
+	msg *models.Message) (err error) {
+	ctx, span := tracing.Start(ctx, "Queue.Publish", trace.WithSpanKind(trace.SpanKindProducer))
+	defer func() { tracing.End(span, err) }()
+
+	queueMsg := models.NewQueueMessage(kind, msg.Id)
+	queueMsg.Priority = msg.Priority
+	// The envelope carries the trace as well, for queues that drop the record headers
+	queueMsg.Trace = make(map[string]string)
+	tracing.Inject(ctx, queueMsg.Trace)
+
+	record, err := queue.NewRecord(queueMsg)
+	if err != nil {
+		return err
+	}
+	// Messages with the same key are handled in order by the workers
+	if keyFunc != nil {
+		record.Key = keyFunc(msg)
+	}
+	tracing.Inject(ctx, record.Headers)
+
+	if err := msgQueue.Publish(record); err != nil {
+		return err
+	}
+	metrics.LaneProduced.WithLabelValues(record.Topic).Inc()
+	return nil
+}
+
+// Returns the account used to share the API headroom fairly, messages
+// without an account are accounted to the sender
+func accountOf(msg *models.Message) string {
+	if len(msg.Account) != 0 {
+		return msg.Account
+	}
+	return msg.From
+}
@@ -0,0 +1,64 @@
+package detka_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka"
+	"github.com/thrawn01/detka/blob"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Endpoint", func() {
+	Context("When the store times out", func() {
+		It("should respond with 503", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			dbStore := store.NewMemoryStore()
+			dbStore.Fail(store.MethodGetMessage, 1, store.ContextError(ctx, "GetMessage()"))
+			server := detka.NewHandler(queue.NewMemoryQueue(1), dbStore, queue.DomainKey, nil, nil, nil)
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/messages/AL3UDCVPMJDAFFNIO2OP4IYQKE", nil)
+			server.ServeHTTP(resp, req)
+			Expect(resp.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(resp.Header().Get("Retry-After")).To(Equal("1"))
+		})
+	})
+
+	Context("When the body of the message is offloaded", func() {
+		It("should respond with the body in the text", func() {
+			dir, err := ioutil.TempDir("", "detka-endpoint")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(dir)
+			blobs, err := blob.NewFileStore(dir)
+			Expect(err).To(BeNil())
+			dbStore := store.NewOffloadStore(store.NewMemoryStore(), blobs, 10)
+
+			body := strings.Repeat("large body ", 10)
+			msg := models.Message{Id: "AL3UDCVPMJDAFFNIO2OP4IYQKE", Text: body, Status: "NEW"}
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+			server := detka.NewHandler(queue.NewMemoryQueue(1), dbStore, queue.DomainKey, nil, nil, nil)
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/messages/AL3UDCVPMJDAFFNIO2OP4IYQKE", nil)
+			server.ServeHTTP(resp, req)
+			Expect(resp.Code).To(Equal(http.StatusOK))
+
+			var result models.Message
+			Expect(json.Unmarshal(resp.Body.Bytes(), &result)).To(BeNil())
+			Expect(result.Text).To(Equal(body))
+			Expect(result.BodyRef).To(Equal(""))
+		})
+	})
+})
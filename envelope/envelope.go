@@ -0,0 +1,175 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thrawn01/args"
+)
+
+// Master key providers
+const (
+	ProviderNone     = "none"
+	ProviderFile     = "file"
+	ProviderLocalKMS = "local-kms"
+)
+
+// Prefix of every encrypted value, values without the prefix are plaintext
+const prefix = "enc:v1:"
+
+// Size in bytes of data and master keys, AES-256
+const KeySize = 32
+
+// Wraps the data keys that encrypt each value, the master key never leaves the provider
+type MasterKey interface {
+	// The id of the key new data keys are wrapped with
+	KeyId() string
+	// Returns the id of the key used to wrap the data key
+	Wrap(dataKey []byte) (keyId string, wrapped []byte, err error)
+	Unwrap(keyId string, wrapped []byte) ([]byte, error)
+	// The secret of BlindIndex(), unlike the master key it must never change
+	IndexKey() []byte
+}
+
+type Config struct {
+	// ProviderNone disables encryption
+	Provider string
+	// Key file of the ProviderFile provider
+	KeyFile string
+	// Directory the ProviderLocalKMS provider keeps its keys in
+	KMSDir string
+}
+
+func ConfigFromOpts(opts *args.Options) Config {
+	return Config{
+		Provider: opts.String("encryption-key-provider"),
+		KeyFile:  opts.String("encryption-key-file"),
+		KMSDir:   opts.String("encryption-kms-dir"),
+	}
+}
+
+// Returns the master key of the configured provider, nil if encryption is disabled
+func NewMasterKey(conf Config) (MasterKey, error) {
+	switch conf.Provider {
+	case ProviderNone, "":
+		return nil, nil
+	case ProviderFile:
+		return LoadKeyFile(conf.KeyFile)
+	case ProviderLocalKMS:
+		return NewLocalKMS(conf.KMSDir)
+	}
+	return nil, errors.Errorf("invalid key provider '%s' - must be one of [none file local-kms]",
+		conf.Provider)
+}
+
+// Encrypt 'plaintext' with a new data key wrapped by 'master'. The 'aad' is authenticated
+// but not stored, the same 'aad' must be given to Decrypt()
+func Encrypt(master MasterKey, plaintext, aad string) (string, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", errors.Wrap(err, "while generating data key")
+	}
+	keyId, wrapped, err := master.Wrap(dataKey)
+	if err != nil {
+		return "", errors.Wrap(err, "while wrapping data key")
+	}
+	sealed, err := seal(dataKey, []byte(plaintext), []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return prefix + keyId + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Returns the plaintext of an encrypted value, plaintext values are returned as is
+func Decrypt(master MasterKey, value, aad string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "while decoding data key")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "while decoding value")
+	}
+
+	dataKey, err := master.Unwrap(parts[0], wrapped)
+	if err != nil {
+		return "", errors.Wrap(err, "while unwrapping data key")
+	}
+	plaintext, err := open(dataKey, sealed, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Returns a keyed hash of the value, so an encrypted value can be looked up without decrypting it
+func BlindIndex(master MasterKey, value string) string {
+	mac := hmac.New(sha256.New, master.IndexKey())
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Returns the id of the master key that wrapped the data key of the value, empty if plaintext
+func KeyIdOf(value string) string {
+	if !IsEncrypted(value) {
+		return ""
+	}
+	return strings.SplitN(strings.TrimPrefix(value, prefix), ":", 2)[0]
+}
+
+// AES-GCM, returns the nonce followed by the ciphertext
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "while generating nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decrypting")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "aes.NewCipher()")
+	}
+	return cipher.NewGCM(block)
+}
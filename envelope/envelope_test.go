@@ -0,0 +1,89 @@
+package envelope_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/envelope"
+)
+
+var _ = Describe("Envelope", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-envelope")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	// Write a key file with a new key for each id, returns the path of the file
+	keyFile := func(ids ...string) string {
+		var content string
+		for _, id := range ids {
+			key, err := envelope.NewKey()
+			Expect(err).To(BeNil())
+			content += fmt.Sprintf("%s %s\n", id, key)
+		}
+		index, err := envelope.NewKey()
+		Expect(err).To(BeNil())
+		file := path.Join(dir, "keys")
+		Expect(ioutil.WriteFile(file, []byte("# master keys\n"+content+"index "+index+"\n"), 0600)).To(BeNil())
+		return file
+	}
+
+	It("should decrypt with the key file the value was encrypted with", func() {
+		master, err := envelope.LoadKeyFile(keyFile("key-1"))
+		Expect(err).To(BeNil())
+
+		value, err := envelope.Encrypt(master, "Secret", "id-1/Text")
+		Expect(err).To(BeNil())
+		Expect(value).ToNot(ContainSubstring("Secret"))
+		Expect(envelope.KeyIdOf(value)).To(Equal("key-1"))
+
+		plaintext, err := envelope.Decrypt(master, value, "id-1/Text")
+		Expect(err).To(BeNil())
+		Expect(plaintext).To(Equal("Secret"))
+
+		_, err = envelope.Decrypt(master, value, "id-2/Text")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should wrap new data keys with the first key of the file", func() {
+		master, err := envelope.LoadKeyFile(keyFile("key-2", "key-1"))
+		Expect(err).To(BeNil())
+		Expect(master.KeyId()).To(Equal("key-2"))
+	})
+
+	It("should return plaintext values as is", func() {
+		master, err := envelope.NewLocalKMS(dir)
+		Expect(err).To(BeNil())
+		plaintext, err := envelope.Decrypt(master, "devs@mailgun.net", "id-1/To")
+		Expect(err).To(BeNil())
+		Expect(plaintext).To(Equal("devs@mailgun.net"))
+	})
+
+	It("should unwrap data keys of previous local kms keys after a restart", func() {
+		master, err := envelope.NewLocalKMS(dir)
+		Expect(err).To(BeNil())
+		value, err := envelope.Encrypt(master, "Secret", "id-1/Text")
+		Expect(err).To(BeNil())
+		Expect(master.Rotate()).To(BeNil())
+
+		restarted, err := envelope.NewLocalKMS(dir)
+		Expect(err).To(BeNil())
+		Expect(restarted.KeyId()).To(Equal(master.KeyId()))
+		Expect(restarted.KeyId()).ToNot(Equal(envelope.KeyIdOf(value)))
+
+		plaintext, err := envelope.Decrypt(restarted, value, "id-1/Text")
+		Expect(err).To(BeNil())
+		Expect(plaintext).To(Equal("Secret"))
+	})
+})
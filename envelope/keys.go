@@ -0,0 +1,226 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The reserved key id of the IndexKey()
+const indexKeyId = "index"
+
+// Master keys by id, wraps data keys with AES-GCM
+type keyring struct {
+	mutex   sync.RWMutex
+	keys    map[string][]byte
+	current string
+	index   []byte
+}
+
+func (self *keyring) IndexKey() []byte {
+	return self.index
+}
+
+func (self *keyring) KeyId() string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.current
+}
+
+func (self *keyring) Wrap(dataKey []byte) (string, []byte, error) {
+	self.mutex.RLock()
+	keyId, key := self.current, self.keys[self.current]
+	self.mutex.RUnlock()
+
+	wrapped, err := seal(key, dataKey, []byte(keyId))
+	return keyId, wrapped, err
+}
+
+func (self *keyring) Unwrap(keyId string, wrapped []byte) ([]byte, error) {
+	self.mutex.RLock()
+	key, ok := self.keys[keyId]
+	self.mutex.RUnlock()
+
+	if !ok {
+		return nil, errors.Errorf("unknown master key '%s'", keyId)
+	}
+	return open(key, wrapped, []byte(keyId))
+}
+
+func (self *keyring) add(keyId, encoded string) error {
+	if keyId == "" || strings.Contains(keyId, ":") {
+		return errors.Errorf("invalid key id '%s' - must not be empty or contain ':'", keyId)
+	}
+	key, err := decodeKey(keyId, encoded)
+	if err != nil {
+		return err
+	}
+	if keyId == indexKeyId {
+		self.index = key
+		return nil
+	}
+	self.keys[keyId] = key
+	return nil
+}
+
+func decodeKey(keyId, encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while decoding key '%s'", keyId)
+	}
+	if len(key) != KeySize {
+		return nil, errors.Errorf("key '%s' must be %d bytes", keyId, KeySize)
+	}
+	return key, nil
+}
+
+// Returns a new base64 encoded master key
+func NewKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", errors.Wrap(err, "while generating key")
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Load the master keys from a file of '<key-id> <base64 key>' lines. The first key wraps new
+// data keys, the other keys only unwrap data keys wrapped before the first key was added.
+// To rotate add a new first line; remove the old key once the data is re-encrypted. The key
+// with the reserved id 'index' is the IndexKey() and is required
+func LoadKeyFile(file string) (MasterKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading key file")
+	}
+
+	ring := &keyring{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid key file line '%s' - expected '<key-id> <base64 key>'",
+				fields[0])
+		}
+		if err := ring.add(fields[0], fields[1]); err != nil {
+			return nil, err
+		}
+		if ring.current == "" && fields[0] != indexKeyId {
+			ring.current = fields[0]
+		}
+	}
+	if ring.current == "" {
+		return nil, errors.Errorf("key file '%s' has no keys", file)
+	}
+	if ring.index == nil {
+		return nil, errors.Errorf("key file '%s' has no '%s' key", file, indexKeyId)
+	}
+	return ring, nil
+}
+
+// Stands in for a KMS during development and testing, the keys are kept as files in a
+// directory. The newest key wraps new data keys
+type LocalKMS struct {
+	keyring
+	dir string
+}
+
+// Load the keys in 'dir', creating the first key if there are none
+func NewLocalKMS(dir string) (*LocalKMS, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "while creating kms dir")
+	}
+	self := &LocalKMS{
+		keyring: keyring{keys: make(map[string][]byte)},
+		dir:     dir,
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading kms dir")
+	}
+	if err := self.loadIndexKey(); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".key") || file.Name() == indexKeyId+".key" {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading kms key")
+		}
+		keyId := strings.TrimSuffix(file.Name(), ".key")
+		if err := self.add(keyId, strings.TrimSpace(string(content))); err != nil {
+			return nil, err
+		}
+		ids = append(ids, keyId)
+	}
+
+	if len(ids) == 0 {
+		return self, self.Rotate()
+	}
+	// Key ids sort by the time they were created
+	sort.Strings(ids)
+	self.current = ids[len(ids)-1]
+	return self, nil
+}
+
+// Read the IndexKey(), creating it if it doesn't exist
+func (self *LocalKMS) loadIndexKey() error {
+	file := path.Join(self.dir, indexKeyId+".key")
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		encoded, err := NewKey()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file, []byte(encoded), 0600); err != nil {
+			return errors.Wrap(err, "while writing kms index key")
+		}
+		content = []byte(encoded)
+	} else if err != nil {
+		return errors.Wrap(err, "while reading kms index key")
+	}
+
+	self.index, err = decodeKey(indexKeyId, strings.TrimSpace(string(content)))
+	return err
+}
+
+// Create a new key that wraps new data keys, the previous keys still unwrap
+func (self *LocalKMS) Rotate() error {
+	encoded, err := NewKey()
+	if err != nil {
+		return err
+	}
+	keyId := fmt.Sprintf("kms-%020d", time.Now().UnixNano())
+	file := path.Join(self.dir, keyId+".key")
+	if err := ioutil.WriteFile(file, []byte(encoded), 0600); err != nil {
+		return errors.Wrap(err, "while writing kms key")
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err := self.add(keyId, encoded); err != nil {
+		return err
+	}
+	self.current = keyId
+	return nil
+}
@@ -0,0 +1,311 @@
+package detka
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/envelope"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+// Erasure modes
+const (
+	// Delete every message addressed to the recipient
+	ErasureDelete = "delete"
+	// Remove the recipient, subject and text of every message addressed to the recipient
+	ErasureAnonymize = "anonymize"
+)
+
+type ErasureConfig struct {
+	// Append an entry for every erasure to this file, disabled if empty
+	AuditLog string
+	// The number of messages read and erased at a time
+	BatchSize int
+	// Bearer token required by the admin endpoint, the endpoint is disabled if empty
+	AdminToken string
+	// Secret key of the recipient hash in the audit entry, not required if Master is set
+	AuditSecret string
+	// When encryption is enabled the recipient hash is the envelope.BlindIndex() of the recipient
+	Master envelope.MasterKey
+}
+
+func ErasureConfigFromOpts(opts *args.Options) ErasureConfig {
+	return ErasureConfig{
+		AuditLog:    opts.String("erasure-audit-log"),
+		BatchSize:   opts.Int("erasure-batch-size"),
+		AdminToken:  opts.String("admin-token"),
+		AuditSecret: opts.String("erasure-audit-secret"),
+	}
+}
+
+type ErasureRequest struct {
+	Recipient   string `json:"recipient"`
+	Mode        string `json:"mode"`
+	RequestedBy string `json:"requested_by"`
+}
+
+// The audit entry of an erasure, the recipient is only recorded as a keyed hash so the
+// log itself holds no personal data
+type ErasureRecord struct {
+	Id            string    `json:"id"`
+	Time          time.Time `json:"time"`
+	RecipientHash string    `json:"recipient_hash"`
+	Mode          string    `json:"mode"`
+	RequestedBy   string    `json:"requested_by"`
+	// Ids of the messages erased
+	Messages []string `json:"messages"`
+	Count    int      `json:"count"`
+	// Why the erasure stopped before every message was erased
+	Error string `json:"error,omitempty"`
+	// Copies of the messages the erasure does not reach, see Erasure
+	NotErased []string `json:"not_erased"`
+}
+
+// Copies of a message outside the store that an erasure leaves untouched
+var ErasureOutOfScope = []string{"retention-archives", "store-buffer"}
+
+// Finds every message addressed to a recipient and deletes or anonymizes it. Only the store
+// is erased; the gzip archives written by Retention and records still waiting in the StoreBuffer
+// segments keep the recipient's data and are listed in the audit entry as not erased
+type Erasure struct {
+	conf  ErasureConfig
+	index store.RecipientIndex
+	store store.Store
+	mutex sync.Mutex
+}
+
+// Returns an error if the store has no recipient index or there is no key to hash the recipient with
+func NewErasure(conf ErasureConfig, dbStore store.Store) (*Erasure, error) {
+	index, ok := dbStore.(store.RecipientIndex)
+	if !ok {
+		return nil, errors.New("the store backend does not support erasure")
+	}
+	if conf.Master == nil && conf.AuditSecret == "" {
+		return nil, errors.New("'erasure-audit-secret' is required unless encryption is enabled")
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 100
+	}
+	return &Erasure{
+		conf:  conf,
+		index: index,
+		store: dbStore,
+	}, nil
+}
+
+// Erase every message addressed to the recipient and record an audit entry. The entry
+// records the messages erased even if the erasure fails part way
+func (self *Erasure) Erase(ctx context.Context, req ErasureRequest) (*ErasureRecord, error) {
+	if err := models.ValidEmail(req.Recipient); err != nil {
+		return nil, err
+	}
+	if req.Mode != ErasureDelete && req.Mode != ErasureAnonymize {
+		return nil, errors.Errorf("invalid mode '%s' - must be one of [delete anonymize]", req.Mode)
+	}
+	if req.Mode == ErasureDelete {
+		if _, ok := self.store.(store.Deleter); !ok {
+			return nil, errors.New("the store backend can not delete messages")
+		}
+	}
+
+	key := models.RecipientKey(req.Recipient)
+	record := &ErasureRecord{
+		Id:            models.NewId(),
+		Time:          time.Now().UTC(),
+		RecipientHash: self.RecipientHash(req.Recipient),
+		Mode:          req.Mode,
+		RequestedBy:   req.RequestedBy,
+		Messages:      []string{},
+		NotErased:     ErasureOutOfScope,
+	}
+
+	err := self.erase(ctx, key, req.Mode, record)
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record.Count = len(record.Messages)
+
+	if auditErr := self.audit(record); auditErr != nil {
+		return record, errors.Wrapf(auditErr, "erased %d messages but failed to record the audit entry",
+			record.Count)
+	}
+	return record, err
+}
+
+// Returns the keyed hash of the recipient recorded in the audit entry, an unkeyed hash of an
+// address is easily reversed by hashing a list of known addresses
+func (self *Erasure) RecipientHash(recipient string) string {
+	key := models.RecipientKey(recipient)
+	if self.conf.Master != nil {
+		return envelope.BlindIndex(self.conf.Master, key)
+	}
+	mac := hmac.New(sha256.New, []byte(self.conf.AuditSecret))
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (self *Erasure) erase(ctx context.Context, key, mode string, record *ErasureRecord) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		erased, err := self.eraseBatch(ctx, key, mode, record)
+		if err != nil || erased == 0 {
+			return err
+		}
+	}
+}
+
+// Returns the number of messages erased, messages that changed while they were erased are
+// left for the next batch
+func (self *Erasure) eraseBatch(ctx context.Context, key, mode string, record *ErasureRecord) (int, error) {
+	batchCtx, cancel := context.WithTimeout(ctx, StoreTimeout)
+	defer cancel()
+
+	messages, err := self.index.MessagesByRecipient(batchCtx, key, self.conf.BatchSize)
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+
+	if mode == ErasureDelete {
+		ids := make([]string, len(messages))
+		for i, message := range messages {
+			ids[i] = message.Id
+		}
+		if err := self.store.(store.Deleter).DeleteMessages(batchCtx, ids); err != nil {
+			return 0, err
+		}
+		record.Messages = append(record.Messages, ids...)
+		return len(ids), nil
+	}
+
+	var erased int
+	for _, message := range messages {
+		for _, id := range record.Messages {
+			if id == message.Id {
+				return erased, errors.Errorf("message id - %s is still addressed to the recipient "+
+					"after it was anonymized", id)
+			}
+		}
+		err := self.store.UpdateMessageIf(batchCtx, message.Id, message.Version, map[string]interface{}{
+			"Subject": "",
+			"Text":    "",
+			"To":      withoutRecipient(message.To, key),
+		})
+		if err != nil {
+			if store.IsConflict(err) {
+				continue
+			}
+			if store.IsNotFound(err) {
+				erased++
+				continue
+			}
+			return erased, err
+		}
+		record.Messages = append(record.Messages, message.Id)
+		erased++
+	}
+	if erased == 0 {
+		return 0, errors.New("every message changed while it was anonymized, try again")
+	}
+	return erased, nil
+}
+
+// Append the record to the audit log, the entry is on disk before this returns
+func (self *Erasure) audit(record *ErasureRecord) error {
+	logrus.WithFields(logrus.Fields{
+		"method":         "Erasure.Erase()",
+		"type":           "erasure",
+		"id":             record.Id,
+		"recipient_hash": record.RecipientHash,
+		"mode":           record.Mode,
+		"requested_by":   record.RequestedBy,
+		"count":          record.Count,
+	}).Info("Erased messages")
+
+	if self.conf.AuditLog == "" {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	file, err := os.OpenFile(self.conf.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "while opening the audit log")
+	}
+	if _, err = file.Write(append(line, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.Wrap(err, "while writing the audit log")
+}
+
+// Returns true if the request has the admin bearer token
+func (self *Erasure) Authorized(req *http.Request) bool {
+	if self.conf.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(self.conf.AdminToken)) == 1
+}
+
+// Returns the 'to' address list without the recipient with 'key'
+func withoutRecipient(to, key string) string {
+	var result []string
+	addresses, err := mail.ParseAddressList(to)
+	if err != nil {
+		for _, address := range strings.Split(to, ",") {
+			if address = strings.TrimSpace(address); address != "" && models.RecipientKey(address) != key {
+				result = append(result, address)
+			}
+		}
+		return strings.Join(result, ", ")
+	}
+	for _, address := range addresses {
+		if models.RecipientKey(address.Address) == key {
+			continue
+		}
+		if address.Name == "" {
+			result = append(result, address.Address)
+		} else {
+			result = append(result, address.String())
+		}
+	}
+	return strings.Join(result, ", ")
+}
+
+type erasureContextKey int
+
+const erasureKey erasureContextKey = 1
+
+func SetErasure(ctx context.Context, erasure *Erasure) context.Context {
+	return context.WithValue(ctx, erasureKey, erasure)
+}
+
+// Returns the Erasure in the context, nil if none was injected
+func GetErasure(ctx context.Context) *Erasure {
+	obj, _ := ctx.Value(erasureKey).(*Erasure)
+	return obj
+}
@@ -0,0 +1,130 @@
+package detka_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Erasure", func() {
+	var dir string
+	var dbStore *store.MemoryStore
+	var erasure *detka.Erasure
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-erasure")
+		Expect(err).To(BeNil())
+
+		dbStore = store.NewMemoryStore()
+		for _, msg := range []models.Message{
+			{Id: "id-1", Subject: "Hi", Text: "body", To: "Jane <JANE@example.com>, bob@example.com"},
+			{Id: "id-2", Subject: "Hi", Text: "body", To: "jane@example.com"},
+			{Id: "id-3", Subject: "Hi", Text: "body", To: "bob@example.com"},
+		} {
+			msg := msg
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+		}
+
+		erasure, err = detka.NewErasure(detka.ErasureConfig{
+			AuditLog:    path.Join(dir, "audit.log"),
+			BatchSize:   1,
+			AdminToken:  "secret",
+			AuditSecret: "audit-secret",
+		}, dbStore)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should delete every message addressed to the recipient", func() {
+		record, err := erasure.Erase(context.Background(), detka.ErasureRequest{
+			Recipient: "jane@example.com", Mode: detka.ErasureDelete, RequestedBy: "support"})
+		Expect(err).To(BeNil())
+		Expect(record.Messages).To(Equal([]string{"id-1", "id-2"}))
+
+		for _, id := range []string{"id-1", "id-2"} {
+			_, err := dbStore.GetMessage(context.Background(), id)
+			Expect(store.IsNotFound(err)).To(Equal(true))
+		}
+		_, err = dbStore.GetMessage(context.Background(), "id-3")
+		Expect(err).To(BeNil())
+
+		// The audit entry holds the hash of the recipient, not the address
+		content, err := ioutil.ReadFile(path.Join(dir, "audit.log"))
+		Expect(err).To(BeNil())
+		Expect(string(content)).NotTo(ContainSubstring("jane"))
+		var audit detka.ErasureRecord
+		Expect(json.Unmarshal(content, &audit)).To(BeNil())
+		Expect(audit.Id).To(Equal(record.Id))
+		Expect(audit.Count).To(Equal(2))
+		Expect(audit.RequestedBy).To(Equal("support"))
+		Expect(audit.RecipientHash).To(Equal(erasure.RecipientHash("Jane@Example.com")))
+		Expect(audit.NotErased).To(Equal(detka.ErasureOutOfScope))
+	})
+
+	It("should hash the recipient with a secret key", func() {
+		hash := sha256.Sum256([]byte("jane@example.com"))
+		Expect(erasure.RecipientHash("jane@example.com")).NotTo(Equal(hex.EncodeToString(hash[:])))
+
+		other, err := detka.NewErasure(detka.ErasureConfig{AuditSecret: "other-secret"}, dbStore)
+		Expect(err).To(BeNil())
+		Expect(other.RecipientHash("jane@example.com")).NotTo(Equal(erasure.RecipientHash("jane@example.com")))
+
+		_, err = detka.NewErasure(detka.ErasureConfig{}, dbStore)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should remove the recipient and content when anonymizing", func() {
+		record, err := erasure.Erase(context.Background(), detka.ErasureRequest{
+			Recipient: "jane@example.com", Mode: detka.ErasureAnonymize})
+		Expect(err).To(BeNil())
+		Expect(record.Count).To(Equal(2))
+
+		message, err := dbStore.GetMessage(context.Background(), "id-1")
+		Expect(err).To(BeNil())
+		Expect(message.To).To(Equal("bob@example.com"))
+		Expect(message.Subject).To(Equal(""))
+		Expect(message.Text).To(Equal(""))
+
+		messages, err := dbStore.MessagesByRecipient(context.Background(), "jane@example.com", 10)
+		Expect(err).To(BeNil())
+		Expect(messages).To(BeEmpty())
+	})
+
+	It("should require the admin token", func() {
+		server := detka.NewHandler(queue.NewMemoryQueue(1), dbStore, queue.DomainKey, nil, nil, erasure)
+		form := url.Values{"recipient": {"jane@example.com"}}
+
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/erasure", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		server.ServeHTTP(resp, req)
+		Expect(resp.Code).To(Equal(http.StatusUnauthorized))
+
+		resp = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/admin/erasure", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer secret")
+		server.ServeHTTP(resp, req)
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		Expect(resp.Body.String()).To(ContainSubstring(`"count":2`))
+	})
+})
@@ -3,13 +3,18 @@ package detka
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 	"github.com/thrawn01/detka/metrics"
 	"github.com/thrawn01/detka/store"
 )
 
+// Suggested to clients in the 'Retry-After' header when the store timed out
+var StoreRetryAfter = time.Second
+
 func InternalError(resp http.ResponseWriter, msg string, fields logrus.Fields) {
 	logrus.WithFields(fields).Error(msg)
 	metrics.InternalErrors.With(ToLabels(fields)).Inc()
@@ -22,6 +27,11 @@ func StoreError(resp http.ResponseWriter, err error, fields logrus.Fields) {
 		NotFound(resp, err.Error(), fields)
 		return
 	}
+	if store.IsTimeout(err) {
+		logrus.WithFields(fields).Error(err.Error())
+		ServiceUnavailable(resp, "Timeout waiting for the store", StoreRetryAfter, fields)
+		return
+	}
 	InternalError(resp, err.Error(), fields)
 }
 
@@ -31,12 +41,34 @@ func BadRequest(resp http.ResponseWriter, msg string, fields logrus.Fields) {
 	resp.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, msg)))
 }
 
+func Unauthorized(resp http.ResponseWriter, msg string, fields logrus.Fields) {
+	metrics.Non200Responses.With(ToLabels(fields)).Inc()
+	resp.WriteHeader(http.StatusUnauthorized)
+	resp.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, msg)))
+}
+
 func NotFound(resp http.ResponseWriter, msg string, fields logrus.Fields) {
 	metrics.Non200Responses.With(ToLabels(fields)).Inc()
 	resp.WriteHeader(http.StatusNotFound)
 	resp.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, msg)))
 }
 
+func ServiceUnavailable(resp http.ResponseWriter, msg string, retryAfter time.Duration, fields logrus.Fields) {
+	metrics.Non200Responses.With(ToLabels(fields)).Inc()
+	resp.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	resp.WriteHeader(http.StatusServiceUnavailable)
+	resp.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, msg)))
+}
+
+// Responds to /healthz with the reason each of our dependencies is not ready
+func NotReady(resp http.ResponseWriter, reasons map[string]string) {
+	resp.WriteHeader(http.StatusInternalServerError)
+	ToJson(resp, struct {
+		Ready  bool              `json:"ready"`
+		Errors map[string]string `json:"errors,omitempty"`
+	}{false, reasons})
+}
+
 func ToLabels(tags logrus.Fields) prometheus.Labels {
 	result := prometheus.Labels{}
 	for key, value := range tags {
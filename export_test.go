@@ -0,0 +1,5 @@
+package detka
+
+// Expose the lane scheduling to the detka_test package
+var LaneSchedule = laneSchedule
+var DrainLanes = drainLanes
@@ -12,16 +12,18 @@ import (
 
 	//"io/ioutil"
 
-	//"github.com/Sirupsen/logrus"
-	logTest "github.com/Sirupsen/logrus/hooks/test"
+	//"github.com/sirupsen/logrus"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	logTest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/thrawn01/args"
 	"github.com/thrawn01/detka"
 	"github.com/thrawn01/detka/kafka"
 	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
 	"github.com/thrawn01/detka/rethink"
 	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
 )
 
 type TestMailer struct {
@@ -58,6 +60,7 @@ func parseArgs(argv *[]string) *args.ArgParser {
 	parser := args.NewParser()
 	parser.AddOption("--kafka-endpoints").Env("KAFKA_ENDPOINTS")
 	parser.AddOption("--kafka-topic").Default("detka-topic")
+	parser.AddOption("--kafka-consumer-group").Default("detka-worker")
 	parser.AddOption("--rethink-auto-create").IsBool().Default("true")
 	parser.AddOption("--rethink-endpoints").Alias("-e").Env("RETHINK_ENDPOINTS")
 	parser.AddOption("--rethink-user").Env("RETHINK_USER")
@@ -82,7 +85,7 @@ var _ = Describe("Functional Tests", func() {
 	var req *http.Request
 	var resp *httptest.ResponseRecorder
 	var hook *logTest.Hook
-	var producerManager *kafka.ProducerManager
+	var msgQueue *kafka.Queue
 	var rethinkManager *rethink.Manager
 	var parser *args.ArgParser
 	var dbStore store.Store
@@ -94,20 +97,20 @@ var _ = Describe("Functional Tests", func() {
 		hook = logTest.NewGlobal()
 		// Get our kafka Config from our local Environment
 		parser = parseArgs(nil)
-		// Create a kafka context for our service
-		producerManager = kafka.NewProducerManager(parser)
+		// Create a kafka queue for our service
+		msgQueue = kafka.NewQueue(parser)
 		// Create a rethink context for our service
 		rethinkManager = rethink.NewManager(parser)
 		// Create the database store
 		dbStore = store.NewRethinkStore(parser, rethinkManager)
 		// Create a new handler instance
-		server = detka.NewHandler(producerManager, dbStore)
+		server = detka.NewHandler(msgQueue, dbStore, queue.DomainKey, nil, nil, nil)
 		// Record HTTP responses.
 		resp = httptest.NewRecorder()
 	})
 
 	AfterEach(func() {
-		producerManager.Stop()
+		msgQueue.Stop()
 		rethinkManager.Stop()
 		hook.Reset()
 	})
@@ -115,7 +118,7 @@ var _ = Describe("Functional Tests", func() {
 	Describe("Service Conditions", func() {
 		Context("When requested path doesn't exist", func() {
 			It("should return 404", func() {
-				server = detka.NewHandler(nil, nil)
+				server = detka.NewHandler(nil, nil, nil, nil, nil, nil)
 				resp = httptest.NewRecorder()
 				req, _ = http.NewRequest("GET", "/path-not-found", nil)
 				server.ServeHTTP(resp, req)
@@ -134,19 +137,16 @@ var _ = Describe("Functional Tests", func() {
 	})
 
 	Describe("POST /messages", func() {
-		var consumerManager *kafka.ConsumerManager
 		var worker *detka.Worker
 		var mailResult models.Message
 		var mailer *TestMailer
 
 		BeforeEach(func() {
-			consumerManager = kafka.NewConsumerManager(parser)
 			mailer = NewTestMailer(&mailResult)
-			worker = detka.NewWorker(consumerManager, dbStore, mailer)
+			worker = detka.NewWorker(msgQueue, dbStore, mailer)
 		})
 
 		AfterEach(func() {
-			consumerManager.Stop()
 			worker.Stop()
 		})
 
@@ -224,7 +224,7 @@ var _ = Describe("Functional Tests", func() {
 				Expect(session).To(Not(BeNil()))
 
 				// Insert a message into the db
-				err := dbStore.InsertMessage(&originalMsg)
+				err := dbStore.InsertMessage(context.Background(), &originalMsg)
 				Expect(err).To(BeNil())
 
 				// Use the endpoint to query the message
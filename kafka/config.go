@@ -0,0 +1,188 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"hash"
+	"io/ioutil"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/thrawn01/args"
+	"github.com/xdg/scram"
+)
+
+// SASL mechanisms accepted by 'kafka-sasl-mechanism'
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// Returns a sarama config with the TLS and SASL settings from our options applied
+func NewConfig(opts *args.Options) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	// Record headers require kafka 0.11
+	config.Version = sarama.V0_11_0_0
+	config.MetricRegistry = MetricRegistry
+
+	if err := applyTLS(config, opts); err != nil {
+		return nil, err
+	}
+	if err := applySASL(config, opts); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// The options every connection to kafka depends on, see ProducerManager.Reconfigure()
+type clientConfig struct {
+	Endpoints   []string
+	TLS         bool
+	TLSInsecure bool
+	TLSCA       string
+	TLSCert     string
+	TLSKey      string
+	// The contents of the TLS files, so a certificate rotated in place reconnects
+	TLSDigests    []string
+	SASLMechanism string
+	SASLUser      string
+	SASLPassword  string
+}
+
+func clientConfigFromOpts(opts *args.Options) clientConfig {
+	return clientConfig{
+		Endpoints:     opts.StringSlice("kafka-endpoints"),
+		TLS:           opts.Bool("kafka-tls"),
+		TLSInsecure:   opts.Bool("kafka-tls-insecure"),
+		TLSCA:         opts.String("kafka-tls-ca"),
+		TLSCert:       opts.String("kafka-tls-cert"),
+		TLSKey:        opts.String("kafka-tls-key"),
+		TLSDigests:    tlsDigests(opts),
+		SASLMechanism: opts.String("kafka-sasl-mechanism"),
+		SASLUser:      opts.String("kafka-sasl-user"),
+		SASLPassword:  opts.String("kafka-sasl-password"),
+	}
+}
+
+// Returns the sha256 of each TLS file, a file that can't be read is reported as such
+func tlsDigests(opts *args.Options) []string {
+	if !opts.Bool("kafka-tls") {
+		return nil
+	}
+
+	var result []string
+	for _, name := range []string{"kafka-tls-ca", "kafka-tls-cert", "kafka-tls-key"} {
+		if opts.String(name) == "" {
+			result = append(result, "")
+			continue
+		}
+		content, err := ioutil.ReadFile(opts.String(name))
+		if err != nil {
+			result = append(result, "unreadable")
+			continue
+		}
+		result = append(result, fmt.Sprintf("%x", sha256.Sum256(content)))
+	}
+	return result
+}
+
+func applyTLS(config *sarama.Config, opts *args.Options) error {
+	if !opts.Bool("kafka-tls") {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.Bool("kafka-tls-insecure")}
+
+	if opts.String("kafka-tls-ca") != "" {
+		content, err := ioutil.ReadFile(opts.String("kafka-tls-ca"))
+		if err != nil {
+			return errors.Wrap(err, "while reading 'kafka-tls-ca'")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return errors.Errorf("no PEM certificates found in 'kafka-tls-ca' - '%s'",
+				opts.String("kafka-tls-ca"))
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// Client certificates are only needed if the brokers require mutual TLS
+	if opts.String("kafka-tls-cert") != "" || opts.String("kafka-tls-key") != "" {
+		cert, err := tls.LoadX509KeyPair(opts.String("kafka-tls-cert"), opts.String("kafka-tls-key"))
+		if err != nil {
+			return errors.Wrap(err, "while loading 'kafka-tls-cert' and 'kafka-tls-key'")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = tlsConfig
+	return nil
+}
+
+func applySASL(config *sarama.Config, opts *args.Options) error {
+	mechanism := opts.String("kafka-sasl-mechanism")
+	if mechanism == "" {
+		return nil
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User = opts.String("kafka-sasl-user")
+	config.Net.SASL.Password = opts.String("kafka-sasl-password")
+
+	switch mechanism {
+	case SASLPlain:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case SASLScramSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scramSHA256}
+		}
+	case SASLScramSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scramSHA512}
+		}
+	default:
+		return errors.Errorf("invalid 'kafka-sasl-mechanism' '%s' - must be one of [%s %s %s]",
+			mechanism, SASLPlain, SASLScramSHA256, SASLScramSHA512)
+	}
+
+	if config.Net.SASL.User == "" {
+		return errors.Errorf("'kafka-sasl-user' is required when 'kafka-sasl-mechanism' is '%s'", mechanism)
+	}
+	return nil
+}
+
+var (
+	scramSHA256 scram.HashGeneratorFcn = func() hash.Hash { return sha256.New() }
+	scramSHA512 scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+)
+
+// Implements sarama.SCRAMClient
+type scramClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (self *scramClient) Begin(user, password, authzID string) error {
+	client, err := self.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return errors.Wrap(err, "scram NewClient()")
+	}
+	self.conversation = client.NewConversation()
+	return nil
+}
+
+func (self *scramClient) Step(challenge string) (string, error) {
+	return self.conversation.Step(challenge)
+}
+
+func (self *scramClient) Done() bool {
+	return self.conversation.Done()
+}
@@ -0,0 +1,187 @@
+package kafka_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Shopify/sarama"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/kafka"
+)
+
+// Write a self signed CA and a client certificate signed by it to 'dir'
+func writeCertificates(dir string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "detka-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	Expect(err).To(BeNil())
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	client := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "detka-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, client, ca, &clientKey.PublicKey, caKey)
+	Expect(err).To(BeNil())
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	Expect(err).To(BeNil())
+
+	write := func(name, kind string, content []byte) {
+		data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: content})
+		Expect(ioutil.WriteFile(path.Join(dir, name), data, 0600)).To(BeNil())
+	}
+	write("ca.pem", "CERTIFICATE", caDER)
+	write("client.pem", "CERTIFICATE", clientDER)
+	write("client-key.pem", "EC PRIVATE KEY", keyDER)
+	Expect(ioutil.WriteFile(path.Join(dir, "empty.pem"), []byte("not a certificate"), 0600)).To(BeNil())
+}
+
+var _ = Describe("NewConfig", func() {
+	var dir string
+
+	// Returns the options of a parser with only the given options set, file names are relative to 'dir'
+	newOpts := func(values map[string]string) *args.Options {
+		parser := args.NewParser()
+		for _, name := range []string{"kafka-tls", "kafka-tls-insecure"} {
+			parser.AddOption("--" + name).IsBool().Default("false")
+		}
+		for _, name := range []string{"kafka-tls-ca", "kafka-tls-cert", "kafka-tls-key",
+			"kafka-sasl-mechanism", "kafka-sasl-user", "kafka-sasl-password"} {
+			parser.AddOption("--" + name)
+		}
+		opts, err := parser.ParseArgs(nil)
+		Expect(err).To(BeNil())
+		for key, value := range values {
+			if key == "kafka-tls-ca" || key == "kafka-tls-cert" || key == "kafka-tls-key" {
+				value = path.Join(dir, value)
+			}
+			opts.Set(key, value)
+		}
+		return opts
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-kafka-config")
+		Expect(err).To(BeNil())
+		writeCertificates(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should not enable TLS or SASL by default", func() {
+		config, err := kafka.NewConfig(newOpts(nil))
+		Expect(err).To(BeNil())
+		Expect(config.Net.TLS.Enable).To(BeFalse())
+		Expect(config.Net.SASL.Enable).To(BeFalse())
+		Expect(config.Validate()).To(BeNil())
+	})
+
+	It("should trust the CA bundle and present the client certificate", func() {
+		config, err := kafka.NewConfig(newOpts(map[string]string{
+			"kafka-tls":      "true",
+			"kafka-tls-ca":   "ca.pem",
+			"kafka-tls-cert": "client.pem",
+			"kafka-tls-key":  "client-key.pem",
+		}))
+		Expect(err).To(BeNil())
+		Expect(config.Net.TLS.Enable).To(BeTrue())
+		Expect(config.Net.TLS.Config.InsecureSkipVerify).To(BeFalse())
+		Expect(config.Net.TLS.Config.RootCAs.Subjects()).To(HaveLen(1))
+		Expect(config.Net.TLS.Config.Certificates).To(HaveLen(1))
+	})
+
+	It("should report a certificate rotated in place as a changed config", func() {
+		opts := newOpts(map[string]string{
+			"kafka-tls":      "true",
+			"kafka-tls-ca":   "ca.pem",
+			"kafka-tls-cert": "client.pem",
+			"kafka-tls-key":  "client-key.pem",
+		})
+		before := kafka.ClientConfigFromOpts(opts)
+		Expect(kafka.ClientConfigFromOpts(opts)).To(Equal(before))
+
+		// Same paths, new certificates
+		writeCertificates(dir)
+		Expect(kafka.ClientConfigFromOpts(opts)).To(Not(Equal(before)))
+	})
+
+	table.DescribeTable("SASL mechanisms",
+		func(mechanism string, expected sarama.SASLMechanism, scram bool) {
+			config, err := kafka.NewConfig(newOpts(map[string]string{
+				"kafka-sasl-mechanism": mechanism,
+				"kafka-sasl-user":      "detka",
+				"kafka-sasl-password":  "secret",
+			}))
+			Expect(err).To(BeNil())
+			Expect(config.Net.SASL.Enable).To(BeTrue())
+			Expect(config.Net.SASL.Mechanism).To(Equal(expected))
+			Expect(config.Net.SASL.User).To(Equal("detka"))
+			Expect(config.Net.SASL.Password).To(Equal("secret"))
+			if scram {
+				client := config.Net.SASL.SCRAMClientGeneratorFunc()
+				Expect(client.Begin("detka", "secret", "")).To(BeNil())
+				Expect(client.Done()).To(BeFalse())
+			} else {
+				Expect(config.Net.SASL.SCRAMClientGeneratorFunc).To(BeNil())
+			}
+			Expect(config.Validate()).To(BeNil())
+		},
+		table.Entry("PLAIN", kafka.SASLPlain, sarama.SASLMechanism(sarama.SASLTypePlaintext), false),
+		table.Entry("SCRAM-SHA-256", kafka.SASLScramSHA256, sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA256), true),
+		table.Entry("SCRAM-SHA-512", kafka.SASLScramSHA512, sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA512), true),
+	)
+
+	table.DescribeTable("invalid options",
+		func(values map[string]string, message string) {
+			_, err := kafka.NewConfig(newOpts(values))
+			Expect(err).To(Not(BeNil()))
+			Expect(err.Error()).To(ContainSubstring(message))
+		},
+		table.Entry("missing CA bundle",
+			map[string]string{"kafka-tls": "true", "kafka-tls-ca": "missing.pem"},
+			"while reading 'kafka-tls-ca'"),
+		table.Entry("CA bundle without certificates",
+			map[string]string{"kafka-tls": "true", "kafka-tls-ca": "empty.pem"},
+			"no PEM certificates found in 'kafka-tls-ca'"),
+		table.Entry("missing client certificate",
+			map[string]string{"kafka-tls": "true", "kafka-tls-cert": "missing.pem", "kafka-tls-key": "client-key.pem"},
+			"while loading 'kafka-tls-cert' and 'kafka-tls-key'"),
+		table.Entry("client key without a certificate",
+			map[string]string{"kafka-tls": "true", "kafka-tls-key": "client-key.pem"},
+			"while loading 'kafka-tls-cert' and 'kafka-tls-key'"),
+		table.Entry("unknown SASL mechanism",
+			map[string]string{"kafka-sasl-mechanism": "GSSAPI", "kafka-sasl-user": "detka"},
+			"invalid 'kafka-sasl-mechanism' 'GSSAPI'"),
+		table.Entry("SASL without a user",
+			map[string]string{"kafka-sasl-mechanism": kafka.SASLPlain},
+			"'kafka-sasl-user' is required"),
+	)
+})
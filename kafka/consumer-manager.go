@@ -1,71 +1,372 @@
 package kafka
 
 import (
-	"time"
+	"sort"
+	"strconv"
+	"sync"
 
 	"github.com/Shopify/sarama"
-	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/thrawn01/args"
 	"github.com/thrawn01/detka/connection"
+	"github.com/thrawn01/detka/metrics"
+	"github.com/thrawn01/detka/queue"
+	"golang.org/x/net/context"
 )
 
+// A single connection to the consumer group, leased through the connection.Manager so a
+// reconnect does not close it while an Ack() is using it. Kafka assigns each partition of the
+// subscribed topics to one member of 'kafka-consumer-group', so every record is handled by a
+// single worker and the records of a partition are handled in order
+type consumerConn struct {
+	manager  *ConsumerManager
+	group    sarama.ConsumerGroup
+	closers  []func() error
+	ctx      context.Context
+	cancel   context.CancelFunc
+	finished chan struct{}
+	// Signaled when a topic is subscribed, so the next session includes it
+	changed chan struct{}
+
+	mutex sync.Mutex
+	// The current session of the group, nil between rebalances
+	session sarama.ConsumerGroupSession
+	// Ends the current session, see resubscribe()
+	endSession context.CancelFunc
+}
+
+func newConsumerConn(manager *ConsumerManager, group sarama.ConsumerGroup, closers []func() error) *consumerConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &consumerConn{
+		manager:  manager,
+		group:    group,
+		closers:  closers,
+		ctx:      ctx,
+		cancel:   cancel,
+		finished: make(chan struct{}),
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// Join the group with the subscribed topics until closed, joins again after each rebalance
+func (self *consumerConn) run() {
+	defer close(self.finished)
+	go self.logErrors()
+
+	for {
+		if self.ctx.Err() != nil {
+			return
+		}
+
+		self.mutex.Lock()
+		select {
+		case <-self.changed:
+		default:
+		}
+		topics := self.manager.topics()
+		ctx, endSession := context.WithCancel(self.ctx)
+		self.endSession = endSession
+		self.mutex.Unlock()
+
+		// Nothing to consume until a topic is subscribed
+		if len(topics) == 0 {
+			select {
+			case <-self.changed:
+			case <-self.ctx.Done():
+			}
+			endSession()
+			continue
+		}
+
+		err := self.group.Consume(ctx, topics, self)
+		endSession()
+		if err != nil && self.ctx.Err() == nil {
+			logrus.WithFields(logrus.Fields{
+				"type":   "kafka",
+				"method": "ConsumerManager.run()",
+			}).Error("Consume failed with - ", err.Error())
+			self.manager.setError(errors.Wrap(err, "Consume()"))
+			go self.manager.Signal()
+			return
+		}
+	}
+}
+
+// End the current session so the group is joined again with the subscribed topics
+func (self *consumerConn) resubscribe() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.endSession != nil {
+		self.endSession()
+	}
+	select {
+	case self.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (self *consumerConn) logErrors() {
+	for err := range self.group.Errors() {
+		logrus.WithFields(logrus.Fields{
+			"type":   "kafka",
+			"method": "ConsumerManager.logErrors()",
+		}).Error("Received Error - ", err.Error())
+	}
+}
+
+// Implements sarama.ConsumerGroupHandler
+func (self *consumerConn) Setup(session sarama.ConsumerGroupSession) error {
+	self.mutex.Lock()
+	self.session = session
+	self.mutex.Unlock()
+	return nil
+}
+
+// Implements sarama.ConsumerGroupHandler, the offsets marked during the session are
+// committed once it returns
+func (self *consumerConn) Cleanup(sarama.ConsumerGroupSession) error {
+	self.mutex.Lock()
+	self.session = nil
+	self.mutex.Unlock()
+	return nil
+}
+
+// Implements sarama.ConsumerGroupHandler, forwards the records of a partition assigned to
+// us to the subscription channel until the session ends
+func (self *consumerConn) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	topic, records := self.manager.subscription(claim.Topic())
+	if records == nil {
+		return nil
+	}
+
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			// Number of records published to the partition after this one
+			metrics.ConsumerLag.WithLabelValues(topic, strconv.Itoa(int(msg.Partition))).
+				Set(float64(claim.HighWaterMarkOffset() - msg.Offset - 1))
+
+			select {
+			case records <- FromConsumerMessage(topic, msg):
+			case <-session.Context().Done():
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Mark the record as consumed, returns an error if the partition is no longer assigned to us
+func (self *consumerConn) markOffset(name string, record *queue.Record) error {
+	self.mutex.Lock()
+	session := self.session
+	self.mutex.Unlock()
+
+	if session != nil {
+		for _, partition := range session.Claims()[name] {
+			if partition == record.Partition {
+				session.MarkOffset(name, record.Partition, record.Offset+1, "")
+				return nil
+			}
+		}
+	}
+	return errors.Errorf("Not consuming partition '%d' of topic '%s'", record.Partition, record.Topic)
+}
+
+// Leave the group and close the clients, committing the marked offsets
+func (self *consumerConn) Close() error {
+	self.cancel()
+	<-self.finished
+	closeAll(self.closers)
+	return nil
+}
+
 type ConsumerManager struct {
 	*connection.Manager
-	parser       *args.ArgParser
-	consumerChan chan sarama.PartitionConsumer
-	connected    bool
+	parser        *args.ArgParser
+	subscriptions map[string]chan *queue.Record
+	connected     bool
+	// The reason our last connect attempt failed, reported by /healthz
+	lastErr error
 }
 
 func NewConsumerManager(parser *args.ArgParser) *ConsumerManager {
 	manager := &ConsumerManager{
-		&connection.Manager{},
-		parser,
-		make(chan sarama.PartitionConsumer, 1),
-		false,
+		Manager:       connection.NewManager("kafka-consumer", connection.Backoff{}),
+		parser:        parser,
+		subscriptions: make(map[string]chan *queue.Record),
 	}
 	manager.Start()
 	return manager
 }
 
+// Returns a channel of records consumed from the partitions of the topic assigned to this
+// member of the consumer group, the channel survives reconnects and rebalances
+func (self *ConsumerManager) Subscribe(topic string) <-chan *queue.Record {
+	var records chan *queue.Record
+	var exists bool
+
+	self.WithLock(func() {
+		records, exists = self.subscriptions[topic]
+		if !exists {
+			records = make(chan *queue.Record)
+			self.subscriptions[topic] = records
+		}
+	})
+
+	// If connected, join the group again with the new topic, else it's consumed on connect
+	if !exists {
+		conn, release := self.acquire()
+		if conn != nil {
+			conn.resubscribe()
+		}
+		release()
+	}
+	return records
+}
+
+// Mark the record as consumed, the offset is committed to kafka periodically. A reconnect
+// waits for the Ack() in flight before leaving the group
+func (self *ConsumerManager) Ack(record *queue.Record) error {
+	conn, release := self.acquire()
+	defer release()
+
+	if conn == nil {
+		return errors.Errorf("Not consuming partition '%d' of topic '%s'", record.Partition, record.Topic)
+	}
+	return conn.markOffset(TopicName(self.parser.GetOpts().String("kafka-topic"), record.Topic), record)
+}
+
+// Returns the kafka topic names of the subscriptions
+func (self *ConsumerManager) topics() []string {
+	base := self.parser.GetOpts().String("kafka-topic")
+	var result []string
+	self.WithLock(func() {
+		for topic := range self.subscriptions {
+			result = append(result, TopicName(base, topic))
+		}
+	})
+	sort.Strings(result)
+	return result
+}
+
+// Returns the queue topic and channel subscribed to the kafka topic 'name'
+func (self *ConsumerManager) subscription(name string) (topic string, records chan *queue.Record) {
+	base := self.parser.GetOpts().String("kafka-topic")
+	self.WithLock(func() {
+		for key, value := range self.subscriptions {
+			if TopicName(base, key) == name {
+				topic, records = key, value
+			}
+		}
+	})
+	return
+}
+
 func (self *ConsumerManager) connect() bool {
 	opts := self.parser.GetOpts()
+
 	logrus.Info("Connecting to Kafka Cluster ", opts.StringSlice("kafka-endpoints"))
-	consumer, err := sarama.NewConsumer(opts.StringSlice("kafka-endpoints"), nil)
+	config, err := NewConfig(opts)
+	if err != nil {
+		logrus.Error("Invalid kafka config - ", err)
+		self.setError(err)
+		return false
+	}
+	config.Consumer.Return.Errors = true
+	// Without a committed offset for our group, only consume new messages
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+
+	client, err := sarama.NewClient(opts.StringSlice("kafka-endpoints"), config)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"type":   "kafka",
-			"method": "NewConsumer()",
+			"method": "NewClient()",
 		}).Error("Failed with - ", err.Error())
-		self.setConnected(false)
+		self.setError(errors.Wrap(err, "NewClient()"))
 		return false
 	}
-	partition, err := consumer.ConsumePartition(opts.String("kafka-topic"), 0, sarama.OffsetNewest)
+
+	group, err := sarama.NewConsumerGroupFromClient(opts.String("kafka-consumer-group"), client)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"type":   "kafka",
-			"method": "ConsumePartition()",
+			"method": "NewConsumerGroupFromClient()",
 		}).Error("Failed with - ", err.Error())
-		self.setConnected(false)
+		client.Close()
+		self.setError(errors.Wrap(err, "NewConsumerGroupFromClient()"))
 		return false
 	}
-	if partition != nil {
-		self.setConnected(true)
-		self.consumerChan <- partition
-	}
+	conn := newConsumerConn(self, group, []func() error{group.Close, client.Close})
+
+	// The new connection is ready, wait for the acks in flight on the previous connection
+	// and close it so its offsets are committed before we resume consuming from them
+	self.Swap(conn, closeConsumer)()
+	self.WithLock(func() {
+		self.connected = true
+		self.lastErr = nil
+	})
+	go conn.run()
 	return true
 }
 
-func (self *ConsumerManager) GetConsumerChannel() chan sarama.PartitionConsumer {
-	return self.consumerChan
+// Returns the current connection and a func to call once done with it, nil if not connected
+func (self *ConsumerManager) acquire() (*consumerConn, func()) {
+	value, release := self.Acquire()
+	conn, _ := value.(*consumerConn)
+	return conn, release
+}
+
+// Leave the group and close the current connection once the acks in flight finish
+func (self *ConsumerManager) disconnect() {
+	self.WithLock(func() {
+		self.connected = false
+	})
+	self.Swap(nil, closeConsumer)()
+}
+
+func closeConsumer(value interface{}) {
+	value.(*consumerConn).Close()
+}
+
+// The options the consumer depends on, see Reconfigure()
+type consumerConfig struct {
+	clientConfig
+	Topic string
+	Group string
+}
+
+func consumerConfigFromOpts(opts *args.Options) consumerConfig {
+	return consumerConfig{
+		clientConfig: clientConfigFromOpts(opts),
+		Topic:        opts.String("kafka-topic"),
+		Group:        opts.String("kafka-consumer-group"),
+	}
 }
 
 func (self *ConsumerManager) Start() {
-	// run connect(), if it fails try again every 2 seconds
-	self.Begin(self.connect, time.Second*2)
+	opts := self.parser.GetOpts()
+	self.Manager.Reconfigure(consumerConfigFromOpts(opts))
+	// run connect(), if it fails try again as the backoff options say
+	self.SetBackoff(connection.BackoffFromOpts(opts))
+	self.Begin(self.connect)
+}
+
+// Apply the current options, reconnects only if the options of the consumer changed
+func (self *ConsumerManager) Reconfigure() bool {
+	opts := self.parser.GetOpts()
+	self.SetBackoff(connection.BackoffFromOpts(opts))
+	return self.Manager.Reconfigure(consumerConfigFromOpts(opts))
 }
 
 func (self *ConsumerManager) Stop() {
 	self.End()
+	self.disconnect()
 }
 
 func (self *ConsumerManager) IsConnected() (result bool) {
@@ -74,8 +375,30 @@ func (self *ConsumerManager) IsConnected() (result bool) {
 	})
 	return
 }
-func (self *ConsumerManager) setConnected(set bool) {
+
+// Mark the consumer as disconnected because of 'err'
+func (self *ConsumerManager) setError(err error) {
 	self.WithLock(func() {
-		self.connected = set
+		self.connected = false
+		self.lastErr = err
 	})
 }
+
+// Returns the reason the consumer is not connected, nil if connected
+func (self *ConsumerManager) LastError() (result error) {
+	self.WithLock(func() {
+		result = self.lastErr
+	})
+	return
+}
+
+func closeAll(closers []func() error) {
+	for _, closer := range closers {
+		if err := closer(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"type":   "kafka",
+				"method": "closeAll()",
+			}).Debug(err.Error())
+		}
+	}
+}
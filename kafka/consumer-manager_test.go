@@ -0,0 +1,87 @@
+package kafka_test
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/kafka"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+)
+
+var _ = Describe("ConsumerManager", func() {
+	var parser *args.ArgParser
+
+	BeforeEach(func() {
+		if os.Getenv("DETKA_DOCKER_HOST") == "" {
+			Skip("DETKA_DOCKER_HOST not set, skipped....")
+		}
+
+		parser = args.NewParser()
+		parser.AddOption("--kafka-endpoints")
+		parser.AddOption("--kafka-topic")
+		parser.AddOption("--kafka-consumer-group")
+		parser.AddOption("--kafka-producer-mode").Default("sync")
+
+		opts, err := parser.ParseArgs(nil)
+		Expect(err).To(BeNil())
+		opts.Set("kafka-endpoints", fmt.Sprintf("%s:9092", os.Getenv("DETKA_DOCKER_HOST")))
+		// Each test gets its own topics and group
+		opts.Set("kafka-topic", "detka-group-"+models.NewId())
+		opts.Set("kafka-consumer-group", "detka-group-"+models.NewId())
+		parser.Apply(opts)
+	})
+
+	Context("When two consumers are in the same group", func() {
+		It("should hand each record to only one of the consumers", func() {
+			producer := kafka.NewProducerManager(parser)
+			defer producer.Stop()
+			first := kafka.NewConsumerManager(parser)
+			defer first.Stop()
+			second := kafka.NewConsumerManager(parser)
+			defer second.Stop()
+
+			records := []<-chan *queue.Record{first.Subscribe("normal"), second.Subscribe("normal")}
+			consumers := []*kafka.ConsumerManager{first, second}
+			received := make(map[string]int)
+
+			// Collect what either consumer has received, acking as we go
+			collect := func(wait time.Duration) {
+				timeout := time.After(wait)
+				for {
+					select {
+					case record := <-records[0]:
+						received[string(record.Value)]++
+						Expect(consumers[0].Ack(record)).To(BeNil())
+					case record := <-records[1]:
+						received[string(record.Value)]++
+						Expect(consumers[1].Ack(record)).To(BeNil())
+					case <-timeout:
+						return
+					}
+				}
+			}
+
+			// The group starts from the newest offset, publish until both consumers joined
+			Eventually(func() int {
+				Expect(producer.Send(&queue.Record{Topic: "normal", Value: []byte(models.NewId())})).To(BeNil())
+				collect(time.Millisecond * 500)
+				return len(received)
+			}, time.Second*60).Should(BeNumerically(">=", 3))
+
+			for i := 0; i < 20; i++ {
+				Expect(producer.Send(&queue.Record{Topic: "normal", Value: []byte(models.NewId())})).To(BeNil())
+			}
+			collect(time.Second * 5)
+
+			for value, count := range received {
+				Expect(count).To(Equal(1), "record '%s' was handled %d times", value, count)
+			}
+			Expect(len(received)).To(BeNumerically(">=", 23))
+		})
+	})
+})
@@ -0,0 +1,4 @@
+package kafka
+
+// Expose the options a connection depends on to the kafka_test package
+var ClientConfigFromOpts = clientConfigFromOpts
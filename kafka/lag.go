@@ -0,0 +1,52 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+)
+
+// Returns the number of records published to the priority lanes that 'group' has yet to
+// commit. Partitions the group has never committed an offset for are not counted
+func ConsumerLag(client sarama.Client, base, group string) (int64, error) {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return 0, errors.Wrap(err, "Coordinator()")
+	}
+
+	var total int64
+	for _, priority := range models.Priorities {
+		name := TopicName(base, queue.LaneTopic(priority))
+		partitions, err := client.Partitions(name)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Partitions('%s')", name)
+		}
+
+		request := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 1}
+		for _, partition := range partitions {
+			request.AddPartition(name, partition)
+		}
+
+		response, err := coordinator.FetchOffset(request)
+		if err != nil {
+			return 0, errors.Wrap(err, "FetchOffset()")
+		}
+
+		for _, partition := range partitions {
+			block := response.GetBlock(name, partition)
+			if block == nil || block.Err != sarama.ErrNoError || block.Offset < 0 {
+				continue
+			}
+
+			newest, err := client.GetOffset(name, partition, sarama.OffsetNewest)
+			if err != nil {
+				return 0, errors.Wrapf(err, "GetOffset('%s', %d)", name, partition)
+			}
+			if newest > block.Offset {
+				total += newest - block.Offset
+			}
+		}
+	}
+	return total, nil
+}
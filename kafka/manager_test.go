@@ -0,0 +1,119 @@
+package kafka_test
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/kafka"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+)
+
+var _ = Describe("Reconfigure", func() {
+	var parser *args.ArgParser
+	var opts *args.Options
+
+	BeforeEach(func() {
+		if os.Getenv("DETKA_DOCKER_HOST") == "" {
+			Skip("DETKA_DOCKER_HOST not set, skipped....")
+		}
+
+		parser = args.NewParser()
+		parser.AddOption("--kafka-endpoints")
+		parser.AddOption("--kafka-topic").Default("detka-reconfigure")
+		parser.AddOption("--kafka-consumer-group").Default("detka-reconfigure")
+		parser.AddOption("--kafka-producer-mode").Default("sync")
+		parser.AddOption("--kafka-linger").IsInt().Default("10")
+
+		var err error
+		opts, err = parser.ParseArgs(nil)
+		Expect(err).To(BeNil())
+		opts.Set("kafka-endpoints", fmt.Sprintf("%s:9092", os.Getenv("DETKA_DOCKER_HOST")))
+		parser.Apply(opts)
+	})
+
+	Describe("ConsumerManager", func() {
+		var consumer *kafka.ConsumerManager
+		var producer *kafka.ProducerManager
+
+		BeforeEach(func() {
+			consumer = kafka.NewConsumerManager(parser)
+			producer = kafka.NewProducerManager(parser)
+		})
+
+		AfterEach(func() {
+			producer.Stop()
+			consumer.Stop()
+		})
+
+		// Publish until the consumer receives a record, the consumer starts from the newest offset
+		receive := func(records <-chan *queue.Record) *queue.Record {
+			var result *queue.Record
+			Eventually(func() bool {
+				producer.Send(&queue.Record{Topic: "normal", Value: []byte(models.NewId())})
+				select {
+				case result = <-records:
+					return true
+				case <-time.After(time.Millisecond * 500):
+					return false
+				}
+			}, time.Second*30).Should(BeTrue())
+			return result
+		}
+
+		It("should keep the connection when the options of the consumer are unchanged", func() {
+			records := consumer.Subscribe("normal")
+			Eventually(consumer.IsConnected, time.Second*10).Should(BeTrue())
+
+			// The linger only applies to the producer
+			opts.Set("kafka-linger", "20")
+			parser.Apply(opts)
+			Expect(consumer.Reconfigure()).To(BeFalse())
+			Expect(consumer.Ack(receive(records))).To(BeNil())
+		})
+
+		It("should reconnect and resume consuming when the options of the consumer change", func() {
+			records := consumer.Subscribe("normal")
+			Eventually(consumer.IsConnected, time.Second*10).Should(BeTrue())
+			Expect(consumer.Ack(receive(records))).To(BeNil())
+
+			opts.Set("kafka-consumer-group", "detka-reconfigure-"+models.NewId())
+			parser.Apply(opts)
+			Expect(consumer.Reconfigure()).To(BeTrue())
+
+			// The subscription survives the reconnect
+			Expect(consumer.Ack(receive(records))).To(BeNil())
+			Expect(consumer.LastError()).To(BeNil())
+		})
+	})
+
+	Describe("ProducerManager", func() {
+		var producer *kafka.ProducerManager
+
+		BeforeEach(func() {
+			producer = kafka.NewProducerManager(parser)
+		})
+
+		AfterEach(func() {
+			producer.Stop()
+		})
+
+		It("should reconnect only when the options of the producer change", func() {
+			Eventually(producer.IsConnected, time.Second*10).Should(BeTrue())
+			Expect(producer.Reconfigure()).To(BeFalse())
+
+			opts.Set("kafka-producer-mode", "async")
+			parser.Apply(opts)
+			Expect(producer.Reconfigure()).To(BeTrue())
+
+			Eventually(func() error {
+				return producer.Send(&queue.Record{Topic: "normal", Value: []byte("reconfigured")})
+			}, time.Second*10).Should(BeNil())
+			Expect(producer.LastError()).To(BeNil())
+		})
+	})
+})
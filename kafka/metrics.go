@@ -0,0 +1,55 @@
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Sarama records producer statistics here, every ProducerManager shares the same registry
+var MetricRegistry = gometrics.NewRegistry()
+
+var quantiles = []float64{0.5, 0.9, 0.99}
+
+// Exports the batching statistics sarama records in MetricRegistry as prometheus summaries
+type SaramaCollector struct {
+	registry gometrics.Registry
+	descs    map[string]*prometheus.Desc
+}
+
+func NewSaramaCollector(registry gometrics.Registry) *SaramaCollector {
+	return &SaramaCollector{
+		registry: registry,
+		descs: map[string]*prometheus.Desc{
+			"batch-size": prometheus.NewDesc("api_kafka_batch_size_bytes",
+				"The size in bytes of the batches sent to kafka.", nil, nil),
+			"records-per-request": prometheus.NewDesc("api_kafka_batch_size_records",
+				"The number of records in each request sent to kafka.", nil, nil),
+			"compression-ratio": prometheus.NewDesc("api_kafka_compression_ratio",
+				"The compression ratio times 100 of the batches sent to kafka.", nil, nil),
+		},
+	}
+}
+
+func (self *SaramaCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range self.descs {
+		ch <- desc
+	}
+}
+
+func (self *SaramaCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, desc := range self.descs {
+		histogram, ok := self.registry.Get(name).(gometrics.Histogram)
+		if !ok {
+			continue
+		}
+		snapshot := histogram.Snapshot()
+		values := snapshot.Percentiles(quantiles)
+
+		result := make(map[float64]float64, len(quantiles))
+		for i, quantile := range quantiles {
+			result[quantile] = values[i]
+		}
+		ch <- prometheus.MustNewConstSummary(desc, uint64(snapshot.Count()),
+			float64(snapshot.Sum()), result)
+	}
+}
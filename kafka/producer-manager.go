@@ -1,65 +1,107 @@
 package kafka
 
 import (
-	"net/http"
+	"io"
 	"time"
 
 	"github.com/Shopify/sarama"
-	"github.com/Sirupsen/logrus"
-	"github.com/pressly/chi"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/thrawn01/args"
 	"github.com/thrawn01/detka/connection"
-	"golang.org/x/net/context"
+	"github.com/thrawn01/detka/queue"
 )
 
-type contextKey int
-
-const (
-	producerManagerKey contextKey = 1
-)
-
-func SetProducerManager(ctx context.Context, manager *ProducerManager) context.Context {
-	return context.WithValue(ctx, producerManagerKey, manager)
+type ProducerManager struct {
+	*connection.Manager
+	parser    *args.ArgParser
+	connected bool
+	// The reason our last connect attempt failed, reported by /healthz
+	lastErr error
 }
 
-func GetProducerManager(ctx context.Context) *ProducerManager {
-	obj, ok := ctx.Value(producerManagerKey).(*ProducerManager)
-	if !ok {
-		panic("No kafka.ProducerManager found in context")
-	}
-	return obj
+// The options the producer depends on, see Reconfigure()
+type producerConfig struct {
+	clientConfig
+	Topic       string
+	Mode        string
+	Compression string
+	Linger      int
+	BatchSize   int
+	BatchBytes  int
 }
 
-type ProducerManager struct {
-	*connection.Manager
-	parser   *args.ArgParser
-	producer Producer
+func producerConfigFromOpts(opts *args.Options) producerConfig {
+	return producerConfig{
+		clientConfig: clientConfigFromOpts(opts),
+		Topic:        opts.String("kafka-topic"),
+		Mode:         opts.String("kafka-producer-mode"),
+		Compression:  opts.String("kafka-compression"),
+		Linger:       opts.Int("kafka-linger"),
+		BatchSize:    opts.Int("kafka-batch-size"),
+		BatchBytes:   opts.Int("kafka-batch-bytes"),
+	}
 }
 
 func NewProducerManager(parser *args.ArgParser) *ProducerManager {
 	manager := &ProducerManager{
-		&connection.Manager{},
+		connection.NewManager("kafka-producer", connection.Backoff{}),
 		parser,
+		false,
 		nil,
 	}
 	manager.Start()
 	return manager
 }
 
-func (self *ProducerManager) GetProducer() (result Producer) {
-	self.WithLock(func() {
-		result = self.producer
-	})
-	return
+// Returns the current producer without acquiring it, prefer Send()
+func (self *ProducerManager) GetProducer() Producer {
+	if producer, ok := self.Current().(Producer); ok {
+		return producer
+	}
+	return &NilProducer{}
+}
+
+// Send the record with the current producer, a producer replaced by a reconnect is not
+// closed until the records sent with it are acknowledged
+func (self *ProducerManager) Send(record *queue.Record) error {
+	value, release := self.Acquire()
+	defer release()
+	if producer, ok := value.(Producer); ok {
+		return producer.Send(record)
+	}
+	return (&NilProducer{}).Send(record)
 }
 
 func (self *ProducerManager) Start() {
-	// run connect(), if it fails try again every 2 seconds
-	self.Begin(self.connect, time.Second*2)
+	opts := self.parser.GetOpts()
+	self.Manager.Reconfigure(producerConfigFromOpts(opts))
+	// run connect(), if it fails try again as the backoff options say
+	self.SetBackoff(connection.BackoffFromOpts(opts))
+	self.Begin(self.connect)
 }
 
+// Apply the current options, reconnects only if the options of the producer changed
+func (self *ProducerManager) Reconfigure() bool {
+	opts := self.parser.GetOpts()
+	self.SetBackoff(connection.BackoffFromOpts(opts))
+	return self.Manager.Reconfigure(producerConfigFromOpts(opts))
+}
+
+// Waits for the records in flight before closing the producer
 func (self *ProducerManager) Stop() {
 	self.End()
+	self.Swap(nil, closeProducer)()
+	self.WithLock(func() {
+		self.connected = false
+	})
+}
+
+func (self *ProducerManager) IsConnected() (result bool) {
+	self.WithLock(func() {
+		result = self.connected
+	})
+	return
 }
 
 func (self *ProducerManager) connect() bool {
@@ -67,27 +109,98 @@ func (self *ProducerManager) connect() bool {
 
 	brokerList := opts.StringSlice("kafka-endpoints")
 	logrus.Info("Connecting to Kafka Cluster ", brokerList)
-	config := sarama.NewConfig()
+	config, err := NewConfig(opts)
+	if err != nil {
+		logrus.Error("Invalid kafka config - ", err)
+		self.setError(err)
+		return false
+	}
 	config.Producer.RequiredAcks = sarama.WaitForAll
 	config.Producer.Retry.Max = 3
+	config.Producer.Return.Successes = true
 
-	producer, err := sarama.NewSyncProducer(brokerList, config)
+	compression, err := CompressionCodec(opts.String("kafka-compression"))
 	if err != nil {
-		logrus.Error("NewSyncProducer() failed - ", err)
+		logrus.Error("Invalid 'kafka-compression' - ", err)
+		self.setError(err)
 		return false
 	}
+	config.Producer.Compression = compression
+
+	var producer Producer
+	if opts.String("kafka-producer-mode") == "sync" {
+		syncProducer, err := sarama.NewSyncProducer(brokerList, config)
+		if err != nil {
+			logrus.Error("NewSyncProducer() failed - ", err)
+			self.setError(errors.Wrap(err, "NewSyncProducer()"))
+			return false
+		}
+		producer = NewProducer(self, opts.String("kafka-topic"), syncProducer)
+	} else {
+		// Wait at most 'kafka-linger' for a batch to fill before sending it
+		config.Producer.Flush.Frequency = time.Duration(opts.Int("kafka-linger")) * time.Millisecond
+		config.Producer.Flush.Messages = opts.Int("kafka-batch-size")
+		config.Producer.Flush.Bytes = opts.Int("kafka-batch-bytes")
+		config.Producer.Return.Errors = true
+
+		asyncProducer, err := sarama.NewAsyncProducer(brokerList, config)
+		if err != nil {
+			logrus.Error("NewAsyncProducer() failed - ", err)
+			self.setError(errors.Wrap(err, "NewAsyncProducer()"))
+			return false
+		}
+		producer = NewAsyncProducer(self, opts.String("kafka-topic"), asyncProducer)
+	}
+
+	// Our endpoints or credentials may have changed, close the previous producer
+	// once the records sent with it are acknowledged
+	closePrevious := self.Swap(producer, closeProducer)
 	self.WithLock(func() {
-		self.producer = NewProducer(self, opts.String("kafka-topic"), producer)
+		self.connected = true
+		self.lastErr = nil
 	})
+	go closePrevious()
 	return true
 }
 
-// Injects kafka.ProducerManager into the context.Context for each request
-func Middleware(producerManager *ProducerManager) func(chi.Handler) chi.Handler {
-	return func(next chi.Handler) chi.Handler {
-		return chi.HandlerFunc(func(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
-			ctx = SetProducerManager(ctx, producerManager)
-			next.ServeHTTPC(ctx, resp, req)
-		})
+func closeProducer(value interface{}) {
+	if closer, ok := value.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"type":   "kafka",
+				"method": "closeProducer()",
+			}).Warn("Close Failed - ", err.Error())
+		}
+	}
+}
+
+// Mark the producer as disconnected because of 'err'
+func (self *ProducerManager) setError(err error) {
+	self.WithLock(func() {
+		self.connected = false
+		self.lastErr = err
+	})
+}
+
+// Returns the reason the producer is not connected, nil if connected
+func (self *ProducerManager) LastError() (result error) {
+	self.WithLock(func() {
+		result = self.lastErr
+	})
+	return
+}
+
+// Returns the sarama compression codec by name
+func CompressionCodec(name string) (sarama.CompressionCodec, error) {
+	switch name {
+	case "", "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
 	}
+	return sarama.CompressionNone, errors.Errorf("unknown codec '%s' - must be one of [none gzip snappy lz4]", name)
 }
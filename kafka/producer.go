@@ -1,16 +1,16 @@
 package kafka
 
 import (
-	"encoding/json"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/pkg/errors"
-	"github.com/thrawn01/detka/models"
-	"golang.org/x/net/context"
+	"github.com/thrawn01/detka/metrics"
+	"github.com/thrawn01/detka/queue"
 )
 
 type Producer interface {
-	Send(models.QueueMessage) error
+	Send(*queue.Record) error
 }
 
 // Producer Implementation
@@ -28,21 +28,14 @@ func NewProducer(ctx *ProducerManager, topic string, producer sarama.SyncProduce
 	}
 }
 
-func (self *KafkaProducer) Send(msg models.QueueMessage) error {
-
-	payload, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-
-	_, _, err = self.producer.SendMessage(&sarama.ProducerMessage{
-		Topic: self.topic,
-		Value: sarama.ByteEncoder(payload),
-	})
-
+func (self *KafkaProducer) Send(record *queue.Record) error {
+	start := time.Now()
+	_, _, err := self.producer.SendMessage(ToProducerMessage(self.topic, record))
+	observeLatency("sync", start)
 	if err != nil {
 		if err == sarama.ErrBrokerNotAvailable || err == sarama.ErrClosedClient {
 			// Signal We should reconnect
+			self.ctx.setError(err)
 			self.ctx.Signal()
 		}
 		return err
@@ -50,30 +43,138 @@ func (self *KafkaProducer) Send(msg models.QueueMessage) error {
 	return nil
 }
 
-func (self *KafkaProducer) Get(payload []byte) error {
-	_, _, err := self.producer.SendMessage(&sarama.ProducerMessage{
-		Topic: self.topic,
-		Value: sarama.ByteEncoder(payload),
-	})
+func (self *KafkaProducer) Close() error {
+	return self.producer.Close()
+}
 
-	if err != nil {
-		if err == sarama.ErrBrokerNotAvailable || err == sarama.ErrClosedClient {
-			// Signal We should reconnect
-			self.ctx.Signal()
+// Async Producer Implementation, sarama batches records from concurrent
+// callers into a single request to the broker
+type AsyncKafkaProducer struct {
+	producer sarama.AsyncProducer
+	topic    string
+	ctx      *ProducerManager
+}
+
+// Resolves once kafka acknowledges or rejects the record
+type Future struct {
+	result chan error
+	start  time.Time
+}
+
+// Block until kafka acknowledges the record
+func (self *Future) Wait() error {
+	return <-self.result
+}
+
+func NewAsyncProducer(ctx *ProducerManager, topic string, producer sarama.AsyncProducer) Producer {
+	self := &AsyncKafkaProducer{
+		producer: producer,
+		topic:    topic,
+		ctx:      ctx,
+	}
+	go self.run()
+	return self
+}
+
+// Queue the record in the current batch and wait until the batch is acknowledged
+func (self *AsyncKafkaProducer) Send(record *queue.Record) error {
+	return self.SendAsync(record).Wait()
+}
+
+// Queue the record in the current batch, the future resolves once the batch is acknowledged
+func (self *AsyncKafkaProducer) SendAsync(record *queue.Record) *Future {
+	future := &Future{
+		result: make(chan error, 1),
+		start:  time.Now(),
+	}
+	msg := ToProducerMessage(self.topic, record)
+	msg.Metadata = future
+	self.producer.Input() <- msg
+	return future
+}
+
+func (self *AsyncKafkaProducer) Close() error {
+	return self.producer.Close()
+}
+
+// Resolve the futures as kafka acknowledges the records, until the producer is closed
+func (self *AsyncKafkaProducer) run() {
+	successes := self.producer.Successes()
+	errs := self.producer.Errors()
+
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			future := msg.Metadata.(*Future)
+			observeLatency("async", future.start)
+			future.result <- nil
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			future := err.Msg.Metadata.(*Future)
+			observeLatency("async", future.start)
+			future.result <- err.Err
+
+			if err.Err == sarama.ErrBrokerNotAvailable || err.Err == sarama.ErrClosedClient {
+				// Signal We should reconnect
+				self.ctx.setError(err.Err)
+				go self.ctx.Signal()
+			}
 		}
-		return err
 	}
-	return nil
+}
+
+func observeLatency(mode string, start time.Time) {
+	elapsed := time.Now().Sub(start)
+	metrics.KafkaProduceLatency.WithLabelValues(mode).
+		Observe(float64(elapsed) / float64(time.Millisecond))
+}
+
+// Convert the queue record into a sarama producer message, 'base' is the 'kafka-topic'
+func ToProducerMessage(base string, record *queue.Record) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic: TopicName(base, record.Topic),
+		Value: sarama.ByteEncoder(record.Value),
+	}
+	if len(record.Key) != 0 {
+		msg.Key = sarama.ByteEncoder(record.Key)
+	}
+	for key, value := range record.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(key),
+			Value: []byte(value),
+		})
+	}
+	return msg
+}
+
+// Convert a consumed sarama message into a queue record
+func FromConsumerMessage(topic string, msg *sarama.ConsumerMessage) *queue.Record {
+	record := &queue.Record{
+		Topic:     topic,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+	}
+	if len(msg.Headers) != 0 {
+		record.Headers = make(map[string]string, len(msg.Headers))
+		for _, header := range msg.Headers {
+			record.Headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	return record
 }
 
 // Nil Implementation only returns errors
 type NilProducer struct{}
 
-func (self *NilProducer) Send(msg models.QueueMessage) error {
+func (self *NilProducer) Send(record *queue.Record) error {
 	return errors.New("Not Connected")
 }
-
-// Returns the Kafka interface from our context
-func GetProducer(ctx context.Context) Producer {
-	return GetProducerManager(ctx).GetProducer()
-}
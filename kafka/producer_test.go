@@ -0,0 +1,56 @@
+package kafka_test
+
+import (
+	"errors"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/kafka"
+	"github.com/thrawn01/detka/queue"
+)
+
+var _ = Describe("Producer", func() {
+	Describe("ToProducerMessage", func() {
+		It("should map the queue topic to the kafka topic", func() {
+			msg := kafka.ToProducerMessage("detka-topic", &queue.Record{Topic: "normal"})
+			Expect(msg.Topic).To(Equal("detka-topic"))
+
+			msg = kafka.ToProducerMessage("detka-topic", &queue.Record{Topic: "high"})
+			Expect(msg.Topic).To(Equal("detka-topic-high"))
+		})
+	})
+
+	Describe("AsyncKafkaProducer", func() {
+		var mock *mocks.AsyncProducer
+		var producer *kafka.AsyncKafkaProducer
+
+		BeforeEach(func() {
+			config := sarama.NewConfig()
+			config.Producer.Return.Successes = true
+			mock = mocks.NewAsyncProducer(GinkgoT(), config)
+			producer = kafka.NewAsyncProducer(nil, "detka-topic", mock).(*kafka.AsyncKafkaProducer)
+		})
+
+		AfterEach(func() {
+			producer.Close()
+		})
+
+		Context("When kafka acknowledges the record", func() {
+			It("should resolve the future without error", func() {
+				mock.ExpectInputAndSucceed()
+				future := producer.SendAsync(&queue.Record{Topic: "normal", Value: []byte("value")})
+				Expect(future.Wait()).To(BeNil())
+			})
+		})
+		Context("When kafka rejects the record", func() {
+			It("should resolve the future with the error", func() {
+				mock.ExpectInputAndFail(errors.New("rejected"))
+				err := producer.Send(&queue.Record{Topic: "normal", Value: []byte("value")})
+				Expect(err).To(Not(BeNil()))
+				Expect(err.Error()).To(Equal("rejected"))
+			})
+		})
+	})
+})
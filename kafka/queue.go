@@ -0,0 +1,172 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/queue"
+)
+
+// Implements queue.Queue using kafka, the consumer is only
+// connected once a topic is subscribed too
+type Queue struct {
+	mutex    sync.Mutex
+	parser   *args.ArgParser
+	producer *ProducerManager
+	consumer *ConsumerManager
+	// Used to fetch the consumer lag, created on first use
+	client sarama.Client
+}
+
+func NewQueue(parser *args.ArgParser) *Queue {
+	return &Queue{
+		parser:   parser,
+		producer: NewProducerManager(parser),
+	}
+}
+
+func (self *Queue) getConsumer(create bool) *ConsumerManager {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.consumer == nil && create {
+		self.consumer = NewConsumerManager(self.parser)
+	}
+	return self.consumer
+}
+
+func (self *Queue) Publish(record *queue.Record) error {
+	return self.producer.Send(record)
+}
+
+func (self *Queue) Subscribe(topic string) (<-chan *queue.Record, error) {
+	return self.getConsumer(true).Subscribe(topic), nil
+}
+
+func (self *Queue) Ack(record *queue.Record) error {
+	return self.getConsumer(true).Ack(record)
+}
+
+// Kafka can't redeliver a single record, so we publish the record
+// to the end of the topic and mark the original as consumed
+func (self *Queue) Nack(record *queue.Record) error {
+	if err := self.Publish(record); err != nil {
+		return err
+	}
+	return self.Ack(record)
+}
+
+// Returns the number of records on the priority lanes the 'kafka-consumer-group' has yet to handle.
+// The client is connected without holding the mutex, so an unreachable cluster does not block
+// the producer and consumer
+func (self *Queue) Lag() (int64, error) {
+	opts := self.parser.GetOpts()
+
+	self.mutex.Lock()
+	client := self.client
+	self.mutex.Unlock()
+
+	if client == nil {
+		config, err := NewConfig(opts)
+		if err != nil {
+			return 0, err
+		}
+		client, err = sarama.NewClient(opts.StringSlice("kafka-endpoints"), config)
+		if err != nil {
+			return 0, errors.Wrap(err, "NewClient()")
+		}
+
+		self.mutex.Lock()
+		if self.client != nil {
+			// Another call connected first
+			client.Close()
+			client = self.client
+		} else {
+			self.client = client
+		}
+		self.mutex.Unlock()
+	}
+
+	lag, err := ConsumerLag(client, opts.String("kafka-topic"), opts.String("kafka-consumer-group"))
+	if err != nil {
+		// Reconnect on the next call
+		self.mutex.Lock()
+		if self.client == client {
+			self.closeClient()
+		}
+		self.mutex.Unlock()
+		return 0, err
+	}
+	return lag, nil
+}
+
+func (self *Queue) closeClient() {
+	if self.client != nil {
+		self.client.Close()
+		self.client = nil
+	}
+}
+
+func (self *Queue) SignalReconnect() {
+	self.mutex.Lock()
+	self.closeClient()
+	self.mutex.Unlock()
+
+	self.producer.Signal()
+	if consumer := self.getConsumer(false); consumer != nil {
+		consumer.Signal()
+	}
+}
+
+// Apply the current options, the producer and consumer reconnect only if their options changed
+func (self *Queue) Reconfigure() {
+	changed := self.producer.Reconfigure()
+	if consumer := self.getConsumer(false); consumer != nil {
+		if consumer.Reconfigure() {
+			changed = true
+		}
+	}
+	if changed {
+		self.mutex.Lock()
+		self.closeClient()
+		self.mutex.Unlock()
+	}
+}
+
+func (self *Queue) Stop() {
+	self.mutex.Lock()
+	self.closeClient()
+	self.mutex.Unlock()
+
+	self.producer.Stop()
+	if consumer := self.getConsumer(false); consumer != nil {
+		consumer.Stop()
+	}
+}
+
+func (self *Queue) IsConnected() bool {
+	if !self.producer.IsConnected() {
+		return false
+	}
+	if consumer := self.getConsumer(false); consumer != nil {
+		return consumer.IsConnected()
+	}
+	return true
+}
+
+// Returns why the producer or consumer is not connected
+func (self *Queue) Diagnose() map[string]string {
+	result := make(map[string]string)
+	if err := self.producer.LastError(); err != nil && !self.producer.IsConnected() {
+		result["kafka-producer"] = fmt.Sprintf("%s - %s", self.producer.State(), err.Error())
+	}
+	if consumer := self.getConsumer(false); consumer != nil {
+		if err := consumer.LastError(); err != nil && !consumer.IsConnected() {
+			result["kafka-consumer"] = fmt.Sprintf("%s - %s", consumer.State(), err.Error())
+		}
+	}
+	return result
+}
@@ -0,0 +1,17 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/thrawn01/detka/models"
+)
+
+// Returns the kafka topic name for the broker agnostic queue topic. The normal
+// lane uses the 'kafka-topic' as is, so producers and workers that predate
+// priority lanes still interoperate. IE: 'high' = 'detka-topic-high'
+func TopicName(base, topic string) string {
+	if topic == models.PriorityNormal {
+		return base
+	}
+	return fmt.Sprintf("%s-%s", base, topic)
+}
@@ -0,0 +1,71 @@
+package detka
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/detka/metrics"
+	"github.com/thrawn01/detka/queue"
+)
+
+// How often the LagWatcher asks the queue for the consumer lag
+var LagInterval = time.Second * 5
+
+// Periodically records the lag of the queue consumers, so the API knows
+// when the workers are not keeping up
+type LagWatcher struct {
+	queue queue.LagReporter
+	lag   int64
+	done  chan struct{}
+}
+
+// Returns a watcher that always reports a lag of 0 if the queue can't report the lag. The first
+// sample is taken in the background, so an unreachable queue does not delay startup
+func NewLagWatcher(msgQueue queue.Queue) *LagWatcher {
+	watcher := &LagWatcher{done: make(chan struct{})}
+	reporter, ok := msgQueue.(queue.LagReporter)
+	if !ok {
+		return watcher
+	}
+	watcher.queue = reporter
+
+	go func() {
+		watcher.update()
+
+		ticker := time.NewTicker(LagInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				watcher.update()
+			case <-watcher.done:
+				return
+			}
+		}
+	}()
+	return watcher
+}
+
+func (self *LagWatcher) update() {
+	lag, err := self.queue.Lag()
+	if err != nil {
+		// Keep the last known lag
+		logrus.WithFields(logrus.Fields{
+			"method": "LagWatcher.update()",
+			"type":   "queue",
+		}).Debug(err.Error())
+		return
+	}
+	atomic.StoreInt64(&self.lag, lag)
+	metrics.QueueLag.Set(float64(lag))
+}
+
+// Returns the number of queued messages the workers have yet to handle
+func (self *LagWatcher) Lag() int64 {
+	return atomic.LoadInt64(&self.lag)
+}
+
+func (self *LagWatcher) Stop() {
+	close(self.done)
+}
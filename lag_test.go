@@ -0,0 +1,33 @@
+package detka_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka"
+	"github.com/thrawn01/detka/queue"
+)
+
+// A queue whose Lag() blocks until released, like a kafka cluster that is unreachable
+type blockingLagQueue struct {
+	*queue.MemoryQueue
+	release chan struct{}
+}
+
+func (self *blockingLagQueue) Lag() (int64, error) {
+	<-self.release
+	return 5, nil
+}
+
+var _ = Describe("LagWatcher", func() {
+	It("should not wait for the first sample before returning", func() {
+		msgQueue := &blockingLagQueue{queue.NewMemoryQueue(10), make(chan struct{})}
+		defer msgQueue.Stop()
+
+		watcher := detka.NewLagWatcher(msgQueue)
+		defer watcher.Stop()
+		Expect(watcher.Lag()).To(Equal(int64(0)))
+
+		close(msgQueue.release)
+		Eventually(watcher.Lag).Should(Equal(int64(5)))
+	})
+})
@@ -0,0 +1,83 @@
+package detka_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+)
+
+var _ = Describe("Lanes", func() {
+	Describe("LaneSchedule()", func() {
+		It("should interleave the lanes by weight, highest priority first", func() {
+			schedule := detka.LaneSchedule(detka.LaneWeights)
+			Expect(schedule).To(Equal([]string{
+				models.PriorityHigh, models.PriorityNormal, models.PriorityBulk,
+				models.PriorityHigh, models.PriorityNormal,
+				models.PriorityHigh, models.PriorityHigh,
+			}))
+		})
+	})
+
+	Describe("DrainLanes()", func() {
+		var channels map[string]chan *queue.Record
+		var lanes map[string]<-chan *queue.Record
+		var handled map[string]int
+
+		// Top up the lane so it never runs empty
+		fill := func(priority string) {
+			for len(channels[priority]) < cap(channels[priority]) {
+				channels[priority] <- &queue.Record{Topic: queue.LaneTopic(priority)}
+			}
+		}
+
+		drain := func() bool {
+			return detka.DrainLanes(detka.LaneSchedule(detka.LaneWeights), lanes, func(record *queue.Record) {
+				handled[record.Topic]++
+			})
+		}
+
+		BeforeEach(func() {
+			channels = make(map[string]chan *queue.Record)
+			lanes = make(map[string]<-chan *queue.Record)
+			handled = make(map[string]int)
+			for _, priority := range models.Priorities {
+				channels[priority] = make(chan *queue.Record, 10)
+				lanes[priority] = channels[priority]
+			}
+		})
+
+		It("should handle the lanes in a 4/2/1 ratio when every lane is waiting", func() {
+			for i := 0; i < 10; i++ {
+				for _, priority := range models.Priorities {
+					fill(priority)
+				}
+				Expect(drain()).To(BeTrue())
+			}
+			Expect(handled).To(Equal(map[string]int{
+				models.PriorityHigh:   40,
+				models.PriorityNormal: 20,
+				models.PriorityBulk:   10,
+			}))
+		})
+
+		It("should keep draining the bulk lane while the high lane stays full", func() {
+			for i := 0; i < 5; i++ {
+				channels[models.PriorityBulk] <- &queue.Record{Topic: queue.LaneTopic(models.PriorityBulk)}
+			}
+			for i := 0; i < 5; i++ {
+				fill(models.PriorityHigh)
+				Expect(drain()).To(BeTrue())
+			}
+			Expect(handled[models.PriorityBulk]).To(Equal(5))
+			Expect(handled[models.PriorityHigh]).To(Equal(20))
+			Expect(lanes[models.PriorityBulk]).To(BeEmpty())
+		})
+
+		It("should report nothing handled when every lane is empty", func() {
+			Expect(drain()).To(BeFalse())
+			Expect(handled).To(BeEmpty())
+		})
+	})
+})
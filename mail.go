@@ -1,7 +1,10 @@
 package detka
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 
 	"net/smtp"
 
@@ -9,9 +12,9 @@ import (
 
 	"strings"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/mailgun/mailgun-go"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/thrawn01/args"
 	"github.com/thrawn01/detka/models"
 )
@@ -20,6 +23,16 @@ type Mailer interface {
 	Send(*models.Message) error
 }
 
+// Opens the body of a message, each call returns a new reader of the whole body
+type BodyFunc func() (io.ReadCloser, error)
+
+// Implemented by mailers that can stream a body too large to keep in Message.Text,
+// see store.OffloadStore
+type BodyMailer interface {
+	// Send the message with the body returned by 'body' in place of Text
+	SendBody(msg *models.Message, body BodyFunc) error
+}
+
 func NewMailer(parser *args.ArgParser) (Mailer, error) {
 	opts := parser.GetOpts()
 	if opts.String("mail-transport") == "mailgun" {
@@ -85,6 +98,12 @@ type Smtp struct {
 }
 
 func (self *Smtp) Send(msg *models.Message) error {
+	return self.SendBody(msg, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(msg.Text)), nil
+	})
+}
+
+func (self *Smtp) SendBody(msg *models.Message, body BodyFunc) error {
 	opts := self.parser.GetOpts()
 	server := opts.String("smtp-server")
 
@@ -93,17 +112,9 @@ func (self *Smtp) Send(msg *models.Message) error {
 	auth := smtp.PlainAuth("", opts.String("smtp-user"),
 		opts.String("smtp-password"), authServer)
 
-	// Construct a body
-	body := []byte(fmt.Sprintf("To: %s\r\n"+
-		"Subject: %s\r\n"+
-		"\r\n"+
-		"%s\r\n", msg.To, msg.Subject, msg.Text))
-
 	var err error
 	for i := 0; i < opts.Int("transport-retry"); i++ {
-
-		err = smtp.SendMail(server, auth,
-			msg.From, []string{msg.To}, body)
+		err = sendSmtp(server, authServer, auth, msg, body)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"method": "Send()",
@@ -112,7 +123,60 @@ func (self *Smtp) Send(msg *models.Message) error {
 			time.Sleep(time.Second)
 			continue
 		}
+		return nil
 	}
 	// TODO: This only returns the final error, should probably return all the errors?
 	return err
 }
+
+// Same as smtp.SendMail() but copies the body from a reader. If the body can't be read the
+// connection is closed before the message is committed
+func sendSmtp(server, host string, auth smtp.Auth, msg *models.Message, body BodyFunc) error {
+	reader, err := body()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	client, err := smtp.Dial(server)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if ok, _ := client.Extension("AUTH"); !ok {
+		return errors.New("smtp: server doesn't support AUTH")
+	}
+	if err := client.Auth(auth); err != nil {
+		return err
+	}
+	if err := client.Mail(msg.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(writer, "To: %s\r\nSubject: %s\r\n\r\n", msg.To, msg.Subject); err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte("\r\n")); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -38,9 +38,176 @@ var Non200Responses = prometheus.NewCounterVec(
 	[]string{"type", "method"},
 )
 
+var LaneProduced = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "api",
+		Name:      "lane_produced_count",
+		Help:      "The number of messages queued on each priority lane.",
+	},
+	[]string{"priority"},
+)
+
+var LaneConsumed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "worker",
+		Name:      "lane_consumed_count",
+		Help:      "The number of messages consumed from each priority lane.",
+	},
+	[]string{"priority"},
+)
+
+var LaneQueueLatency = prometheus.NewSummaryVec(
+	prometheus.SummaryOpts{
+		Namespace: "worker",
+		Name:      "lane_queue_latency",
+		Help:      "Milliseconds a message waited on its priority lane before being handled.",
+	},
+	[]string{"priority"},
+)
+
+var ConsumerLag = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "worker",
+		Name:      "consumer_lag",
+		Help:      "The number of records published to the partition the worker has yet to consume.",
+	},
+	[]string{"topic", "partition"},
+)
+
+var HandleLatency = prometheus.NewSummaryVec(
+	prometheus.SummaryOpts{
+		Namespace: "worker",
+		Name:      "handle_latency",
+		Help:      "Milliseconds the worker spent handling a message.",
+	},
+	[]string{"type"},
+)
+
+var HandleOutcomes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "worker",
+		Name:      "handle_outcome_count",
+		Help:      "The number of handled messages by result; delivered, failed, discarded or deferred.",
+	},
+	[]string{"type", "result"},
+)
+
+var RetentionPurged = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "worker",
+		Name:      "retention_purged_count",
+		Help:      "The number of messages purged by the retention rules; action is body or delete.",
+	},
+	[]string{"status", "action"},
+)
+
+var QueueLag = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "api",
+		Name:      "queue_consumer_lag",
+		Help:      "The number of queued messages the workers have yet to handle.",
+	},
+)
+
+var AdmissionRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "api",
+		Name:      "admission_rejected_count",
+		Help:      "The number of messages rejected with 503 because the delivery pipeline is saturated.",
+	},
+	[]string{"reason"},
+)
+
+var StoreBufferAppended = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "api",
+		Name:      "store_buffer_appended_count",
+		Help:      "The number of messages buffered on disk while the store was disconnected.",
+	},
+)
+
+var StoreBufferReplayed = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "api",
+		Name:      "store_buffer_replayed_count",
+		Help:      "The number of buffered messages inserted into the store and queued.",
+	},
+)
+
+var StoreBufferRejected = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "api",
+		Name:      "store_buffer_rejected_count",
+		Help:      "The number of messages rejected because the store buffer was full.",
+	},
+)
+
+var StoreBufferSize = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "api",
+		Name:      "store_buffer_size_bytes",
+		Help:      "The size of the store buffer on disk.",
+	},
+)
+
+var KafkaProduceLatency = prometheus.NewSummaryVec(
+	prometheus.SummaryOpts{
+		Namespace: "api",
+		Name:      "kafka_produce_latency",
+		Help:      "Milliseconds between queuing a message and kafka acknowledging it.",
+	},
+	[]string{"mode"},
+)
+
+var ConnectionState = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "connection",
+		Name:      "state",
+		Help:      "1 for the current state of the connection to each backend; connecting, connected, disconnected or failed.",
+	},
+	[]string{"backend", "state"},
+)
+
+var ConnectionReconnects = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "connection",
+		Name:      "reconnect_count",
+		Help:      "The number of attempts to reconnect to each backend.",
+	},
+	[]string{"backend"},
+)
+
 // Must call before using the RecordMetrics() middleware
 func Init() {
 	prometheus.MustRegister(HTTPRequestCount)
 	prometheus.MustRegister(HTTPRequestLatency)
 	prometheus.MustRegister(InternalErrors)
 }
+
+// Must call before serving requests with detka.NewHandler()
+func InitProducer() {
+	prometheus.MustRegister(LaneProduced)
+	prometheus.MustRegister(KafkaProduceLatency)
+	prometheus.MustRegister(QueueLag)
+	prometheus.MustRegister(AdmissionRejected)
+	prometheus.MustRegister(StoreBufferAppended)
+	prometheus.MustRegister(StoreBufferReplayed)
+	prometheus.MustRegister(StoreBufferRejected)
+	prometheus.MustRegister(StoreBufferSize)
+}
+
+// Must call before starting a detka.Worker
+func InitWorker() {
+	prometheus.MustRegister(LaneConsumed)
+	prometheus.MustRegister(LaneQueueLatency)
+	prometheus.MustRegister(ConsumerLag)
+	prometheus.MustRegister(HandleLatency)
+	prometheus.MustRegister(HandleOutcomes)
+	prometheus.MustRegister(RetentionPurged)
+}
+
+// Must call before connecting to any backend
+func InitConnection() {
+	prometheus.MustRegister(ConnectionState)
+	prometheus.MustRegister(ConnectionReconnects)
+}
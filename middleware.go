@@ -30,3 +30,33 @@ func RecordMetrics(next chi.Handler) chi.Handler {
 			Observe(float64(elapsed) / float64(time.Millisecond))
 	})
 }
+
+// Injects the Admission into the context.Context for each request
+func AdmissionMiddleware(admission *Admission) func(chi.Handler) chi.Handler {
+	return func(next chi.Handler) chi.Handler {
+		return chi.HandlerFunc(func(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+			ctx = SetAdmission(ctx, admission)
+			next.ServeHTTPC(ctx, resp, req)
+		})
+	}
+}
+
+// Injects the StoreBuffer into the context.Context for each request
+func StoreBufferMiddleware(buffer *StoreBuffer) func(chi.Handler) chi.Handler {
+	return func(next chi.Handler) chi.Handler {
+		return chi.HandlerFunc(func(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+			ctx = SetStoreBuffer(ctx, buffer)
+			next.ServeHTTPC(ctx, resp, req)
+		})
+	}
+}
+
+// Injects the Erasure into the context.Context for each request
+func ErasureMiddleware(erasure *Erasure) func(chi.Handler) chi.Handler {
+	return func(next chi.Handler) chi.Handler {
+		return chi.HandlerFunc(func(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+			ctx = SetErasure(ctx, erasure)
+			next.ServeHTTPC(ctx, resp, req)
+		})
+	}
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"bytes"
 	"encoding/base32"
+	"time"
 
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
@@ -13,18 +14,63 @@ type NewMessageResponse struct {
 	Message string `json:"message"`
 }
 
+// Priority lanes a message can be queued on
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityBulk   = "bulk"
+)
+
+// All the priority lanes from highest to lowest
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityBulk}
+
 type Message struct {
-	Id      string `json:"id"`
-	Subject string `json:"subject"`
-	Text    string `json:"text"`
-	From    string `json:"from"`
-	To      string `json:"recipients"`
-	Status  string `json:"status"`
+	Id       string `json:"id"`
+	Subject  string `json:"subject"`
+	Text     string `json:"text"`
+	From     string `json:"from"`
+	To       string `json:"recipients"`
+	Status   string `json:"status"`
+	Priority string `json:"priority"`
+	// The account that created the message
+	Account string `json:"account"`
+	// Incremented by the store on every update, see Store.UpdateMessageIf()
+	Version int `json:"version"`
+	// The blob store key of a body too large to keep in Text, see store.OffloadStore
+	BodyRef string `json:"body_ref,omitempty"`
+	// Hex SHA-256 of the blob
+	BodyChecksum string `json:"body_checksum,omitempty"`
+	// Unix time a worker claimed the message for sending, see detka.ClaimTimeout
+	ClaimedAt int64 `json:"claimed_at,omitempty"`
+	// Keys the store indexes the recipients by, computed from To if nil, see RecipientKeys().
+	// Written but never returned by the store
+	RecipientKeys []string `json:"-"`
 }
 
+// The current version of the QueueMessage envelope, workers discard
+// messages with a version newer than they understand
+const QueueMessageVersion = 1
+
 type QueueMessage struct {
-	Id   string `json:"id"`
-	Type string `json:"type"`
+	Version    int               `json:"version"`
+	Id         string            `json:"id"`
+	Type       string            `json:"type"`
+	Attempt    int               `json:"attempt"`
+	Priority   string            `json:"priority,omitempty"`
+	Trace      map[string]string `json:"trace,omitempty"`
+	EnqueuedAt time.Time         `json:"enqueued_at"`
+}
+
+// Create a new queue message envelope of the current version
+func NewQueueMessage(kind, id string) QueueMessage {
+	return QueueMessage{
+		Version:    QueueMessageVersion,
+		Id:         id,
+		Type:       kind,
+		Attempt:    1,
+		Priority:   PriorityNormal,
+		EnqueuedAt: time.Now().UTC(),
+	}
 }
 
 // After marshaling from JSON, call this method to validate the object is intact
@@ -38,6 +84,10 @@ func (self *Message) Validate() error {
 		return errors.Wrap(err, "To")
 	}
 
+	if err := ValidPriority(self.Priority); err != nil {
+		return errors.Wrap(err, "Priority")
+	}
+
 	return nil
 }
 
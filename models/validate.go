@@ -3,6 +3,7 @@ package models
 import (
 	"fmt"
 	"net/mail"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -15,9 +16,55 @@ func ValidEmail(address string) error {
 	return nil
 }
 
+// Returns the lower case address of each recipient in the 'to' address list, such
+// that the same recipient has the same key however the address was written
+func RecipientKeys(to string) []string {
+	var keys []string
+	addresses, err := mail.ParseAddressList(to)
+	if err != nil {
+		// Messages are validated before they are stored, this is a best effort for those that were not
+		for _, address := range strings.Split(to, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				keys = appendUnique(keys, strings.ToLower(address))
+			}
+		}
+		return keys
+	}
+	for _, address := range addresses {
+		keys = appendUnique(keys, strings.ToLower(address.Address))
+	}
+	return keys
+}
+
+// Returns the key of a single recipient address, IE: 'Devs <DEVS@mailgun.net>' = 'devs@mailgun.net'
+func RecipientKey(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return strings.ToLower(parsed.Address)
+	}
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+func appendUnique(items []string, item string) []string {
+	for _, existing := range items {
+		if existing == item {
+			return items
+		}
+	}
+	return append(items, item)
+}
+
 func ValidMessageId(id string) error {
 	if len(id) == 26 {
 		return nil
 	}
 	return errors.New("Invalid Message ID - must be 26 characters")
 }
+
+func ValidPriority(priority string) error {
+	for _, lane := range Priorities {
+		if priority == lane {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Invalid priority '%s' - must be one of %v", priority, Priorities))
+}
@@ -41,4 +41,20 @@ var _ = Describe("Validate", func() {
 			})
 		})
 	})
+	Describe("ValidPriority", func() {
+		Context("When priority is a known lane", func() {
+			It("should return nil", func() {
+				Expect(models.ValidPriority("high")).To(BeNil())
+				Expect(models.ValidPriority("normal")).To(BeNil())
+				Expect(models.ValidPriority("bulk")).To(BeNil())
+			})
+		})
+		Context("When priority is unknown", func() {
+			It("should return an error", func() {
+				err := models.ValidPriority("urgent")
+				Expect(err).To(Not(BeNil()))
+				Expect(err.Error()).To(Equal("Invalid priority 'urgent' - must be one of [high normal bulk]"))
+			})
+		})
+	})
 })
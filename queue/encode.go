@@ -0,0 +1,135 @@
+package queue
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/schema"
+)
+
+// Headers every record carries so consumers know how to decode the payload
+const (
+	ContentTypeHeader   = "content-type"
+	SchemaVersionHeader = "schema-version"
+)
+
+const (
+	// The schema.QueueMessage protobuf envelope
+	ContentTypeProtobuf = "application/x-protobuf"
+	// The JSON envelope, records without a content type (older producers) are always JSON
+	ContentTypeJSON = "application/json"
+)
+
+// The content type of new records created by NewRecord(), JSON is understood by every worker
+var ContentType = ContentTypeJSON
+
+// Choose the encoding of new records by name, 'protobuf' or 'json'
+func SetEncoding(name string) error {
+	switch name {
+	case "protobuf":
+		ContentType = ContentTypeProtobuf
+	case "json":
+		ContentType = ContentTypeJSON
+	default:
+		return errors.Errorf("invalid encoding '%s' - must be one of [protobuf json]", name)
+	}
+	return nil
+}
+
+// Create a new record for the queue message on the priority lane of the message
+func NewRecord(msg models.QueueMessage) (*Record, error) {
+	return Encode(msg, ContentType)
+}
+
+// Create a new record for the queue message encoded as 'contentType'
+func Encode(msg models.QueueMessage, contentType string) (*Record, error) {
+	var payload []byte
+	var err error
+
+	switch contentType {
+	case ContentTypeProtobuf:
+		payload, err = proto.Marshal(toSchema(msg))
+		if err != nil {
+			return nil, errors.Wrap(err, "proto.Marshal()")
+		}
+	case "", ContentTypeJSON:
+		contentType = ContentTypeJSON
+		payload, err = json.Marshal(msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "json.Marshal()")
+		}
+	default:
+		return nil, errors.Errorf("unsupported content type '%s'", contentType)
+	}
+
+	return &Record{
+		Topic: LaneTopic(msg.Priority),
+		Value: payload,
+		Headers: map[string]string{
+			ContentTypeHeader:   contentType,
+			SchemaVersionHeader: strconv.Itoa(msg.Version),
+		},
+	}, nil
+}
+
+// Returns the content type of the record payload
+func ContentTypeOf(record *Record) string {
+	if contentType, ok := record.Headers[ContentTypeHeader]; ok {
+		return contentType
+	}
+	return ContentTypeJSON
+}
+
+// Decode the queue message contained in the record
+func Decode(record *Record) (models.QueueMessage, error) {
+	var msg models.QueueMessage
+
+	switch ContentTypeOf(record) {
+	case ContentTypeProtobuf:
+		var envelope schema.QueueMessage
+		if err := proto.Unmarshal(record.Value, &envelope); err != nil {
+			return msg, errors.Wrap(err, "Unmarshal failed on protobuf payload")
+		}
+		return fromSchema(&envelope), nil
+	case ContentTypeJSON:
+		if err := json.Unmarshal(record.Value, &msg); err != nil {
+			return msg, errors.Wrap(err, "Unmarshal failed on payload")
+		}
+		return msg, nil
+	}
+	return msg, errors.Errorf("unsupported content type '%s'", ContentTypeOf(record))
+}
+
+func toSchema(msg models.QueueMessage) *schema.QueueMessage {
+	envelope := &schema.QueueMessage{
+		Version:  int32(msg.Version),
+		Id:       msg.Id,
+		Type:     msg.Type,
+		Attempt:  int32(msg.Attempt),
+		Priority: msg.Priority,
+		Trace:    msg.Trace,
+	}
+	if !msg.EnqueuedAt.IsZero() {
+		envelope.EnqueuedAt = msg.EnqueuedAt.UnixNano()
+	}
+	return envelope
+}
+
+func fromSchema(envelope *schema.QueueMessage) models.QueueMessage {
+	msg := models.QueueMessage{
+		Version:  int(envelope.Version),
+		Id:       envelope.Id,
+		Type:     envelope.Type,
+		Attempt:  int(envelope.Attempt),
+		Priority: envelope.Priority,
+		Trace:    envelope.Trace,
+	}
+	if envelope.EnqueuedAt != 0 {
+		msg.EnqueuedAt = time.Unix(0, envelope.EnqueuedAt).UTC()
+	}
+	return msg
+}
@@ -0,0 +1,97 @@
+package queue_test
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+)
+
+// The envelope as understood by workers that predate the schema
+type legacyQueueMessage struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+}
+
+var _ = Describe("Encode", func() {
+	msg := models.QueueMessage{
+		Version:    models.QueueMessageVersion,
+		Id:         "AL3UDCVPMJDAFFNIO2OP4IYQKE",
+		Type:       "email",
+		Attempt:    2,
+		Priority:   models.PriorityHigh,
+		Trace:      map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		EnqueuedAt: time.Date(2017, 3, 1, 12, 30, 0, 123456789, time.UTC),
+	}
+
+	Context("When encoded as protobuf", func() {
+		It("should decode every field", func() {
+			record, err := queue.Encode(msg, queue.ContentTypeProtobuf)
+			Expect(err).To(BeNil())
+			Expect(record.Topic).To(Equal("high"))
+			Expect(record.Headers[queue.ContentTypeHeader]).To(Equal(queue.ContentTypeProtobuf))
+			Expect(record.Headers[queue.SchemaVersionHeader]).To(Equal("1"))
+
+			decoded, err := queue.Decode(record)
+			Expect(err).To(BeNil())
+			Expect(decoded).To(Equal(msg))
+		})
+		It("should ignore fields added by newer producers", func() {
+			record, err := queue.Encode(msg, queue.ContentTypeProtobuf)
+			Expect(err).To(BeNil())
+
+			// Field 15 (string) is unknown to this version of the schema
+			buf := proto.NewBuffer(record.Value)
+			buf.EncodeVarint(15<<3 | 2)
+			buf.EncodeStringBytes("from the future")
+			record.Value = buf.Bytes()
+
+			decoded, err := queue.Decode(record)
+			Expect(err).To(BeNil())
+			Expect(decoded.Id).To(Equal(msg.Id))
+		})
+	})
+
+	Context("When a record from an older producer has no headers", func() {
+		It("should decode the JSON payload", func() {
+			record := &queue.Record{
+				Topic: "normal",
+				Value: []byte(`{"id":"AL3UDCVPMJDAFFNIO2OP4IYQKE","type":"email"}`),
+			}
+			decoded, err := queue.Decode(record)
+			Expect(err).To(BeNil())
+			Expect(decoded.Id).To(Equal("AL3UDCVPMJDAFFNIO2OP4IYQKE"))
+			Expect(decoded.Type).To(Equal("email"))
+		})
+	})
+
+	Context("When encoded as JSON during a rollout", func() {
+		It("should be understood by older workers", func() {
+			record, err := queue.Encode(msg, queue.ContentTypeJSON)
+			Expect(err).To(BeNil())
+			Expect(record.Headers[queue.ContentTypeHeader]).To(Equal(queue.ContentTypeJSON))
+
+			var legacy legacyQueueMessage
+			Expect(json.Unmarshal(record.Value, &legacy)).To(BeNil())
+			Expect(legacy.Id).To(Equal(msg.Id))
+			Expect(legacy.Type).To(Equal(msg.Type))
+
+			decoded, err := queue.Decode(record)
+			Expect(err).To(BeNil())
+			Expect(decoded).To(Equal(msg))
+		})
+	})
+
+	Context("When the content type is unknown", func() {
+		It("should return an error", func() {
+			_, err := queue.Decode(&queue.Record{
+				Headers: map[string]string{queue.ContentTypeHeader: "application/avro"},
+			})
+			Expect(err).To(Not(BeNil()))
+		})
+	})
+})
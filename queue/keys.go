@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+	"github.com/thrawn01/detka/models"
+	"golang.org/x/net/context"
+)
+
+// Strategies used to choose the partition key of a message. Messages with the same
+// key are delivered to the same partition, and so are handled in the order they were published
+const (
+	// No key, messages are spread evenly across the partitions
+	KeyNone = "none"
+	// The domain of the recipient, IE: 'example.com'
+	KeyDomain = "domain"
+	// The account that created the message
+	KeyAccount = "account"
+	// The id of the message
+	KeyMessageId = "message-id"
+)
+
+// Returns the partition key for the message, nil if the message should not be keyed
+type KeyFunc func(*models.Message) []byte
+
+// Returns the KeyFunc for the named strategy
+func NewKeyFunc(strategy string) (KeyFunc, error) {
+	switch strategy {
+	case "", KeyNone:
+		return func(*models.Message) []byte { return nil }, nil
+	case KeyDomain:
+		return DomainKey, nil
+	case KeyAccount:
+		return AccountKey, nil
+	case KeyMessageId:
+		return MessageIdKey, nil
+	}
+	return nil, errors.Errorf("invalid key strategy '%s' - must be one of [%s %s %s %s]",
+		strategy, KeyNone, KeyDomain, KeyAccount, KeyMessageId)
+}
+
+// Keys the message by the lower case domain of the recipient
+func DomainKey(msg *models.Message) []byte {
+	address := msg.To
+	if parsed, err := mail.ParseAddress(msg.To); err == nil {
+		address = parsed.Address
+	}
+
+	idx := strings.LastIndex(address, "@")
+	if idx == -1 || idx == len(address)-1 {
+		return nil
+	}
+	return []byte(strings.ToLower(address[idx+1:]))
+}
+
+// Keys the message by account, messages without an account are not keyed
+func AccountKey(msg *models.Message) []byte {
+	if len(msg.Account) == 0 {
+		return nil
+	}
+	return []byte(msg.Account)
+}
+
+func MessageIdKey(msg *models.Message) []byte {
+	if len(msg.Id) == 0 {
+		return nil
+	}
+	return []byte(msg.Id)
+}
+
+func SetKeyFunc(ctx context.Context, keyFunc KeyFunc) context.Context {
+	return context.WithValue(ctx, keyFuncContextKey, keyFunc)
+}
+
+// Returns the KeyFunc in the context, if none was injected messages are not keyed
+func GetKeyFunc(ctx context.Context) KeyFunc {
+	obj, ok := ctx.Value(keyFuncContextKey).(KeyFunc)
+	if !ok || obj == nil {
+		return func(*models.Message) []byte { return nil }
+	}
+	return obj
+}
+
+// Injects the KeyFunc into the context.Context for each request
+func KeyMiddleware(keyFunc KeyFunc) func(chi.Handler) chi.Handler {
+	return func(next chi.Handler) chi.Handler {
+		return chi.HandlerFunc(func(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+			ctx = SetKeyFunc(ctx, keyFunc)
+			next.ServeHTTPC(ctx, resp, req)
+		})
+	}
+}
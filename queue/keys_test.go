@@ -0,0 +1,53 @@
+package queue_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+)
+
+var _ = Describe("Keys", func() {
+	msg := &models.Message{
+		Id:      "AL3UDCVPMJDAFFNIO2OP4IYQKE",
+		To:      "Dev Team <devs@Mailgun.NET>",
+		Account: "account-1",
+	}
+
+	Describe("NewKeyFunc", func() {
+		It("should key the message using the strategy", func() {
+			keyFunc, err := queue.NewKeyFunc(queue.KeyDomain)
+			Expect(err).To(BeNil())
+			Expect(string(keyFunc(msg))).To(Equal("mailgun.net"))
+
+			keyFunc, err = queue.NewKeyFunc(queue.KeyAccount)
+			Expect(err).To(BeNil())
+			Expect(string(keyFunc(msg))).To(Equal("account-1"))
+
+			keyFunc, err = queue.NewKeyFunc(queue.KeyMessageId)
+			Expect(err).To(BeNil())
+			Expect(string(keyFunc(msg))).To(Equal("AL3UDCVPMJDAFFNIO2OP4IYQKE"))
+
+			keyFunc, err = queue.NewKeyFunc(queue.KeyNone)
+			Expect(err).To(BeNil())
+			Expect(keyFunc(msg)).To(BeNil())
+		})
+		It("should return an error for an unknown strategy", func() {
+			_, err := queue.NewKeyFunc("recipient")
+			Expect(err).To(Not(BeNil()))
+			Expect(err.Error()).To(ContainSubstring("invalid key strategy 'recipient'"))
+		})
+	})
+
+	Describe("DomainKey", func() {
+		It("should not key a recipient without a domain", func() {
+			Expect(queue.DomainKey(&models.Message{To: "devs"})).To(BeNil())
+		})
+	})
+
+	Describe("AccountKey", func() {
+		It("should not key a message without an account", func() {
+			Expect(queue.AccountKey(&models.Message{To: "devs@mailgun.net"})).To(BeNil())
+		})
+	})
+})
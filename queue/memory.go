@@ -0,0 +1,124 @@
+package queue
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thrawn01/detka/models"
+)
+
+// An in-process queue built on buffered channels, useful for running the API and
+// worker in the same process for tests and development without kafka or zookeeper
+type MemoryQueue struct {
+	mutex   sync.Mutex
+	size    int
+	topics  map[string]chan *Record
+	offsets map[string]int64
+	done    chan struct{}
+}
+
+// Create a new in-memory queue, each topic buffers at most 'size' records
+// before Publish() returns an error. Nothing consumes the dead letter topic in
+// dev and test setups, so once it is full the oldest dead letter is dropped instead
+func NewMemoryQueue(size int) *MemoryQueue {
+	return &MemoryQueue{
+		size:    size,
+		topics:  make(map[string]chan *Record),
+		offsets: make(map[string]int64),
+		done:    make(chan struct{}),
+	}
+}
+
+func (self *MemoryQueue) getTopic(name string) chan *Record {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	topic, ok := self.topics[name]
+	if !ok {
+		topic = make(chan *Record, self.size)
+		self.topics[name] = topic
+	}
+	return topic
+}
+
+func (self *MemoryQueue) nextOffset(name string) (result int64) {
+	self.mutex.Lock()
+	result = self.offsets[name]
+	self.offsets[name]++
+	self.mutex.Unlock()
+	return
+}
+
+func (self *MemoryQueue) Publish(record *Record) error {
+	if !self.IsConnected() {
+		return errors.New("Not Connected")
+	}
+
+	// Copy the record so the publisher can't modify what we deliver
+	delivery := *record
+	delivery.Offset = self.nextOffset(record.Topic)
+
+	topic := self.getTopic(record.Topic)
+	for {
+		select {
+		case topic <- &delivery:
+			return nil
+		default:
+		}
+		if record.Topic != DeadLetterTopic {
+			return errors.Errorf("topic '%s' is full", record.Topic)
+		}
+		// Make room by dropping the oldest dead letter
+		select {
+		case <-topic:
+		default:
+		}
+	}
+}
+
+func (self *MemoryQueue) Subscribe(topic string) (<-chan *Record, error) {
+	if !self.IsConnected() {
+		return nil, errors.New("Not Connected")
+	}
+	return self.getTopic(topic), nil
+}
+
+// Records are removed from the channel on delivery, so there is nothing to do
+func (self *MemoryQueue) Ack(record *Record) error {
+	return nil
+}
+
+func (self *MemoryQueue) Nack(record *Record) error {
+	return self.Publish(record)
+}
+
+// Returns the number of records waiting to be delivered on the priority lanes
+func (self *MemoryQueue) Lag() (int64, error) {
+	var result int64
+	for _, priority := range models.Priorities {
+		result += int64(len(self.getTopic(LaneTopic(priority))))
+	}
+	return result, nil
+}
+
+func (self *MemoryQueue) SignalReconnect() {}
+
+func (self *MemoryQueue) Stop() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	select {
+	case <-self.done:
+	default:
+		close(self.done)
+	}
+}
+
+func (self *MemoryQueue) IsConnected() bool {
+	select {
+	case <-self.done:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,93 @@
+package queue_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+)
+
+var _ = Describe("MemoryQueue", func() {
+	var msgQueue *queue.MemoryQueue
+
+	BeforeEach(func() {
+		msgQueue = queue.NewMemoryQueue(2)
+	})
+
+	AfterEach(func() {
+		msgQueue.Stop()
+	})
+
+	Context("When a record is published", func() {
+		It("should be delivered to the subscriber of the topic", func() {
+			records, err := msgQueue.Subscribe("high")
+			Expect(err).To(BeNil())
+
+			record, err := queue.NewRecord(models.QueueMessage{Id: "id-1", Type: "email", Priority: "high"})
+			Expect(err).To(BeNil())
+			Expect(record.Topic).To(Equal("high"))
+			Expect(msgQueue.Publish(record)).To(BeNil())
+
+			delivered := <-records
+			msg, err := queue.Decode(delivered)
+			Expect(err).To(BeNil())
+			Expect(msg.Id).To(Equal("id-1"))
+			Expect(msg.Type).To(Equal("email"))
+			Expect(delivered.Offset).To(Equal(int64(0)))
+		})
+	})
+	Context("When a delivered record is nacked", func() {
+		It("should be delivered again", func() {
+			records, _ := msgQueue.Subscribe("normal")
+			Expect(msgQueue.Publish(&queue.Record{Topic: "normal", Value: []byte("first")})).To(BeNil())
+
+			delivered := <-records
+			delivered.Value = []byte("second")
+			Expect(msgQueue.Nack(delivered)).To(BeNil())
+
+			delivered = <-records
+			Expect(string(delivered.Value)).To(Equal("second"))
+			Expect(delivered.Offset).To(Equal(int64(1)))
+		})
+	})
+	Context("When the topic is full", func() {
+		It("should return an error", func() {
+			Expect(msgQueue.Publish(&queue.Record{Topic: "bulk"})).To(BeNil())
+			Expect(msgQueue.Publish(&queue.Record{Topic: "bulk"})).To(BeNil())
+			err := msgQueue.Publish(&queue.Record{Topic: "bulk"})
+			Expect(err).To(Not(BeNil()))
+			Expect(err.Error()).To(Equal("topic 'bulk' is full"))
+		})
+	})
+	Context("When the dead letter topic is full", func() {
+		It("should drop the oldest dead letter", func() {
+			for _, value := range []string{"first", "second", "third"} {
+				Expect(msgQueue.Publish(&queue.Record{Topic: queue.DeadLetterTopic,
+					Value: []byte(value)})).To(BeNil())
+			}
+
+			records, err := msgQueue.Subscribe(queue.DeadLetterTopic)
+			Expect(err).To(BeNil())
+			Expect(string((<-records).Value)).To(Equal("second"))
+			Expect(string((<-records).Value)).To(Equal("third"))
+		})
+	})
+	Context("When records are waiting on the priority lanes", func() {
+		It("should report them as lag", func() {
+			Expect(msgQueue.Publish(&queue.Record{Topic: "high"})).To(BeNil())
+			Expect(msgQueue.Publish(&queue.Record{Topic: "bulk"})).To(BeNil())
+			Expect(msgQueue.Publish(&queue.Record{Topic: "dead-letter"})).To(BeNil())
+
+			lag, err := msgQueue.Lag()
+			Expect(err).To(BeNil())
+			Expect(lag).To(Equal(int64(2)))
+		})
+	})
+	Context("When the queue is stopped", func() {
+		It("should not be connected", func() {
+			msgQueue.Stop()
+			Expect(msgQueue.IsConnected()).To(BeFalse())
+			Expect(msgQueue.Publish(&queue.Record{Topic: "bulk"})).To(Not(BeNil()))
+		})
+	})
+})
@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"net/http"
+
+	"github.com/pressly/chi"
+	"github.com/thrawn01/detka/models"
+	"golang.org/x/net/context"
+)
+
+type contextKey int
+
+const (
+	queueContextKey   contextKey = 1
+	keyFuncContextKey contextKey = 2
+)
+
+// Name of the topic messages that could not be handled are published to
+const DeadLetterTopic = "dead-letter"
+
+func SetQueue(ctx context.Context, queue Queue) context.Context {
+	return context.WithValue(ctx, queueContextKey, queue)
+}
+
+func GetQueue(ctx context.Context) Queue {
+	obj, ok := ctx.Value(queueContextKey).(Queue)
+	if !ok {
+		panic("No queue.Queue found in context")
+	}
+	return obj
+}
+
+// A single message published to or delivered from a queue
+type Record struct {
+	// The broker agnostic name of the topic, IE: 'high', 'normal', 'bulk' or 'dead-letter'
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+
+	// Where the record was delivered from, set by the queue on delivery
+	Partition int32
+	Offset    int64
+}
+
+type Queue interface {
+	// Publish the record to Record.Topic
+	Publish(*Record) error
+	// Returns a channel of records published to the topic, subscribing to the same
+	// topic more than once returns the same channel
+	Subscribe(string) (<-chan *Record, error)
+	// The delivered record was handled and should not be delivered again
+	Ack(*Record) error
+	// The delivered record was not handled, the queue will deliver the record
+	// (including any changes made to Record.Value) again
+	Nack(*Record) error
+	SignalReconnect()
+	Stop()
+	IsConnected() bool
+}
+
+// Implemented by queues that reconnect only when the options of their connections change
+type Reconfigurer interface {
+	Reconfigure()
+}
+
+// Apply changed options to the queue, queues that are not a Reconfigurer reconnect
+func Reconfigure(queue Queue) {
+	if reconfigurer, ok := queue.(Reconfigurer); ok {
+		reconfigurer.Reconfigure()
+		return
+	}
+	queue.SignalReconnect()
+}
+
+// Implemented by queues that can explain why they are not connected
+type Diagnoser interface {
+	// Returns the last connection error of each component of the queue that is not connected
+	Diagnose() map[string]string
+}
+
+// Returns the connection errors reported by the queue, or nil if the queue is not a Diagnoser
+func Diagnose(queue Queue) map[string]string {
+	if diagnoser, ok := queue.(Diagnoser); ok {
+		return diagnoser.Diagnose()
+	}
+	return nil
+}
+
+// Implemented by queues that can report how far behind the consumers are
+type LagReporter interface {
+	// Returns the number of records published to the priority lanes the consumers have yet to handle
+	Lag() (int64, error)
+}
+
+// Returns the topic for the priority lane, messages with no
+// priority (older producers) are queued on the normal lane
+func LaneTopic(priority string) string {
+	if len(priority) == 0 {
+		return models.PriorityNormal
+	}
+	return priority
+}
+
+// Injects queue.Queue into the context.Context for each request
+func Middleware(queue Queue) func(chi.Handler) chi.Handler {
+	return func(next chi.Handler) chi.Handler {
+		return chi.HandlerFunc(func(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+			ctx = SetQueue(ctx, queue)
+			next.ServeHTTPC(ctx, resp, req)
+		})
+	}
+}
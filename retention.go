@@ -0,0 +1,328 @@
+package detka
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/envelope"
+	"github.com/thrawn01/detka/metrics"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+// How long a message of 'Status' is kept, a zero duration keeps it forever
+type RetentionRule struct {
+	Status string
+	// Remove the body of messages older than this
+	PurgeBody time.Duration
+	// Delete messages older than this
+	Delete time.Duration
+}
+
+type RetentionConfig struct {
+	// No messages are purged if empty
+	Rules []RetentionRule
+	// How often the purge runs
+	Interval time.Duration
+	// The number of messages read and purged at a time
+	BatchSize int
+	// Write messages to gzip compressed NDJSON files in this directory before they
+	// are purged, disabled if empty
+	ArchiveDir string
+	// Encrypts each archived message, nil archives them in plaintext. See ReadArchive()
+	Master envelope.MasterKey
+}
+
+// A line of an encrypted archive, the message is bound to its id
+type archivedMessage struct {
+	Id        string `json:"id"`
+	Encrypted string `json:"encrypted"`
+}
+
+func RetentionConfigFromOpts(opts *args.Options) (RetentionConfig, error) {
+	rules, err := ParseRetentionRules(opts.String("retention"))
+	if err != nil {
+		return RetentionConfig{}, err
+	}
+	return RetentionConfig{
+		Rules:      rules,
+		Interval:   time.Duration(opts.Int("retention-interval")) * time.Minute,
+		BatchSize:  opts.Int("retention-batch-size"),
+		ArchiveDir: opts.String("retention-archive-dir"),
+	}, nil
+}
+
+// Parse a comma separated list of '<status>:<purge-body-days>:<delete-days>' rules,
+// IE: 'DELIVERED:7:90' purges the body of delivered messages after 7 days and deletes
+// them after 90. A value of 0 days disables either
+func ParseRetentionRules(value string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, errors.Errorf("invalid retention rule '%s' - expected "+
+				"'<status>:<purge-body-days>:<delete-days>'", item)
+		}
+
+		rule := RetentionRule{Status: parts[0]}
+		for i, target := range []*time.Duration{&rule.PurgeBody, &rule.Delete} {
+			days, err := strconv.Atoi(parts[i+1])
+			if err != nil || days < 0 {
+				return nil, errors.Errorf("invalid retention rule '%s' - '%s' is not a number of days",
+					item, parts[i+1])
+			}
+			*target = time.Duration(days) * 24 * time.Hour
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Periodically purges the bodies of old messages and deletes expired messages according to
+// the retention rules. Each batch is archived before it is purged, so a crash may archive a
+// message more than once but never purges a message that was not archived
+type Retention struct {
+	conf    RetentionConfig
+	expirer store.Expirer
+	store   store.Store
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Returns an error if there are rules and the store can't expire messages. Call Start()
+// to begin purging
+func NewRetention(conf RetentionConfig, dbStore store.Store) (*Retention, error) {
+	expirer, ok := dbStore.(store.Expirer)
+	if !ok && len(conf.Rules) != 0 {
+		return nil, errors.New("the store backend does not support retention")
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 500
+	}
+	if conf.ArchiveDir != "" {
+		if err := os.MkdirAll(conf.ArchiveDir, 0700); err != nil {
+			return nil, errors.Wrap(err, "while creating the retention archive dir")
+		}
+	}
+	return &Retention{
+		conf:    conf,
+		expirer: expirer,
+		store:   dbStore,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (self *Retention) Start() {
+	if len(self.conf.Rules) == 0 || self.conf.Interval <= 0 {
+		return
+	}
+
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		ticker := time.NewTicker(self.conf.Interval)
+		defer ticker.Stop()
+		for {
+			if err := self.Purge(); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"method": "Retention.Purge()",
+					"type":   "retention",
+				}).Error(err.Error())
+			}
+			select {
+			case <-ticker.C:
+			case <-self.done:
+				return
+			}
+		}
+	}()
+}
+
+// Waits for a purge in progress to finish the current batch
+func (self *Retention) Stop() {
+	close(self.done)
+	self.wg.Wait()
+}
+
+// Apply every rule until no expired messages remain or Stop() is called
+func (self *Retention) Purge() error {
+	now := time.Now()
+	for _, rule := range self.conf.Rules {
+		if rule.PurgeBody > 0 {
+			if err := self.purge(rule.Status, "body", now.Add(-rule.PurgeBody)); err != nil {
+				return err
+			}
+		}
+		if rule.Delete > 0 {
+			if err := self.purge(rule.Status, "delete", now.Add(-rule.Delete)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *Retention) purge(status, action string, before time.Time) error {
+	for {
+		select {
+		case <-self.done:
+			return nil
+		default:
+		}
+
+		count, err := self.purgeBatch(status, action, before)
+		metrics.RetentionPurged.WithLabelValues(status, action).Add(float64(count))
+		if err != nil {
+			return errors.Wrapf(err, "while purging '%s' of '%s' messages", action, status)
+		}
+		if count < self.conf.BatchSize {
+			return nil
+		}
+	}
+}
+
+// Returns the number of messages purged
+func (self *Retention) purgeBatch(status, action string, before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	messages, err := self.expirer.ExpiredMessages(ctx, status, before, action == "body", self.conf.BatchSize)
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+	if err := self.archive(status, action, messages); err != nil {
+		return 0, err
+	}
+
+	if action == "delete" {
+		ids := make([]string, len(messages))
+		for i, message := range messages {
+			ids[i] = message.Id
+		}
+		if err := self.expirer.DeleteMessages(ctx, ids); err != nil {
+			return 0, err
+		}
+		return len(messages), nil
+	}
+
+	for i, message := range messages {
+		if err := self.store.UpdateMessage(ctx, message.Id, map[string]interface{}{"Text": ""}); err != nil {
+			if store.IsNotFound(err) {
+				continue
+			}
+			return i, err
+		}
+	}
+	return len(messages), nil
+}
+
+// Write the messages to a new archive file, the file only appears once it is complete
+func (self *Retention) archive(status, action string, messages []models.Message) error {
+	if self.conf.ArchiveDir == "" {
+		return nil
+	}
+
+	name := path.Join(self.conf.ArchiveDir, fmt.Sprintf("%s-%s-%d.ndjson.gz",
+		status, action, time.Now().UnixNano()))
+	file, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "while creating archive file")
+	}
+
+	writer := gzip.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for i := range messages {
+		if err = self.encode(encoder, &messages[i]); err != nil {
+			break
+		}
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return errors.Wrap(err, "while writing archive")
+	}
+	return errors.Wrap(os.Rename(name+".tmp", name), "while renaming archive")
+}
+
+func (self *Retention) encode(encoder *json.Encoder, msg *models.Message) error {
+	if self.conf.Master == nil {
+		return encoder.Encode(msg)
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	encrypted, err := envelope.Encrypt(self.conf.Master, string(payload), msg.Id)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(&archivedMessage{Id: msg.Id, Encrypted: encrypted})
+}
+
+// Returns the messages in an archive written by Retention, 'master' decrypts the
+// messages of an encrypted archive
+func ReadArchive(file string, master envelope.MasterKey) ([]models.Message, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening archive")
+	}
+	defer fd.Close()
+	reader, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading archive")
+	}
+
+	var results []models.Message
+	decoder := json.NewDecoder(reader)
+	for decoder.More() {
+		var line json.RawMessage
+		if err := decoder.Decode(&line); err != nil {
+			return nil, errors.Wrap(err, "while reading archive")
+		}
+
+		var archived archivedMessage
+		if err := json.Unmarshal(line, &archived); err != nil {
+			return nil, errors.Wrap(err, "while reading archive")
+		}
+		if archived.Encrypted != "" {
+			if master == nil {
+				return nil, errors.New("archive is encrypted and no master key was given")
+			}
+			payload, err := envelope.Decrypt(master, archived.Encrypted, archived.Id)
+			if err != nil {
+				return nil, err
+			}
+			line = json.RawMessage(payload)
+		}
+
+		var msg models.Message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, errors.Wrap(err, "while reading archive")
+		}
+		results = append(results, msg)
+	}
+	return results, nil
+}
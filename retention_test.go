@@ -0,0 +1,194 @@
+package detka_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka"
+	"github.com/thrawn01/detka/envelope"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/sqldb"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+// Returns the number of archived messages in 'dir'
+func countArchived(dir string) int {
+	files, err := ioutil.ReadDir(dir)
+	Expect(err).To(BeNil())
+
+	count := 0
+	for _, info := range files {
+		file, err := os.Open(path.Join(dir, info.Name()))
+		Expect(err).To(BeNil())
+		reader, err := gzip.NewReader(file)
+		Expect(err).To(BeNil())
+		for scanner := bufio.NewScanner(reader); scanner.Scan(); {
+			count++
+		}
+		file.Close()
+	}
+	return count
+}
+
+var _ = Describe("Retention", func() {
+	var dir, dbDir string
+	var dbStore store.Store
+
+	// The stores that support retention
+	backends := []struct {
+		name     string
+		newStore func(dir string) store.Store
+	}{
+		{"MemoryStore", func(string) store.Store { return store.NewMemoryStore() }},
+		{"SQLStore", func(dir string) store.Store {
+			manager, err := sqldb.NewManagerFromConfig(sqldb.Config{
+				Dialect:     sqldb.SQLite,
+				DSN:         path.Join(dir, "detka.db"),
+				AutoMigrate: true,
+			})
+			Expect(err).To(BeNil())
+			manager.Start()
+			dbStore, err := store.NewSQLStore(nil, manager)
+			Expect(err).To(BeNil())
+			return dbStore
+		}},
+	}
+
+	insert := func() {
+		for _, msg := range []models.Message{
+			{Id: "id-1", Text: "body", Status: "DELIVERED"},
+			{Id: "id-2", Text: "body", Status: "DELIVERED"},
+			{Id: "id-3", Text: "body", Status: "DELIVERED"},
+			{Id: "id-4", Text: "body", Status: "NEW"},
+		} {
+			msg := msg
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+			// Ensure each message is inserted before the purge runs
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-retention")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context("ParseRetentionRules()", func() {
+		It("should parse the rules in days", func() {
+			rules, err := detka.ParseRetentionRules("DELIVERED:7:90, UN-DELIVERABLE:0:30")
+			Expect(err).To(BeNil())
+			Expect(rules).To(Equal([]detka.RetentionRule{
+				{Status: "DELIVERED", PurgeBody: 7 * 24 * time.Hour, Delete: 90 * 24 * time.Hour},
+				{Status: "UN-DELIVERABLE", Delete: 30 * 24 * time.Hour},
+			}))
+		})
+
+		It("should reject invalid rules", func() {
+			_, err := detka.ParseRetentionRules("DELIVERED:7")
+			Expect(err).ToNot(BeNil())
+			_, err = detka.ParseRetentionRules("DELIVERED:7:ninety")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	for _, backend := range backends {
+		backend := backend
+		Context("When messages of a status expire in the "+backend.name, func() {
+			BeforeEach(func() {
+				var err error
+				dbDir, err = ioutil.TempDir("", "detka-retention-store")
+				Expect(err).To(BeNil())
+				dbStore = backend.newStore(dbDir)
+				insert()
+			})
+
+			AfterEach(func() {
+				dbStore.Stop()
+				os.RemoveAll(dbDir)
+			})
+
+			It("should archive and purge the bodies in batches", func() {
+				retention, err := detka.NewRetention(detka.RetentionConfig{
+					Rules:      []detka.RetentionRule{{Status: "DELIVERED", PurgeBody: time.Nanosecond}},
+					BatchSize:  2,
+					ArchiveDir: dir,
+				}, dbStore)
+				Expect(err).To(BeNil())
+				Expect(retention.Purge()).To(BeNil())
+
+				for _, id := range []string{"id-1", "id-2", "id-3"} {
+					msg, err := dbStore.GetMessage(context.Background(), id)
+					Expect(err).To(BeNil())
+					Expect(msg.Text).To(Equal(""))
+				}
+				msg, err := dbStore.GetMessage(context.Background(), "id-4")
+				Expect(err).To(BeNil())
+				Expect(msg.Text).To(Equal("body"))
+				Expect(countArchived(dir)).To(Equal(3))
+			})
+
+			It("should encrypt the archived messages with the master key", func() {
+				master, err := envelope.NewLocalKMS(path.Join(dir, "kms"))
+				Expect(err).To(BeNil())
+				archiveDir := path.Join(dir, "archive")
+				retention, err := detka.NewRetention(detka.RetentionConfig{
+					Rules:      []detka.RetentionRule{{Status: "DELIVERED", PurgeBody: time.Nanosecond}},
+					ArchiveDir: archiveDir,
+					Master:     master,
+				}, dbStore)
+				Expect(err).To(BeNil())
+				Expect(retention.Purge()).To(BeNil())
+
+				files, err := ioutil.ReadDir(archiveDir)
+				Expect(err).To(BeNil())
+				Expect(files).To(HaveLen(1))
+				file := path.Join(archiveDir, files[0].Name())
+
+				_, err = detka.ReadArchive(file, nil)
+				Expect(err).NotTo(BeNil())
+				messages, err := detka.ReadArchive(file, master)
+				Expect(err).To(BeNil())
+				Expect(messages).To(HaveLen(3))
+				Expect(messages[0].Text).To(Equal("body"))
+			})
+
+			It("should delete the messages", func() {
+				retention, err := detka.NewRetention(detka.RetentionConfig{
+					Rules: []detka.RetentionRule{{Status: "DELIVERED", Delete: time.Nanosecond}},
+				}, dbStore)
+				Expect(err).To(BeNil())
+				Expect(retention.Purge()).To(BeNil())
+
+				_, err = dbStore.GetMessage(context.Background(), "id-1")
+				Expect(store.IsNotFound(err)).To(Equal(true))
+				_, err = dbStore.GetMessage(context.Background(), "id-4")
+				Expect(err).To(BeNil())
+			})
+
+			It("should not purge a message when the archive fails", func() {
+				retention, err := detka.NewRetention(detka.RetentionConfig{
+					Rules:      []detka.RetentionRule{{Status: "DELIVERED", Delete: time.Nanosecond}},
+					ArchiveDir: dir,
+				}, dbStore)
+				Expect(err).To(BeNil())
+				os.RemoveAll(dir)
+
+				Expect(retention.Purge()).ToNot(BeNil())
+				_, err = dbStore.GetMessage(context.Background(), "id-1")
+				Expect(err).To(BeNil())
+			})
+		})
+	}
+})
@@ -1,18 +1,14 @@
 package rethink
 
 import (
-	"time"
-
 	"net/http"
 
-	"strings"
-
-	"github.com/Sirupsen/logrus"
-	"github.com/dancannon/gorethink"
 	"github.com/pressly/chi"
+	"github.com/sirupsen/logrus"
 	"github.com/thrawn01/args"
 	"github.com/thrawn01/detka/connection"
 	"golang.org/x/net/context"
+	"gopkg.in/gorethink/gorethink.v3"
 )
 
 type contextKey int
@@ -29,6 +25,13 @@ var ExecOpts = gorethink.ExecOpts{
 	Durability: "hard",
 }
 
+// Returns RunOpts that cancel the query once the context is done
+func RunOptsWithContext(ctx context.Context) gorethink.RunOpts {
+	opts := RunOpts
+	opts.Context = ctx
+	return opts
+}
+
 func SetManager(ctx context.Context, manager *Manager) context.Context {
 	return context.WithValue(ctx, rethinkManagerKey, manager)
 }
@@ -48,38 +51,70 @@ func GetManager(ctx context.Context) *Manager {
 
 type Manager struct {
 	*connection.Manager
-	parser  *args.ArgParser
-	session *gorethink.Session
+	parser *args.ArgParser
+}
+
+// The options a session depends on, see Reconfigure()
+type sessionConfig struct {
+	Endpoints  []string
+	Database   string
+	User       string
+	Password   string
+	AutoCreate bool
+}
+
+func sessionConfigFromOpts(opts *args.Options) sessionConfig {
+	return sessionConfig{
+		Endpoints:  opts.StringSlice("rethink-endpoints"),
+		Database:   opts.String("rethink-db"),
+		User:       opts.String("rethink-user"),
+		Password:   opts.String("rethink-password"),
+		AutoCreate: opts.Bool("rethink-auto-create"),
+	}
 }
 
 func NewManager(parser *args.ArgParser) *Manager {
 	me := &Manager{
-		&connection.Manager{},
+		connection.NewManager("rethink", connection.Backoff{}),
 		parser,
-		nil,
 	}
 	me.Start()
 	return me
 }
 
-func (self *Manager) GetSession() (result *gorethink.Session) {
-	self.WithLock(func() {
-		result = self.session
-	})
-	return
+// Returns the current session without acquiring it, prefer AcquireSession()
+func (self *Manager) GetSession() *gorethink.Session {
+	session, _ := self.Current().(*gorethink.Session)
+	return session
+}
+
+// Returns the current session and a func to call once done with it, a session replaced
+// by a reconnect is not closed until then. The session is nil if not connected
+func (self *Manager) AcquireSession() (*gorethink.Session, func()) {
+	value, release := self.Acquire()
+	session, _ := value.(*gorethink.Session)
+	return session, release
 }
 
 func (self *Manager) Start() {
-	// run connect(), if it fails try again every 2 seconds
-	self.Begin(self.connect, time.Second*2)
+	opts := self.parser.GetOpts()
+	self.Manager.Reconfigure(sessionConfigFromOpts(opts))
+	// run connect(), if it fails try again as the backoff options say
+	self.SetBackoff(connection.BackoffFromOpts(opts))
+	self.Begin(self.connect)
+}
+
+// Apply the current options, reconnects only if the options of the session changed
+func (self *Manager) Reconfigure() bool {
+	opts := self.parser.GetOpts()
+	self.SetBackoff(connection.BackoffFromOpts(opts))
+	return self.Manager.Reconfigure(sessionConfigFromOpts(opts))
 }
 
+// Waits for the users of the session to finish before closing it
 func (self *Manager) Stop() {
-	session := self.GetSession()
-	if session != nil {
-		session.Close()
-	}
 	self.End()
+	self.Swap(nil, closeSession)()
 }
 
 func (self *Manager) connect() bool {
@@ -87,12 +122,7 @@ func (self *Manager) connect() bool {
 
 	// Attempt to connect to rethinkdb
 	logrus.Info("Connecting to Rethink Cluster ", opts.StringSlice("rethink-endpoints"))
-	session, err := gorethink.Connect(gorethink.ConnectOpts{
-		Addresses: opts.StringSlice("rethink-endpoints"),
-		Database:  opts.String("rethink-db"),
-		Username:  opts.String("rethink-user"),
-		Password:  opts.String("rethink-password"),
-	})
+	session, err := Connect(opts)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"type":   "rethink",
@@ -102,28 +132,38 @@ func (self *Manager) connect() bool {
 	}
 
 	if opts.Bool("rethink-auto-create") {
-		if !self.createDbIfNotExists(session, opts) {
-			return false
-		}
-
-		if !self.createTablesIfNotExists(session) {
+		if err := Migrate(session, opts.String("rethink-db")); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"type":   "rethink",
+				"method": "Manager.connect()",
+			}).Errorf("Migration Failed - %s", err.Error())
+			session.Close()
 			return false
 		}
 	}
 
-	self.WithLock(func() {
-		self.session = session
-	})
+	// Close the previous session once the queries using it finish
+	go self.Swap(session, closeSession)()
 	return true
 }
 
-func (self *Manager) createDbIfNotExists(session *gorethink.Session, opts *args.Options) bool {
-	err := gorethink.DBCreate(opts.String("rethink-db")).Exec(session, ExecOpts)
-	return handleCreateError("createDbIfNotExists", err)
+func closeSession(value interface{}) {
+	if err := value.(*gorethink.Session).Close(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"type":   "rethink",
+			"method": "closeSession()",
+		}).Warn("Close Failed - ", err.Error())
+	}
 }
-func (self *Manager) createTablesIfNotExists(session *gorethink.Session) bool {
-	err := gorethink.TableCreate("messages", gorethink.TableCreateOpts{PrimaryKey: "Id"}).Exec(session, ExecOpts)
-	return handleCreateError("createTablesIfNotExists", err)
+
+// Open a session to the cluster described by the 'rethink-*' options
+func Connect(opts *args.Options) (*gorethink.Session, error) {
+	return gorethink.Connect(gorethink.ConnectOpts{
+		Addresses: opts.StringSlice("rethink-endpoints"),
+		Database:  opts.String("rethink-db"),
+		Username:  opts.String("rethink-user"),
+		Password:  opts.String("rethink-password"),
+	})
 }
 
 // Injects rethink.Manager into the context.Context for each request
@@ -135,17 +175,3 @@ func Middleware(manager *Manager) func(chi.Handler) chi.Handler {
 		})
 	}
 }
-
-func handleCreateError(context string, err error) bool {
-	if err != nil {
-		if !strings.Contains(err.Error(), "already exists") {
-			logrus.WithFields(logrus.Fields{
-				"method": context,
-				"type":   "rethink",
-			}).Error(err)
-			return false
-		}
-		logrus.Debug(err)
-	}
-	return true
-}
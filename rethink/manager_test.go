@@ -0,0 +1,104 @@
+package rethink_test
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/rethink"
+	"gopkg.in/gorethink/gorethink.v3"
+)
+
+var _ = Describe("Manager", func() {
+	var parser *args.ArgParser
+	var opts *args.Options
+	var manager *rethink.Manager
+	var databases []string
+
+	// Each test gets an empty database
+	newDatabase := func() string {
+		db := "detka_manager_" + models.NewId()
+		databases = append(databases, db)
+		return db
+	}
+
+	BeforeEach(func() {
+		if os.Getenv("DETKA_DOCKER_HOST") == "" {
+			Skip("DETKA_DOCKER_HOST not set, skipped....")
+		}
+
+		parser = args.NewParser()
+		parser.AddOption("--rethink-auto-create").IsBool().Default("true")
+		parser.AddOption("--rethink-endpoints").IsStringSlice()
+		parser.AddOption("--rethink-db")
+
+		var err error
+		opts, err = parser.ParseArgs(nil)
+		Expect(err).To(BeNil())
+		databases = nil
+		opts.Set("rethink-endpoints", fmt.Sprintf("%s:28015", os.Getenv("DETKA_DOCKER_HOST")))
+		opts.Set("rethink-db", newDatabase())
+		parser.Apply(opts)
+
+		manager = rethink.NewManager(parser)
+	})
+
+	AfterEach(func() {
+		if manager == nil {
+			return
+		}
+		manager.Stop()
+		manager = nil
+
+		session, err := rethink.Connect(parser.GetOpts())
+		Expect(err).To(BeNil())
+		defer session.Close()
+		for _, db := range databases {
+			gorethink.DBDrop(db).Exec(session)
+		}
+	})
+
+	Describe("Reconfigure()", func() {
+		It("should keep the session when the options are unchanged", func() {
+			session := manager.GetSession()
+			Expect(session).To(Not(BeNil()))
+			Expect(manager.Reconfigure()).To(BeFalse())
+			Expect(manager.GetSession()).To(BeIdenticalTo(session))
+		})
+
+		It("should replace the session when the options change", func() {
+			previous := manager.GetSession()
+			Expect(previous).To(Not(BeNil()))
+
+			db := newDatabase()
+			opts.Set("rethink-db", db)
+			parser.Apply(opts)
+			Expect(manager.Reconfigure()).To(BeTrue())
+
+			Eventually(manager.GetSession, time.Second*10).Should(Not(BeIdenticalTo(previous)))
+			// The new database was created and migrated on connect
+			version, err := rethink.SchemaVersion(manager.GetSession(), db)
+			Expect(err).To(BeNil())
+			Expect(version).To(Equal(rethink.LatestVersion()))
+		})
+
+		It("should not close the previous session until it is released", func() {
+			session, release := manager.AcquireSession()
+			Expect(session).To(Not(BeNil()))
+
+			opts.Set("rethink-db", newDatabase())
+			parser.Apply(opts)
+			Expect(manager.Reconfigure()).To(BeTrue())
+			Eventually(manager.GetSession, time.Second*10).Should(Not(BeIdenticalTo(session)))
+
+			// The acquired session is still usable
+			Expect(session.IsConnected()).To(BeTrue())
+			release()
+			Eventually(session.IsConnected).Should(BeFalse())
+		})
+	})
+})
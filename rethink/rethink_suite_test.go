@@ -0,0 +1,13 @@
+package rethink_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRethink(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Rethink Suite")
+}
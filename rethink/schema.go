@@ -0,0 +1,200 @@
+package rethink
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/gorethink/gorethink.v3"
+)
+
+// Table that records the schema versions applied to the database
+const MigrationsTable = "schema_migrations"
+
+type Table struct {
+	Name       string
+	PrimaryKey string
+}
+
+// A secondary index on a single field of a table
+type Index struct {
+	Table string
+	Name  string
+	Field string
+	// Index each element of an array field
+	Multi bool
+}
+
+type migration struct {
+	Version int
+	// Created if they don't exist, so a migration interrupted part way can be run again
+	Tables  []Table
+	Indexes []Index
+	// Dropped if they exist, only the Table and Name are used
+	DropIndexes []Index
+}
+
+// The schema of the database, never modify a released migration; append a new version instead
+var migrations = []migration{
+	{
+		Version: 1,
+		Tables:  []Table{{Name: "messages", PrimaryKey: "Id"}},
+	},
+	{
+		Version: 2,
+		Indexes: []Index{
+			{Table: "messages", Name: "status", Field: "Status"},
+			{Table: "messages", Name: "created_at", Field: "CreatedAt"},
+			{Table: "messages", Name: "recipient", Field: "To"},
+			{Table: "messages", Name: "account", Field: "Account"},
+		},
+	},
+	{
+		// Recipients by models.RecipientKeys(), see store.RecipientIndex
+		Version: 3,
+		Indexes: []Index{
+			{Table: "messages", Name: "recipient_keys", Field: "RecipientKeys", Multi: true},
+		},
+	},
+	{
+		// The raw 'To' field is replaced by 'recipient_keys', it misses every recipient but the
+		// first and holds ciphertext once the store is encrypted
+		Version: 4,
+		DropIndexes: []Index{
+			{Table: "messages", Name: "recipient"},
+		},
+	},
+}
+
+// Returns the version of the latest migration
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Create the database if it doesn't exist and apply any migrations it has not seen. Waits
+// for new indexes to become ready before recording the migration
+func Migrate(session *gorethink.Session, db string) error {
+	if err := createIfMissing(session, gorethink.DBList(), db, gorethink.DBCreate(db)); err != nil {
+		return errors.Wrapf(err, "while creating database '%s'", db)
+	}
+
+	err := createIfMissing(session, gorethink.DB(db).TableList(), MigrationsTable,
+		gorethink.DB(db).TableCreate(MigrationsTable, gorethink.TableCreateOpts{PrimaryKey: "Version"}))
+	if err != nil {
+		return errors.Wrapf(err, "while creating '%s'", MigrationsTable)
+	}
+
+	current, err := SchemaVersion(session, db)
+	if err != nil {
+		return err
+	}
+	if current > LatestVersion() {
+		return errors.Errorf("database schema version %d is newer than this release understands (%d)",
+			current, LatestVersion())
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		if err := apply(session, db, migration); err != nil {
+			return errors.Wrapf(err, "migration %d", migration.Version)
+		}
+		logrus.WithFields(logrus.Fields{
+			"type":   "rethink",
+			"method": "Migrate()",
+		}).Infof("Applied migration %d", migration.Version)
+	}
+	return nil
+}
+
+// Returns the latest schema version applied to the database, 0 if none
+func SchemaVersion(session *gorethink.Session, db string) (int, error) {
+	cursor, err := gorethink.DB(db).Table(MigrationsTable).Max("Version").Field("Version").
+		Default(0).Run(session, RunOpts)
+	if err != nil {
+		return 0, errors.Wrap(err, "while reading the schema version")
+	}
+	var current int
+	if err := cursor.One(&current); err != nil {
+		return 0, errors.Wrap(err, "while reading the schema version")
+	}
+	return current, nil
+}
+
+func apply(session *gorethink.Session, db string, migration migration) error {
+	for _, table := range migration.Tables {
+		err := createIfMissing(session, gorethink.DB(db).TableList(), table.Name,
+			gorethink.DB(db).TableCreate(table.Name, gorethink.TableCreateOpts{PrimaryKey: table.PrimaryKey}))
+		if err != nil {
+			return errors.Wrapf(err, "while creating table '%s'", table.Name)
+		}
+	}
+
+	for _, index := range migration.Indexes {
+		table := gorethink.DB(db).Table(index.Table)
+		err := createIfMissing(session, table.IndexList(), index.Name,
+			table.IndexCreateFunc(index.Name, func(row gorethink.Term) interface{} {
+				return row.Field(index.Field)
+			}, gorethink.IndexCreateOpts{Multi: index.Multi}))
+		if err != nil {
+			return errors.Wrapf(err, "while creating index '%s' on '%s'", index.Name, index.Table)
+		}
+		if err := table.IndexWait(index.Name).Exec(session, ExecOpts); err != nil {
+			return errors.Wrapf(err, "while waiting for index '%s' on '%s'", index.Name, index.Table)
+		}
+	}
+
+	for _, index := range migration.DropIndexes {
+		table := gorethink.DB(db).Table(index.Table)
+		if err := dropIfPresent(session, table.IndexList(), index.Name, table.IndexDrop(index.Name)); err != nil {
+			return errors.Wrapf(err, "while dropping index '%s' on '%s'", index.Name, index.Table)
+		}
+	}
+
+	_, err := gorethink.DB(db).Table(MigrationsTable).
+		Insert(map[string]interface{}{"Version": migration.Version}, gorethink.InsertOpts{Conflict: "replace"}).
+		RunWrite(session, RunOpts)
+	return errors.Wrap(err, "while recording the migration")
+}
+
+// Run 'create' if 'name' is not in the result of 'list'. If 'create' fails because another
+// process created 'name' first the error is ignored
+func createIfMissing(session *gorethink.Session, list gorethink.Term, name string, create gorethink.Term) error {
+	exists, err := contains(session, list, name)
+	if err != nil || exists {
+		return err
+	}
+
+	if err := create.Exec(session, ExecOpts); err != nil {
+		if exists, _ := contains(session, list, name); exists {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Run 'drop' if 'name' is in the result of 'list'. If 'drop' fails because another
+// process dropped 'name' first the error is ignored
+func dropIfPresent(session *gorethink.Session, list gorethink.Term, name string, drop gorethink.Term) error {
+	exists, err := contains(session, list, name)
+	if err != nil || !exists {
+		return err
+	}
+
+	if err := drop.Exec(session, ExecOpts); err != nil {
+		if exists, _ := contains(session, list, name); !exists {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func contains(session *gorethink.Session, list gorethink.Term, name string) (bool, error) {
+	cursor, err := list.Contains(name).Run(session, RunOpts)
+	if err != nil {
+		return false, err
+	}
+	var result bool
+	return result, cursor.One(&result)
+}
@@ -0,0 +1,112 @@
+package rethink_test
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/rethink"
+	"gopkg.in/gorethink/gorethink.v3"
+)
+
+var _ = Describe("Migrate", func() {
+	var session *gorethink.Session
+	var db string
+
+	indexes := func() []string {
+		cursor, err := gorethink.DB(db).Table("messages").IndexList().Run(session)
+		Expect(err).To(BeNil())
+		var result []string
+		Expect(cursor.All(&result)).To(BeNil())
+		return result
+	}
+
+	recordVersion := func(version int) {
+		_, err := gorethink.DB(db).Table(rethink.MigrationsTable).
+			Insert(map[string]interface{}{"Version": version}).RunWrite(session)
+		Expect(err).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		if os.Getenv("DETKA_DOCKER_HOST") == "" {
+			Skip("DETKA_DOCKER_HOST not set, skipped....")
+		}
+
+		var err error
+		session, err = gorethink.Connect(gorethink.ConnectOpts{
+			Address: fmt.Sprintf("%s:28015", os.Getenv("DETKA_DOCKER_HOST")),
+		})
+		Expect(err).To(BeNil())
+		// Each test gets an empty database
+		db = "detka_schema_" + models.NewId()
+	})
+
+	AfterEach(func() {
+		if session == nil {
+			return
+		}
+		gorethink.DBDrop(db).Exec(session)
+		session.Close()
+		session = nil
+	})
+
+	It("should apply every migration to a new database", func() {
+		Expect(rethink.Migrate(session, db)).To(BeNil())
+
+		version, err := rethink.SchemaVersion(session, db)
+		Expect(err).To(BeNil())
+		Expect(version).To(Equal(rethink.LatestVersion()))
+		Expect(indexes()).To(ConsistOf("status", "created_at", "account", "recipient_keys"))
+	})
+
+	It("should do nothing when run again", func() {
+		Expect(rethink.Migrate(session, db)).To(BeNil())
+		Expect(rethink.Migrate(session, db)).To(BeNil())
+
+		version, err := rethink.SchemaVersion(session, db)
+		Expect(err).To(BeNil())
+		Expect(version).To(Equal(rethink.LatestVersion()))
+	})
+
+	It("should drop the recipient index of a database at version 3", func() {
+		Expect(gorethink.DBCreate(db).Exec(session)).To(BeNil())
+		Expect(gorethink.DB(db).TableCreate(rethink.MigrationsTable,
+			gorethink.TableCreateOpts{PrimaryKey: "Version"}).Exec(session)).To(BeNil())
+		Expect(gorethink.DB(db).TableCreate("messages",
+			gorethink.TableCreateOpts{PrimaryKey: "Id"}).Exec(session)).To(BeNil())
+		Expect(gorethink.DB(db).Table("messages").IndexCreateFunc("recipient",
+			func(row gorethink.Term) interface{} { return row.Field("To") }).Exec(session)).To(BeNil())
+		recordVersion(3)
+
+		version, err := rethink.SchemaVersion(session, db)
+		Expect(err).To(BeNil())
+		Expect(version).To(Equal(3))
+
+		Expect(rethink.Migrate(session, db)).To(BeNil())
+		Expect(indexes()).To(Not(ContainElement("recipient")))
+		version, err = rethink.SchemaVersion(session, db)
+		Expect(err).To(BeNil())
+		Expect(version).To(Equal(rethink.LatestVersion()))
+	})
+
+	It("should refuse a database newer than it understands", func() {
+		Expect(rethink.Migrate(session, db)).To(BeNil())
+		recordVersion(rethink.LatestVersion() + 1)
+
+		err := rethink.Migrate(session, db)
+		Expect(err).To(Not(BeNil()))
+		Expect(err.Error()).To(ContainSubstring("newer than this release understands"))
+	})
+
+	It("should report version 0 for a database without migrations", func() {
+		Expect(gorethink.DBCreate(db).Exec(session)).To(BeNil())
+		Expect(gorethink.DB(db).TableCreate(rethink.MigrationsTable,
+			gorethink.TableCreateOpts{PrimaryKey: "Version"}).Exec(session)).To(BeNil())
+
+		version, err := rethink.SchemaVersion(session, db)
+		Expect(err).To(BeNil())
+		Expect(version).To(Equal(0))
+	})
+})
@@ -0,0 +1,207 @@
+package sqldb
+
+import (
+	"database/sql"
+	"strconv"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/connection"
+)
+
+// Databases supported by the Manager
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+type Config struct {
+	// Either Postgres or SQLite
+	Dialect string
+	// Connection string of the postgres database or path of the sqlite database file
+	DSN string
+	// Apply any pending migrations on connect
+	AutoMigrate bool
+	// How to retry a failed connect, the zero value uses connection.DefaultBackoff()
+	Backoff connection.Backoff
+}
+
+func ConfigFromOpts(opts *args.Options) Config {
+	return Config{
+		Dialect:     opts.String("store-backend"),
+		DSN:         opts.String("sql-dsn"),
+		AutoMigrate: opts.Bool("sql-auto-migrate"),
+		Backoff:     connection.BackoffFromOpts(opts),
+	}
+}
+
+type Manager struct {
+	*connection.Manager
+	config  func() Config
+	dialect Dialect
+	db      *sql.DB
+}
+
+// Create a manager for the 'store-backend' database, the options are read again on every
+// reconnect. Returns an error if the backend is not a SQL database. Call Start() to connect
+func NewManager(parser *args.ArgParser) (*Manager, error) {
+	return newManager(func() Config { return ConfigFromOpts(parser.GetOpts()) })
+}
+
+// Create a manager that always connects using 'conf'
+func NewManagerFromConfig(conf Config) (*Manager, error) {
+	return newManager(func() Config { return conf })
+}
+
+func newManager(config func() Config) (*Manager, error) {
+	dialect, err := NewDialect(config().Dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		Manager: connection.NewManager(dialect.Name(), connection.Backoff{}),
+		config:  config,
+		dialect: dialect,
+	}, nil
+}
+
+func (self *Manager) GetDB() (result *sql.DB) {
+	self.WithLock(func() {
+		result = self.db
+	})
+	return
+}
+
+func (self *Manager) GetDialect() Dialect {
+	return self.dialect
+}
+
+func (self *Manager) Start() {
+	conf := self.config()
+	self.Manager.Reconfigure(conf.DSN)
+	// run connect(), if it fails try again as the backoff config says
+	self.SetBackoff(conf.Backoff)
+	self.Begin(self.connect)
+}
+
+// Apply the current config, reconnects only if the DSN changed
+func (self *Manager) Reconfigure() bool {
+	conf := self.config()
+	self.SetBackoff(conf.Backoff)
+	return self.Manager.Reconfigure(conf.DSN)
+}
+
+func (self *Manager) Stop() {
+	self.End()
+	self.setDB(nil)
+}
+
+// Replace the current connection pool, closing the previous pool
+func (self *Manager) setDB(db *sql.DB) {
+	var prev *sql.DB
+	self.WithLock(func() {
+		prev = self.db
+		self.db = db
+	})
+	if prev != nil {
+		prev.Close()
+	}
+}
+
+func (self *Manager) connect() bool {
+	conf := self.config()
+
+	logrus.Infof("Connecting to %s database", self.dialect.Name())
+	db, err := sql.Open(self.dialect.Driver(), conf.DSN)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"type":   "sql",
+			"method": "Manager.connect()",
+		}).Errorf("Connect Failed - %s", err.Error())
+		if db != nil {
+			db.Close()
+		}
+		return false
+	}
+
+	if self.dialect.Name() == SQLite {
+		// SQLite allows a single writer, avoid 'database is locked' errors
+		db.SetMaxOpenConns(1)
+	}
+
+	if conf.AutoMigrate {
+		if err := Migrate(db, self.dialect); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"type":   "sql",
+				"method": "Manager.connect()",
+			}).Errorf("Migration Failed - %s", err.Error())
+			db.Close()
+			return false
+		}
+	}
+
+	self.setDB(db)
+	return true
+}
+
+// Describes the differences between the supported databases
+type Dialect interface {
+	Name() string
+	// The database/sql driver name
+	Driver() string
+	// Rewrite the '?' placeholders of the query for the database
+	Rebind(query string) string
+	// Statement executed in the migration transaction to serialize concurrent migrations
+	LockMigrations() string
+}
+
+func NewDialect(name string) (Dialect, error) {
+	switch name {
+	case Postgres:
+		return &postgresDialect{}, nil
+	case SQLite:
+		return &sqliteDialect{}, nil
+	}
+	return nil, errors.Errorf("invalid sql dialect '%s' - must be one of [postgres sqlite]", name)
+}
+
+type postgresDialect struct{}
+
+func (self *postgresDialect) Name() string   { return Postgres }
+func (self *postgresDialect) Driver() string { return "postgres" }
+
+// Postgres uses numbered placeholders ($1, $2)
+func (self *postgresDialect) Rebind(query string) string {
+	result := make([]byte, 0, len(query)+10)
+	count := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '?' {
+			result = append(result, query[i])
+			continue
+		}
+		count++
+		result = append(result, '$')
+		result = append(result, strconv.Itoa(count)...)
+	}
+	return string(result)
+}
+
+func (self *postgresDialect) LockMigrations() string {
+	// Released when the migration transaction ends
+	return "SELECT pg_advisory_xact_lock(7461827)"
+}
+
+type sqliteDialect struct{}
+
+func (self *sqliteDialect) Name() string               { return SQLite }
+func (self *sqliteDialect) Driver() string             { return "sqlite3" }
+func (self *sqliteDialect) Rebind(query string) string { return query }
+
+// SQLite transactions already serialize writers
+func (self *sqliteDialect) LockMigrations() string { return "" }
@@ -0,0 +1,142 @@
+package sqldb
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type migration struct {
+	Version int
+	// Statements applied in order, the same statements must work for every dialect
+	Up []string
+}
+
+// The schema of the database, never modify a released migration; append a new version instead
+var migrations = []migration{
+	{
+		Version: 1,
+		Up: []string{
+			`CREATE TABLE messages (
+				id         VARCHAR(64) PRIMARY KEY,
+				subject    TEXT NOT NULL DEFAULT '',
+				body       TEXT NOT NULL DEFAULT '',
+				sender     TEXT NOT NULL DEFAULT '',
+				recipients TEXT NOT NULL DEFAULT '',
+				status     VARCHAR(32) NOT NULL DEFAULT '',
+				priority   VARCHAR(16) NOT NULL DEFAULT '',
+				account    TEXT NOT NULL DEFAULT ''
+			)`,
+		},
+	},
+	{
+		// Optimistic concurrency, see Store.UpdateMessageIf()
+		Version: 2,
+		Up: []string{
+			`ALTER TABLE messages ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		},
+	},
+	{
+		// Recipients by models.RecipientKeys(), see store.RecipientIndex
+		Version: 3,
+		Up: []string{
+			`CREATE TABLE message_recipients (
+				recipient_key TEXT NOT NULL,
+				message_id    VARCHAR(64) NOT NULL,
+				PRIMARY KEY (recipient_key, message_id)
+			)`,
+			`CREATE INDEX message_recipients_message_id ON message_recipients (message_id)`,
+		},
+	},
+	{
+		// Bodies kept in the blob store, see store.OffloadStore
+		Version: 4,
+		Up: []string{
+			`ALTER TABLE messages ADD COLUMN body_ref TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE messages ADD COLUMN body_checksum TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		// When a worker claimed the message, see detka.ClaimTimeout
+		Version: 5,
+		Up: []string{
+			`ALTER TABLE messages ADD COLUMN claimed_at BIGINT NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		// Unix nanoseconds the message was inserted, see store.Expirer. Messages inserted before
+		// this migration have no insert time and are never expired
+		Version: 6,
+		Up: []string{
+			`ALTER TABLE messages ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0`,
+			`CREATE INDEX messages_status_created_at ON messages (status, created_at)`,
+		},
+	},
+}
+
+// Returns the version of the latest migration
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Apply any migrations the database has not seen, in a single transaction so a failed
+// migration leaves the schema untouched
+func Migrate(db *sql.DB, dialect Dialect) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "db.Begin()")
+	}
+	defer tx.Rollback()
+
+	if lock := dialect.LockMigrations(); lock != "" {
+		if _, err := tx.Exec(lock); err != nil {
+			return errors.Wrap(err, "while locking migrations")
+		}
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "while creating schema_migrations")
+	}
+
+	current, err := version(tx)
+	if err != nil {
+		return err
+	}
+	if current > LatestVersion() {
+		return errors.Errorf("database schema version %d is newer than this release understands (%d)",
+			current, LatestVersion())
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		for _, statement := range migration.Up {
+			if _, err := tx.Exec(statement); err != nil {
+				return errors.Wrapf(err, "migration %d", migration.Version)
+			}
+		}
+		_, err := tx.Exec(dialect.Rebind("INSERT INTO schema_migrations (version) VALUES (?)"),
+			migration.Version)
+		if err != nil {
+			return errors.Wrapf(err, "while recording migration %d", migration.Version)
+		}
+		logrus.WithFields(logrus.Fields{
+			"type":   "sql",
+			"method": "Migrate()",
+		}).Infof("Applied migration %d", migration.Version)
+	}
+	return errors.Wrap(tx.Commit(), "tx.Commit()")
+}
+
+func version(tx *sql.Tx) (int, error) {
+	var current sql.NullInt64
+	if err := tx.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&current); err != nil {
+		return 0, errors.Wrap(err, "while reading the schema version")
+	}
+	return int(current.Int64), nil
+}
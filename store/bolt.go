@@ -0,0 +1,359 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/boltdb"
+	"github.com/thrawn01/detka/models"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/context"
+)
+
+// The value stored in the messages bucket
+type boltRecord struct {
+	Message models.Message `json:"message"`
+	// Unix time in nanoseconds the message was inserted
+	Created int64 `json:"created"`
+	// Not encoded with the message, see models.Message.RecipientKeys
+	RecipientKeys []string `json:"recipient_keys"`
+}
+
+func NewBoltStore(parser *args.ArgParser, manager *boltdb.Manager) Store {
+	if manager == nil {
+		manager = boltdb.NewManager(parser)
+		manager.Start()
+	}
+
+	return &BoltStore{
+		manager: manager,
+	}
+}
+
+// A Store embedded in the process, for deployments without an external database. Messages are
+// indexed by status, by recipient and by the time they were inserted
+type BoltStore struct {
+	manager *boltdb.Manager
+}
+
+func (self *BoltStore) GetMessage(ctx context.Context, id string) (*models.Message, error) {
+	var record boltRecord
+	err := self.view(ctx, "GetMessage()", func(tx *bolt.Tx) error {
+		return getRecord(tx, id, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record.Message, nil
+}
+
+func (self *BoltStore) InsertMessage(ctx context.Context, msg *models.Message) error {
+	if len(msg.Id) == 0 {
+		msg.Id = models.NewId()
+	}
+	if msg.Version == 0 {
+		msg.Version = 1
+	}
+
+	return self.update(ctx, "InsertMessage()", func(tx *bolt.Tx) error {
+		if tx.Bucket(boltdb.MessagesBucket).Get([]byte(msg.Id)) != nil {
+			return NewError(internalErr, "Duplicate primary key `id`: %s", msg.Id)
+		}
+
+		record := boltRecord{Message: *msg, Created: time.Now().UnixNano(), RecipientKeys: recipientKeysOf(msg)}
+		if err := putRecord(tx, &record); err != nil {
+			return err
+		}
+		return tx.Bucket(boltdb.CreatedIndexBucket).Put(createdKey(record.Created, msg.Id), nil)
+	})
+}
+
+func (self *BoltStore) UpdateMessage(ctx context.Context, id string, fields map[string]interface{}) error {
+	return self.updateMessage(ctx, "UpdateMessage()", id, -1, fields)
+}
+
+func (self *BoltStore) UpdateMessageIf(ctx context.Context, id string, version int,
+	fields map[string]interface{}) error {
+	return self.updateMessage(ctx, "UpdateMessageIf()", id, version, fields)
+}
+
+// Apply the update if the message has 'version', any version if 'version' is negative
+func (self *BoltStore) updateMessage(ctx context.Context, method, id string, version int,
+	fields map[string]interface{}) error {
+	return self.update(ctx, method, func(tx *bolt.Tx) error {
+		var record boltRecord
+		if err := getRecord(tx, id, &record); err != nil {
+			return err
+		}
+		if version >= 0 && record.Message.Version != version {
+			return NewError(conflictErr, "Message Id - %s was modified since version %d", id, version)
+		}
+
+		prev := record.Message.Status
+		fields = indexRecipientFields(fields)
+		if err := setFields(&record.Message, fields); err != nil {
+			return err
+		}
+		record.Message.Version++
+		if prev != record.Message.Status {
+			if err := tx.Bucket(boltdb.StatusIndexBucket).Delete(statusKey(prev, id)); err != nil {
+				return err
+			}
+		}
+		if _, ok := fields["RecipientKeys"]; ok {
+			if err := deleteRecipients(tx, &record); err != nil {
+				return err
+			}
+			record.RecipientKeys, record.Message.RecipientKeys = record.Message.RecipientKeys, nil
+		}
+		return putRecord(tx, &record)
+	})
+}
+
+// Returns the ids of the messages with 'status'
+func (self *BoltStore) MessagesByStatus(ctx context.Context, status string) ([]string, error) {
+	var ids []string
+	err := self.view(ctx, "MessagesByStatus()", func(tx *bolt.Tx) error {
+		prefix := statusKey(status, "")
+		cursor := tx.Bucket(boltdb.StatusIndexBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			ids = append(ids, string(key[len(prefix):]))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// Returns the ids of the messages inserted between 'start' and 'end' (exclusive), oldest first
+func (self *BoltStore) MessagesCreatedBetween(ctx context.Context, start, end time.Time) ([]string, error) {
+	var ids []string
+	err := self.view(ctx, "MessagesCreatedBetween()", func(tx *bolt.Tx) error {
+		limit := createdKey(end.UnixNano(), "")
+		cursor := tx.Bucket(boltdb.CreatedIndexBucket).Cursor()
+		for key, _ := cursor.Seek(createdKey(start.UnixNano(), "")); key != nil && bytes.Compare(key, limit) < 0; key, _ = cursor.Next() {
+			ids = append(ids, string(key[8:]))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (self *BoltStore) ScanMessages(ctx context.Context, after string, limit int) ([]models.Message, error) {
+	var result []models.Message
+	err := self.view(ctx, "ScanMessages()", func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltdb.MessagesBucket).Cursor()
+		key, value := cursor.Seek([]byte(after))
+		if key != nil && string(key) == after {
+			key, value = cursor.Next()
+		}
+		for ; key != nil && len(result) < limit; key, value = cursor.Next() {
+			var record boltRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return FromError(internalErr, err, "json.Unmarshal() message id - %s", key)
+			}
+			result = append(result, record.Message)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (self *BoltStore) MessagesByRecipient(ctx context.Context, recipient string,
+	limit int) ([]models.Message, error) {
+	return self.messagesByRecipientKey(ctx, models.RecipientKey(recipient), limit)
+}
+
+func (self *BoltStore) messagesByRecipientKey(ctx context.Context, key string,
+	limit int) ([]models.Message, error) {
+	var result []models.Message
+	err := self.view(ctx, "MessagesByRecipient()", func(tx *bolt.Tx) error {
+		prefix := recipientKey(key, "")
+		cursor := tx.Bucket(boltdb.RecipientIndexBucket).Cursor()
+		for index, _ := cursor.Seek(prefix); index != nil && bytes.HasPrefix(index, prefix) &&
+			len(result) < limit; index, _ = cursor.Next() {
+			var record boltRecord
+			if err := getRecord(tx, string(index[len(prefix):]), &record); err != nil {
+				return err
+			}
+			result = append(result, record.Message)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (self *BoltStore) ExpiredMessages(ctx context.Context, status string, before time.Time,
+	withBody bool, limit int) ([]models.Message, error) {
+	var result []models.Message
+	err := self.view(ctx, "ExpiredMessages()", func(tx *bolt.Tx) error {
+		end := createdKey(before.UnixNano(), "")
+		cursor := tx.Bucket(boltdb.CreatedIndexBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && bytes.Compare(key, end) < 0 && len(result) < limit; key, _ = cursor.Next() {
+			var record boltRecord
+			if err := getRecord(tx, string(key[8:]), &record); err != nil {
+				return err
+			}
+			if record.Message.Status != status ||
+				(withBody && record.Message.Text == "" && record.Message.BodyRef == "") {
+				continue
+			}
+			result = append(result, record.Message)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (self *BoltStore) DeleteMessages(ctx context.Context, ids []string) error {
+	return self.update(ctx, "DeleteMessages()", func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			var record boltRecord
+			if err := getRecord(tx, id, &record); err != nil {
+				if IsNotFound(err) {
+					continue
+				}
+				return err
+			}
+			if err := tx.Bucket(boltdb.MessagesBucket).Delete([]byte(id)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltdb.StatusIndexBucket).Delete(statusKey(record.Message.Status, id)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltdb.CreatedIndexBucket).Delete(createdKey(record.Created, id)); err != nil {
+				return err
+			}
+			if err := deleteRecipients(tx, &record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Write a consistent copy of the database to 'path' while it remains in use
+func (self *BoltStore) Backup(path string) error {
+	if err := self.manager.Backup(path); err != nil {
+		return FromError(internalErr, err, "Backup()")
+	}
+	return nil
+}
+
+func (self *BoltStore) SignalReconnect() {
+	self.manager.Signal()
+}
+
+func (self *BoltStore) Reconfigure() {
+	self.manager.Reconfigure()
+}
+
+func (self *BoltStore) Diagnose() map[string]string {
+	if self.IsConnected() {
+		return nil
+	}
+	return map[string]string{"bolt": string(self.manager.State())}
+}
+
+func (self *BoltStore) IsConnected() bool {
+	return self.manager.GetDB() != nil
+}
+
+func (self *BoltStore) Stop() {
+	self.manager.Stop()
+}
+
+// Bolt transactions can't be interrupted, the context is only checked before the transaction begins
+func (self *BoltStore) view(ctx context.Context, method string, callBack func(*bolt.Tx) error) error {
+	if err := ContextError(ctx, "%s", method); err != nil {
+		return err
+	}
+	db := self.manager.GetDB()
+	if db == nil {
+		return NewError(connectionErr, "%s Not Connected", method)
+	}
+	return boltError(db.View(callBack), method)
+}
+
+func (self *BoltStore) update(ctx context.Context, method string, callBack func(*bolt.Tx) error) error {
+	if err := ContextError(ctx, "%s", method); err != nil {
+		return err
+	}
+	db := self.manager.GetDB()
+	if db == nil {
+		return NewError(connectionErr, "%s Not Connected", method)
+	}
+	return boltError(db.Update(callBack), method)
+}
+
+// Store errors are returned as is, bolt errors are mapped to store errors
+func boltError(err error, method string) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*StoreError); ok {
+		return err
+	}
+	if err == bolt.ErrDatabaseNotOpen {
+		return FromError(connectionErr, err, "%s", method)
+	}
+	return FromError(internalErr, err, "%s", method)
+}
+
+func getRecord(tx *bolt.Tx, id string, record *boltRecord) error {
+	value := tx.Bucket(boltdb.MessagesBucket).Get([]byte(id))
+	if value == nil {
+		return NewError(notFoundErr, "message id - %s not found", id)
+	}
+	if err := json.Unmarshal(value, record); err != nil {
+		return FromError(internalErr, err, "json.Unmarshal() message id - %s", id)
+	}
+	return nil
+}
+
+// Write the record and its status and recipient indexes
+func putRecord(tx *bolt.Tx, record *boltRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return FromError(internalErr, err, "json.Marshal()")
+	}
+
+	id := record.Message.Id
+	if err := tx.Bucket(boltdb.MessagesBucket).Put([]byte(id), value); err != nil {
+		return err
+	}
+	for _, key := range record.RecipientKeys {
+		if err := tx.Bucket(boltdb.RecipientIndexBucket).Put(recipientKey(key, id), nil); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(boltdb.StatusIndexBucket).Put(statusKey(record.Message.Status, id), nil)
+}
+
+func deleteRecipients(tx *bolt.Tx, record *boltRecord) error {
+	for _, key := range record.RecipientKeys {
+		err := tx.Bucket(boltdb.RecipientIndexBucket).Delete(recipientKey(key, record.Message.Id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Index keys are prefixed by the indexed value so a cursor can seek to it
+func statusKey(status, id string) []byte {
+	return []byte(status + "\x00" + id)
+}
+
+func recipientKey(key, id string) []byte {
+	return []byte(key + "\x00" + id)
+}
+
+// Big endian so the keys sort by time
+func createdKey(created int64, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(created))
+	return append(key, id...)
+}
@@ -0,0 +1,75 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/boltdb"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/store"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("BoltStore", func() {
+	var dir string
+	var dbStore *store.BoltStore
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-bolt")
+		Expect(err).To(BeNil())
+
+		manager := boltdb.NewManagerFromConfig(boltdb.Config{Path: path.Join(dir, "detka.db")})
+		manager.Start()
+		dbStore = store.NewBoltStore(nil, manager).(*store.BoltStore)
+		Expect(dbStore.IsConnected()).To(Equal(true))
+	})
+
+	AfterEach(func() {
+		dbStore.Stop()
+		os.RemoveAll(dir)
+	})
+
+	It("should index messages by status and created time", func() {
+		start := time.Now()
+		msg := models.Message{To: "devs@mailgun.net", Status: "NEW"}
+		Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+		Expect(dbStore.UpdateMessage(context.Background(), msg.Id, map[string]interface{}{"Status": "SENT"})).To(BeNil())
+
+		ids, err := dbStore.MessagesByStatus(context.Background(), "NEW")
+		Expect(err).To(BeNil())
+		Expect(ids).To(BeEmpty())
+
+		ids, err = dbStore.MessagesByStatus(context.Background(), "SENT")
+		Expect(err).To(BeNil())
+		Expect(ids).To(Equal([]string{msg.Id}))
+
+		ids, err = dbStore.MessagesCreatedBetween(context.Background(), start, time.Now())
+		Expect(err).To(BeNil())
+		Expect(ids).To(Equal([]string{msg.Id}))
+
+		_, err = dbStore.GetMessage(context.Background(), "no-such-id")
+		Expect(store.IsNotFound(err)).To(Equal(true))
+	})
+
+	It("should backup the database while it is open", func() {
+		msg := models.Message{Id: "id-1", Status: "NEW"}
+		Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+
+		backup := path.Join(dir, "backup.db")
+		Expect(dbStore.Backup(backup)).To(BeNil())
+
+		db, err := bolt.Open(backup, 0600, &bolt.Options{ReadOnly: true})
+		Expect(err).To(BeNil())
+		defer db.Close()
+		db.View(func(tx *bolt.Tx) error {
+			Expect(tx.Bucket(boltdb.MessagesBucket).Get([]byte("id-1"))).NotTo(BeNil())
+			return nil
+		})
+	})
+})
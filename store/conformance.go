@@ -0,0 +1,561 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thrawn01/detka/models"
+	"golang.org/x/net/context"
+)
+
+// The store under test and how to interrupt its connection
+type ConformanceTarget struct {
+	Store Store
+	// Simulate losing the connection to the database, the checks that need it are
+	// skipped if Disconnect or Reconnect is nil
+	Disconnect func()
+	// Restore the connection, messages inserted before Disconnect() must still exist
+	Reconnect func()
+	// Called after the store is stopped if not nil, IE: to drop the test database
+	Cleanup func()
+}
+
+// A check every Store implementation must pass
+type ConformanceTest struct {
+	Name string
+	Run  func(ConformanceTarget) error
+}
+
+// Returns the checks that describe how a Store must behave, so new implementations behave exactly
+// like RethinkStore. Each test should be run against a new, empty store. IE:
+//
+//	for _, test := range store.ConformanceTests() {
+//		test := test
+//		It(test.Name, func() {
+//			Expect(test.Run(newTarget())).To(BeNil())
+//		})
+//	}
+func ConformanceTests() []ConformanceTest {
+	return []ConformanceTest{
+		{"InsertMessage should assign an id when empty", conformInsertAssignsId},
+		{"InsertMessage should keep the provided id", conformInsertKeepsId},
+		{"InsertMessage should not replace an existing message", conformInsertDuplicate},
+		{"GetMessage should return the inserted message", conformGet},
+		{"GetMessage should return a not found error for a missing id", conformGetNotFound},
+		{"UpdateMessage should update the fields by struct field name", conformUpdate},
+		{"UpdateMessage should return a not found error for a missing id", conformUpdateNotFound},
+		{"UpdateMessageIf should only update the expected version", conformUpdateIf},
+		{"UpdateMessageIf should allow a single concurrent update of a version", conformUpdateIfConcurrent},
+		{"Store should be safe for concurrent use", conformConcurrent},
+		{"Store should return connection errors until reconnected", conformReconnect},
+		{"Store should return a timeout error once the context is done", conformCancelled},
+		{"Expirer should return and delete messages inserted before a time", conformExpire},
+		{"Scanner should return the messages in pages ordered by id", conformScan},
+		{"RecipientIndex should return the messages addressed to a recipient", conformRecipientIndex},
+	}
+}
+
+func newConformanceMessage(id string) models.Message {
+	return models.Message{
+		Id:       id,
+		Subject:  "Hello",
+		Text:     "Testing some Mailgun awesomeness!",
+		From:     "Excited User <excited@samples.mailgun.org>",
+		To:       "devs@mailgun.net",
+		Status:   "NEW",
+		Priority: models.PriorityNormal,
+		Account:  "account-1",
+	}
+}
+
+// Compares every field but the RecipientKeys, which are set by the store
+func sameMessage(a, b models.Message) bool {
+	a.RecipientKeys, b.RecipientKeys = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// Returns the message with an offloaded body read back into Text, see OffloadStore
+func getWithBody(dbStore Store, id string) (*models.Message, error) {
+	message, err := dbStore.GetMessage(context.Background(), id)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetMessage()")
+	}
+	opener, ok := dbStore.(BodyOpener)
+	if message.BodyRef == "" || !ok {
+		return message, nil
+	}
+
+	reader, err := opener.OpenBody(context.Background(), message)
+	if err != nil {
+		return nil, errors.Wrap(err, "OpenBody()")
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "OpenBody()")
+	}
+	message.Text = string(content)
+	message.BodyRef, message.BodyChecksum = "", ""
+	return message, nil
+}
+
+func conformInsertAssignsId(target ConformanceTarget) error {
+	msg := newConformanceMessage("")
+	if err := target.Store.InsertMessage(context.Background(), &msg); err != nil {
+		return errors.Wrap(err, "InsertMessage()")
+	}
+	if msg.Id == "" {
+		return errors.New("InsertMessage() did not assign an id")
+	}
+	if _, err := target.Store.GetMessage(context.Background(), msg.Id); err != nil {
+		return errors.Wrap(err, "GetMessage() of the assigned id")
+	}
+	return nil
+}
+
+func conformInsertKeepsId(target ConformanceTarget) error {
+	msg := newConformanceMessage("conform-id-1")
+	if err := target.Store.InsertMessage(context.Background(), &msg); err != nil {
+		return errors.Wrap(err, "InsertMessage()")
+	}
+	if msg.Id != "conform-id-1" {
+		return errors.Errorf("InsertMessage() changed the id to '%s'", msg.Id)
+	}
+	return nil
+}
+
+func conformInsertDuplicate(target ConformanceTarget) error {
+	msg := newConformanceMessage("conform-id-1")
+	if err := target.Store.InsertMessage(context.Background(), &msg); err != nil {
+		return errors.Wrap(err, "InsertMessage()")
+	}
+
+	duplicate := newConformanceMessage("conform-id-1")
+	duplicate.Subject = "Duplicate"
+	err := target.Store.InsertMessage(context.Background(), &duplicate)
+	if err == nil {
+		return errors.New("InsertMessage() of a duplicate id should fail")
+	}
+	if IsNotFound(err) || IsConnectError(err) {
+		return errors.Errorf("InsertMessage() of a duplicate id returned the wrong kind - %s", err)
+	}
+
+	stored, err := target.Store.GetMessage(context.Background(), "conform-id-1")
+	if err != nil {
+		return errors.Wrap(err, "GetMessage()")
+	}
+	if stored.Subject != "Hello" {
+		return errors.New("InsertMessage() of a duplicate id replaced the existing message")
+	}
+	return nil
+}
+
+func conformGet(target ConformanceTarget) error {
+	msg := newConformanceMessage("conform-id-1")
+	if err := target.Store.InsertMessage(context.Background(), &msg); err != nil {
+		return errors.Wrap(err, "InsertMessage()")
+	}
+
+	stored, err := getWithBody(target.Store, "conform-id-1")
+	if err != nil {
+		return err
+	}
+	if !sameMessage(*stored, msg) {
+		return errors.Errorf("GetMessage() returned %+v expected %+v", *stored, msg)
+	}
+
+	// Modifying the result must not modify the store
+	stored.Status = "MODIFIED"
+	again, err := target.Store.GetMessage(context.Background(), "conform-id-1")
+	if err != nil {
+		return errors.Wrap(err, "GetMessage()")
+	}
+	if again.Status != "NEW" {
+		return errors.New("modifying the message returned by GetMessage() modified the store")
+	}
+	return nil
+}
+
+func conformGetNotFound(target ConformanceTarget) error {
+	_, err := target.Store.GetMessage(context.Background(), "conform-no-such-id")
+	if !IsNotFound(err) {
+		return errors.Errorf("GetMessage() expected a not found error got '%v'", err)
+	}
+	return nil
+}
+
+func conformUpdate(target ConformanceTarget) error {
+	msg := newConformanceMessage("conform-id-1")
+	if err := target.Store.InsertMessage(context.Background(), &msg); err != nil {
+		return errors.Wrap(err, "InsertMessage()")
+	}
+
+	// The worker updates messages using the struct field names
+	err := target.Store.UpdateMessage(context.Background(), "conform-id-1",
+		map[string]interface{}{"Status": "SENT"})
+	if err != nil {
+		return errors.Wrap(err, "UpdateMessage()")
+	}
+
+	stored, err := getWithBody(target.Store, "conform-id-1")
+	if err != nil {
+		return err
+	}
+	msg.Status = "SENT"
+	msg.Version = 2
+	if !sameMessage(*stored, msg) {
+		return errors.Errorf("UpdateMessage() resulted in %+v expected %+v", *stored, msg)
+	}
+	return nil
+}
+
+func conformUpdateIf(target ConformanceTarget) error {
+	msg := newConformanceMessage("conform-id-1")
+	if err := target.Store.InsertMessage(context.Background(), &msg); err != nil {
+		return errors.Wrap(err, "InsertMessage()")
+	}
+	if msg.Version != 1 {
+		return errors.Errorf("InsertMessage() should set the version to 1 got %d", msg.Version)
+	}
+
+	err := target.Store.UpdateMessageIf(context.Background(), "conform-id-1", 1,
+		map[string]interface{}{"Status": "SENDING"})
+	if err != nil {
+		return errors.Wrap(err, "UpdateMessageIf()")
+	}
+
+	// A second update of the same version must conflict
+	err = target.Store.UpdateMessageIf(context.Background(), "conform-id-1", 1,
+		map[string]interface{}{"Status": "BOUNCED"})
+	if !IsConflict(err) {
+		return errors.Errorf("UpdateMessageIf() of a stale version expected a conflict error got '%v'", err)
+	}
+
+	stored, err := target.Store.GetMessage(context.Background(), "conform-id-1")
+	if err != nil {
+		return errors.Wrap(err, "GetMessage()")
+	}
+	if stored.Status != "SENDING" || stored.Version != 2 {
+		return errors.Errorf("UpdateMessageIf() resulted in status '%s' version %d expected 'SENDING' 2",
+			stored.Status, stored.Version)
+	}
+
+	err = target.Store.UpdateMessageIf(context.Background(), "conform-no-such-id", 1,
+		map[string]interface{}{"Status": "SENDING"})
+	if !IsNotFound(err) {
+		return errors.Errorf("UpdateMessageIf() expected a not found error got '%v'", err)
+	}
+	return nil
+}
+
+func conformUpdateIfConcurrent(target ConformanceTarget) error {
+	msg := newConformanceMessage("conform-id-1")
+	if err := target.Store.InsertMessage(context.Background(), &msg); err != nil {
+		return errors.Wrap(err, "InsertMessage()")
+	}
+
+	// Only one of the claims may succeed
+	const count = 10
+	var wg sync.WaitGroup
+	results := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- target.Store.UpdateMessageIf(context.Background(), "conform-id-1", msg.Version,
+				map[string]interface{}{"Status": "SENDING"})
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var claimed int
+	for err := range results {
+		if err == nil {
+			claimed++
+		} else if !IsConflict(err) {
+			return errors.Wrap(err, "UpdateMessageIf()")
+		}
+	}
+	if claimed != 1 {
+		return errors.Errorf("%d concurrent UpdateMessageIf() of the same version succeeded, expected 1", claimed)
+	}
+	return nil
+}
+
+func conformUpdateNotFound(target ConformanceTarget) error {
+	err := target.Store.UpdateMessage(context.Background(), "conform-no-such-id",
+		map[string]interface{}{"Status": "SENT"})
+	if !IsNotFound(err) {
+		return errors.Errorf("UpdateMessage() expected a not found error got '%v'", err)
+	}
+	return nil
+}
+
+func conformConcurrent(target ConformanceTarget) error {
+	const count = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			msg := newConformanceMessage(id)
+			if err := target.Store.InsertMessage(context.Background(), &msg); err != nil {
+				errs <- errors.Wrap(err, "InsertMessage()")
+				return
+			}
+			err := target.Store.UpdateMessage(context.Background(), id,
+				map[string]interface{}{"Status": "SENT"})
+			if err != nil {
+				errs <- errors.Wrap(err, "UpdateMessage()")
+				return
+			}
+			if _, err := target.Store.GetMessage(context.Background(), id); err != nil {
+				errs <- errors.Wrap(err, "GetMessage()")
+			}
+		}(fmt.Sprintf("conform-id-%d", i))
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		stored, err := target.Store.GetMessage(context.Background(), fmt.Sprintf("conform-id-%d", i))
+		if err != nil {
+			return errors.Wrap(err, "GetMessage()")
+		}
+		if stored.Status != "SENT" {
+			return errors.Errorf("message %s has status '%s' expected 'SENT'", stored.Id, stored.Status)
+		}
+	}
+	return nil
+}
+
+func conformReconnect(target ConformanceTarget) error {
+	if target.Disconnect == nil || target.Reconnect == nil {
+		return nil
+	}
+
+	msg := newConformanceMessage("conform-id-1")
+	if err := target.Store.InsertMessage(context.Background(), &msg); err != nil {
+		return errors.Wrap(err, "InsertMessage()")
+	}
+
+	target.Disconnect()
+	if target.Store.IsConnected() {
+		return errors.New("IsConnected() should be false while disconnected")
+	}
+	if _, err := target.Store.GetMessage(context.Background(), "conform-id-1"); !IsConnectError(err) {
+		return errors.Errorf("GetMessage() expected a connection error got '%v'", err)
+	}
+	other := newConformanceMessage("conform-id-2")
+	if err := target.Store.InsertMessage(context.Background(), &other); !IsConnectError(err) {
+		return errors.Errorf("InsertMessage() expected a connection error got '%v'", err)
+	}
+	err := target.Store.UpdateMessage(context.Background(), "conform-id-1",
+		map[string]interface{}{"Status": "SENT"})
+	if !IsConnectError(err) {
+		return errors.Errorf("UpdateMessage() expected a connection error got '%v'", err)
+	}
+
+	target.Reconnect()
+	if !target.Store.IsConnected() {
+		return errors.New("IsConnected() should be true once reconnected")
+	}
+	if _, err := target.Store.GetMessage(context.Background(), "conform-id-1"); err != nil {
+		return errors.Wrap(err, "GetMessage() after reconnect")
+	}
+	return nil
+}
+
+func conformCancelled(target ConformanceTarget) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := target.Store.GetMessage(ctx, "conform-id-1"); !IsTimeout(err) {
+		return errors.Errorf("GetMessage() expected a timeout error got '%v'", err)
+	}
+	msg := newConformanceMessage("conform-id-1")
+	if err := target.Store.InsertMessage(ctx, &msg); !IsTimeout(err) {
+		return errors.Errorf("InsertMessage() expected a timeout error got '%v'", err)
+	}
+	err := target.Store.UpdateMessage(ctx, "conform-id-1", map[string]interface{}{"Status": "SENT"})
+	if !IsTimeout(err) {
+		return errors.Errorf("UpdateMessage() expected a timeout error got '%v'", err)
+	}
+
+	// The cancelled insert must not have stored the message
+	if _, err := target.Store.GetMessage(context.Background(), "conform-id-1"); !IsNotFound(err) {
+		return errors.Errorf("GetMessage() expected a not found error got '%v'", err)
+	}
+	return nil
+}
+
+// Skipped if the store is not an Expirer
+func conformExpire(target ConformanceTarget) error {
+	expirer, ok := target.Store.(Expirer)
+	if !ok {
+		return nil
+	}
+	ctx := context.Background()
+
+	for _, msg := range []models.Message{
+		{Id: "conform-id-1", Text: "body", Status: "DELIVERED"},
+		{Id: "conform-id-2", Status: "DELIVERED"},
+		{Id: "conform-id-3", Text: "body", Status: "NEW"},
+	} {
+		msg := msg
+		if err := target.Store.InsertMessage(ctx, &msg); err != nil {
+			return errors.Wrap(err, "InsertMessage()")
+		}
+		// Ensure each message has a distinct insert time
+		time.Sleep(time.Millisecond)
+	}
+	future := time.Now().Add(time.Minute)
+
+	expect := func(withBody bool, limit int, before time.Time, ids ...string) error {
+		messages, err := expirer.ExpiredMessages(ctx, "DELIVERED", before, withBody, limit)
+		if err != nil {
+			return errors.Wrap(err, "ExpiredMessages()")
+		}
+		var result []string
+		for _, message := range messages {
+			result = append(result, message.Id)
+		}
+		if fmt.Sprint(result) != fmt.Sprint(ids) {
+			return errors.Errorf("ExpiredMessages(withBody: %t, limit: %d) expected %v got %v",
+				withBody, limit, ids, result)
+		}
+		return nil
+	}
+	if err := expect(false, 10, future, "conform-id-1", "conform-id-2"); err != nil {
+		return err
+	}
+	if err := expect(false, 1, future, "conform-id-1"); err != nil {
+		return err
+	}
+	if err := expect(true, 10, future, "conform-id-1"); err != nil {
+		return err
+	}
+	if err := expect(false, 10, time.Now().Add(-time.Minute)); err != nil {
+		return err
+	}
+
+	if err := expirer.DeleteMessages(ctx, []string{"conform-id-1", "conform-id-missing"}); err != nil {
+		return errors.Wrap(err, "DeleteMessages()")
+	}
+	if _, err := target.Store.GetMessage(ctx, "conform-id-1"); !IsNotFound(err) {
+		return errors.Errorf("GetMessage() of a deleted message expected a not found error got '%v'", err)
+	}
+	return expect(false, 10, future, "conform-id-2")
+}
+
+// Skipped if the store is not a Scanner
+func conformScan(target ConformanceTarget) error {
+	scanner, ok := target.Store.(Scanner)
+	if !ok {
+		return nil
+	}
+	ctx := context.Background()
+
+	for _, id := range []string{"conform-id-2", "conform-id-3", "conform-id-1"} {
+		msg := newConformanceMessage(id)
+		if err := target.Store.InsertMessage(ctx, &msg); err != nil {
+			return errors.Wrap(err, "InsertMessage()")
+		}
+	}
+
+	var result []string
+	for after := ""; ; {
+		messages, err := scanner.ScanMessages(ctx, after, 2)
+		if err != nil {
+			return errors.Wrap(err, "ScanMessages()")
+		}
+		if len(messages) == 0 {
+			break
+		}
+		for _, message := range messages {
+			if message.Subject != "Hello" {
+				return errors.Errorf("ScanMessages() returned subject '%s' for id '%s'",
+					message.Subject, message.Id)
+			}
+			result = append(result, message.Id)
+		}
+		after = messages[len(messages)-1].Id
+	}
+
+	expected := []string{"conform-id-1", "conform-id-2", "conform-id-3"}
+	if fmt.Sprint(result) != fmt.Sprint(expected) {
+		return errors.Errorf("ScanMessages() expected %v got %v", expected, result)
+	}
+	return nil
+}
+
+// Skipped if the store is not a RecipientIndex
+func conformRecipientIndex(target ConformanceTarget) error {
+	index, ok := target.Store.(RecipientIndex)
+	if !ok {
+		return nil
+	}
+	ctx := context.Background()
+
+	for id, to := range map[string]string{
+		"conform-id-1": "Devs <DEVS@mailgun.net>, ops@mailgun.net",
+		"conform-id-2": "devs@mailgun.net",
+		"conform-id-3": "ops@mailgun.net",
+	} {
+		msg := newConformanceMessage(id)
+		msg.To = to
+		if err := target.Store.InsertMessage(ctx, &msg); err != nil {
+			return errors.Wrap(err, "InsertMessage()")
+		}
+	}
+
+	expect := func(recipient string, limit int, ids ...string) error {
+		messages, err := index.MessagesByRecipient(ctx, recipient, limit)
+		if err != nil {
+			return errors.Wrap(err, "MessagesByRecipient()")
+		}
+		var result []string
+		for _, message := range messages {
+			if message.Subject != "Hello" {
+				return errors.Errorf("MessagesByRecipient() returned subject '%s' for id '%s'",
+					message.Subject, message.Id)
+			}
+			result = append(result, message.Id)
+		}
+		if fmt.Sprint(result) != fmt.Sprint(ids) {
+			return errors.Errorf("MessagesByRecipient('%s', limit: %d) expected %v got %v",
+				recipient, limit, ids, result)
+		}
+		return nil
+	}
+	if err := expect("devs@mailgun.net", 10, "conform-id-1", "conform-id-2"); err != nil {
+		return err
+	}
+	if err := expect("Devs <Devs@Mailgun.net>", 1, "conform-id-1"); err != nil {
+		return err
+	}
+	if err := expect("nobody@mailgun.net", 10); err != nil {
+		return err
+	}
+
+	// Updating the recipients must update the index
+	err := target.Store.UpdateMessage(ctx, "conform-id-1", map[string]interface{}{"To": "ops@mailgun.net"})
+	if err != nil {
+		return errors.Wrap(err, "UpdateMessage()")
+	}
+	if err := expect("devs@mailgun.net", 10, "conform-id-2"); err != nil {
+		return err
+	}
+	return expect("ops@mailgun.net", 10, "conform-id-1", "conform-id-3")
+}
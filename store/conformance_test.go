@@ -0,0 +1,160 @@
+package store_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/blob"
+	"github.com/thrawn01/detka/boltdb"
+	"github.com/thrawn01/detka/envelope"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/rethink"
+	"github.com/thrawn01/detka/sqldb"
+	"github.com/thrawn01/detka/store"
+	"gopkg.in/gorethink/gorethink.v3"
+)
+
+// Run the conformance tests against a new target for each test
+func conformance(newTarget func(dir string) store.ConformanceTarget) {
+	var dir string
+	var target store.ConformanceTarget
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-conformance")
+		Expect(err).To(BeNil())
+		target = newTarget(dir)
+	})
+
+	AfterEach(func() {
+		// Nil if the test was skipped
+		if target.Store != nil {
+			target.Store.Stop()
+		}
+		if target.Cleanup != nil {
+			target.Cleanup()
+		}
+		target = store.ConformanceTarget{}
+		os.RemoveAll(dir)
+	})
+
+	for _, test := range store.ConformanceTests() {
+		test := test
+		It(test.Name, func() {
+			Expect(test.Run(target)).To(BeNil())
+		})
+	}
+}
+
+var _ = Describe("Conformance", func() {
+	Describe("MemoryStore", func() {
+		conformance(func(string) store.ConformanceTarget {
+			dbStore := store.NewMemoryStore()
+			return store.ConformanceTarget{
+				Store:      dbStore,
+				Disconnect: func() { dbStore.SetConnected(false) },
+				Reconnect:  func() { dbStore.SetConnected(true) },
+			}
+		})
+	})
+
+	Describe("EncryptedStore", func() {
+		conformance(func(dir string) store.ConformanceTarget {
+			master, err := envelope.NewLocalKMS(dir)
+			Expect(err).To(BeNil())
+			memStore := store.NewMemoryStore()
+			return store.ConformanceTarget{
+				Store:      store.NewEncryptedStore(memStore, master, 0),
+				Disconnect: func() { memStore.SetConnected(false) },
+				Reconnect:  func() { memStore.SetConnected(true) },
+			}
+		})
+	})
+
+	Describe("OffloadStore", func() {
+		conformance(func(dir string) store.ConformanceTarget {
+			blobs, err := blob.NewFileStore(dir)
+			Expect(err).To(BeNil())
+			memStore := store.NewMemoryStore()
+			return store.ConformanceTarget{
+				Store:      store.NewOffloadStore(memStore, blobs, 10),
+				Disconnect: func() { memStore.SetConnected(false) },
+				Reconnect:  func() { memStore.SetConnected(true) },
+			}
+		})
+	})
+
+	Describe("RethinkStore", func() {
+		BeforeEach(func() {
+			if os.Getenv("DETKA_DOCKER_HOST") == "" {
+				Skip("DETKA_DOCKER_HOST not set, skipped....")
+			}
+		})
+
+		conformance(func(string) store.ConformanceTarget {
+			parser := args.NewParser()
+			parser.AddOption("--rethink-auto-create").IsBool().Default("true")
+			parser.AddOption("--rethink-endpoints").IsStringSlice()
+			parser.AddOption("--rethink-db")
+			opts, err := parser.ParseArgs(nil)
+			Expect(err).To(BeNil())
+
+			// Each test gets an empty database
+			db := "detka_conformance_" + models.NewId()
+			opts.Set("rethink-endpoints", fmt.Sprintf("%s:28015", os.Getenv("DETKA_DOCKER_HOST")))
+			opts.Set("rethink-db", db)
+			parser.Apply(opts)
+
+			manager := rethink.NewManager(parser)
+			return store.ConformanceTarget{
+				Store:      store.NewRethinkStore(parser, manager),
+				Disconnect: manager.Stop,
+				Reconnect:  manager.Start,
+				Cleanup: func() {
+					session, err := rethink.Connect(parser.GetOpts())
+					Expect(err).To(BeNil())
+					defer session.Close()
+					_, err = gorethink.DBDrop(db).RunWrite(session)
+					Expect(err).To(BeNil())
+				},
+			}
+		})
+	})
+
+	Describe("SQLStore", func() {
+		conformance(func(dir string) store.ConformanceTarget {
+			manager, err := sqldb.NewManagerFromConfig(sqldb.Config{
+				Dialect:     sqldb.SQLite,
+				DSN:         path.Join(dir, "detka.db"),
+				AutoMigrate: true,
+			})
+			Expect(err).To(BeNil())
+			manager.Start()
+
+			dbStore, err := store.NewSQLStore(nil, manager)
+			Expect(err).To(BeNil())
+			return store.ConformanceTarget{
+				Store:      dbStore,
+				Disconnect: manager.Stop,
+				Reconnect:  manager.Start,
+			}
+		})
+	})
+
+	Describe("BoltStore", func() {
+		conformance(func(dir string) store.ConformanceTarget {
+			manager := boltdb.NewManagerFromConfig(boltdb.Config{Path: path.Join(dir, "detka.db")})
+			manager.Start()
+			return store.ConformanceTarget{
+				Store:      store.NewBoltStore(nil, manager),
+				Disconnect: manager.Stop,
+				Reconnect:  manager.Start,
+			}
+		})
+	})
+})
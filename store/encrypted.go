@@ -0,0 +1,365 @@
+package store
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/detka/envelope"
+	"github.com/thrawn01/detka/models"
+	"golang.org/x/net/context"
+)
+
+// Maps the struct and json names of the encrypted models.Message fields to the struct name
+var encryptedFields = map[string]string{
+	"Subject": "Subject", "subject": "Subject",
+	"Text": "Text", "text": "Text",
+	"To": "To", "recipients": "To",
+}
+
+// The number of messages Rotate() re-encrypts at a time
+const rotateBatchSize = 100
+
+// Encrypts the subject, text and recipients of messages before they reach the wrapped store and
+// decrypts them on the way out. Each value is encrypted with a new data key wrapped by the master
+// key, and bound to the message id so values can't be moved between messages. Empty values and
+// the other fields are stored as is, plaintext values written before encryption was enabled are
+// returned as is until Rotate() encrypts them. Recipients are indexed by their envelope.BlindIndex()
+// so MessagesByRecipient() works without decrypting every message
+type EncryptedStore struct {
+	store  Store
+	master envelope.MasterKey
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Adds the Expirer methods when the wrapped store is an Expirer
+type encryptedExpirer struct {
+	*EncryptedStore
+	expirer Expirer
+}
+
+// Wrap 'dbStore' such that messages are encrypted at rest. If 'rotateInterval' is not zero and the
+// store is a Scanner, every interval values not encrypted by the current master key are re-encrypted
+func NewEncryptedStore(dbStore Store, master envelope.MasterKey, rotateInterval time.Duration) Store {
+	self := &EncryptedStore{
+		store:  dbStore,
+		master: master,
+		done:   make(chan struct{}),
+	}
+	if _, ok := dbStore.(Scanner); ok && rotateInterval > 0 {
+		self.wg.Add(1)
+		go self.rotateLoop(rotateInterval)
+	}
+
+	if expirer, ok := dbStore.(Expirer); ok {
+		return &encryptedExpirer{EncryptedStore: self, expirer: expirer}
+	}
+	return self
+}
+
+func (self *EncryptedStore) MasterKey() envelope.MasterKey {
+	return self.master
+}
+
+func (self *EncryptedStore) GetMessage(ctx context.Context, id string) (*models.Message, error) {
+	message, err := self.store.GetMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.decrypt(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (self *EncryptedStore) InsertMessage(ctx context.Context, msg *models.Message) error {
+	if len(msg.Id) == 0 {
+		msg.Id = models.NewId()
+	}
+
+	encrypted := *msg
+	encrypted.RecipientKeys = self.recipientKeys(msg.To)
+	for name, field := range map[string]*string{"Subject": &encrypted.Subject, "Text": &encrypted.Text,
+		"To": &encrypted.To} {
+		if *field == "" {
+			continue
+		}
+		value, err := envelope.Encrypt(self.master, *field, msg.Id+"/"+name)
+		if err != nil {
+			return FromError(internalErr, err, "while encrypting '%s' of message id - %s", name, msg.Id)
+		}
+		*field = value
+	}
+
+	if err := self.store.InsertMessage(ctx, &encrypted); err != nil {
+		return err
+	}
+	msg.Version = encrypted.Version
+	return nil
+}
+
+func (self *EncryptedStore) UpdateMessage(ctx context.Context, id string, fields map[string]interface{}) error {
+	encrypted, err := self.encryptFields(id, fields)
+	if err != nil {
+		return err
+	}
+	return self.store.UpdateMessage(ctx, id, encrypted)
+}
+
+func (self *EncryptedStore) UpdateMessageIf(ctx context.Context, id string, version int,
+	fields map[string]interface{}) error {
+	encrypted, err := self.encryptFields(id, fields)
+	if err != nil {
+		return err
+	}
+	return self.store.UpdateMessageIf(ctx, id, version, encrypted)
+}
+
+func (self *EncryptedStore) MessagesByRecipient(ctx context.Context, recipient string,
+	limit int) ([]models.Message, error) {
+	index, ok := self.store.(recipientKeyIndex)
+	if !ok {
+		return nil, NewError(internalErr, "MessagesByRecipient() the store has no recipient index")
+	}
+	key := envelope.BlindIndex(self.master, models.RecipientKey(recipient))
+	messages, err := index.messagesByRecipientKey(ctx, key, limit)
+	if err != nil {
+		return nil, err
+	}
+	return messages, self.decryptAll(messages)
+}
+
+func (self *EncryptedStore) ScanMessages(ctx context.Context, after string, limit int) ([]models.Message, error) {
+	scanner, ok := self.store.(Scanner)
+	if !ok {
+		return nil, NewError(internalErr, "ScanMessages() the store can't list messages")
+	}
+	messages, err := scanner.ScanMessages(ctx, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return messages, self.decryptAll(messages)
+}
+
+func (self *EncryptedStore) DeleteMessages(ctx context.Context, ids []string) error {
+	deleter, ok := self.store.(Deleter)
+	if !ok {
+		return NewError(internalErr, "DeleteMessages() the store can't delete messages")
+	}
+	return deleter.DeleteMessages(ctx, ids)
+}
+
+// The body is read and decrypted before it is returned, encrypted bodies can't be streamed
+func (self *EncryptedStore) OpenBody(ctx context.Context, msg *models.Message) (io.ReadCloser, error) {
+	opener, ok := self.store.(BodyOpener)
+	if !ok || msg.BodyRef == "" {
+		return ioutil.NopCloser(strings.NewReader(msg.Text)), nil
+	}
+	reader, err := opener.OpenBody(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, blobError(ctx, err, "while reading the body of message id - %s", msg.Id)
+	}
+	plaintext, err := envelope.Decrypt(self.master, string(content), msg.Id+"/Text")
+	if err != nil {
+		return nil, FromError(internalErr, err, "while decrypting the body of message id - %s", msg.Id)
+	}
+	return ioutil.NopCloser(strings.NewReader(plaintext)), nil
+}
+
+func (self *EncryptedStore) SignalReconnect() {
+	self.store.SignalReconnect()
+}
+
+func (self *EncryptedStore) Reconfigure() {
+	Reconfigure(self.store)
+}
+
+func (self *EncryptedStore) Diagnose() map[string]string {
+	return Diagnose(self.store)
+}
+
+func (self *EncryptedStore) IsConnected() bool {
+	return self.store.IsConnected()
+}
+
+func (self *EncryptedStore) Stop() {
+	close(self.done)
+	self.wg.Wait()
+	self.store.Stop()
+}
+
+// Re-encrypt the values that are plaintext or not encrypted by the current master key, returns
+// the number of messages updated. A message updated while it is re-encrypted is left for the
+// next call
+func (self *EncryptedStore) Rotate(ctx context.Context) (int, error) {
+	scanner, ok := self.store.(Scanner)
+	if !ok {
+		return 0, NewError(internalErr, "Rotate() the store can't list messages")
+	}
+
+	var count int
+	var after string
+	for {
+		batchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		messages, err := scanner.ScanMessages(batchCtx, after, rotateBatchSize)
+		if err != nil {
+			cancel()
+			return count, err
+		}
+
+		for _, message := range messages {
+			fields, err := self.stale(&message)
+			if err != nil {
+				cancel()
+				return count, err
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			err = self.store.UpdateMessageIf(batchCtx, message.Id, message.Version, fields)
+			if err != nil {
+				if IsConflict(err) || IsNotFound(err) {
+					continue
+				}
+				cancel()
+				return count, err
+			}
+			count++
+		}
+		cancel()
+
+		if len(messages) < rotateBatchSize {
+			return count, nil
+		}
+		after = messages[len(messages)-1].Id
+	}
+}
+
+func (self *EncryptedStore) rotateLoop(interval time.Duration) {
+	defer self.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-self.done
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		count, err := self.Rotate(ctx)
+		if err != nil && ctx.Err() == nil {
+			logrus.WithFields(logrus.Fields{
+				"method": "EncryptedStore.Rotate()",
+				"type":   "store",
+			}).Error(err.Error())
+		} else if count != 0 {
+			logrus.Infof("Re-encrypted %d messages with master key '%s'", count, self.master.KeyId())
+		}
+		select {
+		case <-ticker.C:
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// Returns the re-encrypted values of the message that are not encrypted by the current master key
+func (self *EncryptedStore) stale(message *models.Message) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	current := self.master.KeyId()
+	for name, value := range map[string]string{"Subject": message.Subject, "Text": message.Text,
+		"To": message.To} {
+		if value == "" || envelope.KeyIdOf(value) == current {
+			continue
+		}
+		plaintext, err := envelope.Decrypt(self.master, value, message.Id+"/"+name)
+		if err != nil {
+			return nil, FromError(internalErr, err, "while decrypting '%s' of message id - %s",
+				name, message.Id)
+		}
+		encrypted, err := envelope.Encrypt(self.master, plaintext, message.Id+"/"+name)
+		if err != nil {
+			return nil, FromError(internalErr, err, "while encrypting '%s' of message id - %s",
+				name, message.Id)
+		}
+		result[name] = encrypted
+		if name == "To" {
+			result["RecipientKeys"] = self.recipientKeys(plaintext)
+		}
+	}
+	return result, nil
+}
+
+func (self *EncryptedStore) decryptAll(messages []models.Message) error {
+	for i := range messages {
+		if err := self.decrypt(&messages[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *EncryptedStore) decrypt(message *models.Message) error {
+	for name, field := range map[string]*string{"Subject": &message.Subject, "Text": &message.Text,
+		"To": &message.To} {
+		plaintext, err := envelope.Decrypt(self.master, *field, message.Id+"/"+name)
+		if err != nil {
+			return FromError(internalErr, err, "while decrypting '%s' of message id - %s",
+				name, message.Id)
+		}
+		*field = plaintext
+	}
+	return nil
+}
+
+// Returns a copy of the fields with the encrypted fields encrypted
+func (self *EncryptedStore) encryptFields(id string, fields map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		name, ok := encryptedFields[key]
+		plaintext, isString := value.(string)
+		if !ok || !isString || plaintext == "" {
+			result[key] = value
+			continue
+		}
+		encrypted, err := envelope.Encrypt(self.master, plaintext, id+"/"+name)
+		if err != nil {
+			return nil, FromError(internalErr, err, "while encrypting '%s' of message id - %s", name, id)
+		}
+		result[key] = encrypted
+		if _, ok := fields["RecipientKeys"]; !ok && name == "To" {
+			result["RecipientKeys"] = self.recipientKeys(plaintext)
+		}
+	}
+	return result, nil
+}
+
+// Returns the blind index of each recipient in 'to'
+func (self *EncryptedStore) recipientKeys(to string) []string {
+	var result []string
+	for _, key := range models.RecipientKeys(to) {
+		result = append(result, envelope.BlindIndex(self.master, key))
+	}
+	return result
+}
+
+func (self *encryptedExpirer) ExpiredMessages(ctx context.Context, status string, before time.Time,
+	withBody bool, limit int) ([]models.Message, error) {
+	messages, err := self.expirer.ExpiredMessages(ctx, status, before, withBody, limit)
+	if err != nil {
+		return nil, err
+	}
+	return messages, self.decryptAll(messages)
+}
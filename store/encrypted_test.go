@@ -0,0 +1,102 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/envelope"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+type rotator interface {
+	Rotate(context.Context) (int, error)
+}
+
+var _ = Describe("EncryptedStore", func() {
+	var dir string
+	var master *envelope.LocalKMS
+	var memStore *store.MemoryStore
+	var dbStore store.Store
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-encrypted")
+		Expect(err).To(BeNil())
+		master, err = envelope.NewLocalKMS(dir)
+		Expect(err).To(BeNil())
+		memStore = store.NewMemoryStore()
+		dbStore = store.NewEncryptedStore(memStore, master, 0)
+	})
+
+	AfterEach(func() {
+		dbStore.Stop()
+		os.RemoveAll(dir)
+	})
+
+	It("should store the subject, text and recipients encrypted", func() {
+		msg := models.Message{Id: "id-1", Subject: "Hello", Text: "Secret", To: "devs@mailgun.net",
+			Status: "NEW"}
+		Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+		Expect(dbStore.UpdateMessage(context.Background(), "id-1",
+			map[string]interface{}{"text": "Updated"})).To(BeNil())
+
+		stored, err := memStore.GetMessage(context.Background(), "id-1")
+		Expect(err).To(BeNil())
+		for _, value := range []string{stored.Subject, stored.Text, stored.To} {
+			Expect(envelope.KeyIdOf(value)).To(Equal(master.KeyId()))
+		}
+		Expect(stored.Status).To(Equal("NEW"))
+
+		read, err := dbStore.GetMessage(context.Background(), "id-1")
+		Expect(err).To(BeNil())
+		Expect(read.Subject).To(Equal("Hello"))
+		Expect(read.Text).To(Equal("Updated"))
+		Expect(read.To).To(Equal("devs@mailgun.net"))
+	})
+
+	It("should re-encrypt plaintext and old keys when rotated", func() {
+		legacy := models.Message{Id: "id-1", Subject: "Hello", To: "devs@mailgun.net"}
+		Expect(memStore.InsertMessage(context.Background(), &legacy)).To(BeNil())
+		msg := models.Message{Id: "id-2", Text: "Secret"}
+		Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+		Expect(master.Rotate()).To(BeNil())
+
+		count, err := dbStore.(rotator).Rotate(context.Background())
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(2))
+
+		for _, id := range []string{"id-1", "id-2"} {
+			stored, err := memStore.GetMessage(context.Background(), id)
+			Expect(err).To(BeNil())
+			for _, value := range []string{stored.Subject, stored.Text, stored.To} {
+				if value != "" {
+					Expect(envelope.KeyIdOf(value)).To(Equal(master.KeyId()))
+				}
+			}
+		}
+		read, err := dbStore.GetMessage(context.Background(), "id-1")
+		Expect(err).To(BeNil())
+		Expect(read.Subject).To(Equal("Hello"))
+
+		// Nothing left to rotate
+		count, err = dbStore.(rotator).Rotate(context.Background())
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(0))
+	})
+
+	It("should not decrypt a value moved to another message", func() {
+		msg := models.Message{Id: "id-1", Text: "Secret"}
+		Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+		stored, err := memStore.GetMessage(context.Background(), "id-1")
+		Expect(err).To(BeNil())
+
+		moved := models.Message{Id: "id-2", Text: stored.Text}
+		Expect(memStore.InsertMessage(context.Background(), &moved)).To(BeNil())
+		_, err = dbStore.GetMessage(context.Background(), "id-2")
+		Expect(err).ToNot(BeNil())
+	})
+})
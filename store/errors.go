@@ -4,12 +4,15 @@ import (
 	"fmt"
 
 	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 )
 
 const (
 	internalErr   int = 1
 	notFoundErr   int = 2
 	connectionErr int = 3
+	timeoutErr    int = 4
+	conflictErr   int = 5
 )
 
 type StoreError struct {
@@ -37,6 +40,11 @@ func NewError(kind int, msg string, stuff ...interface{}) *StoreError {
 	}
 }
 
+// Create a new not found error, for Store implementations outside this package
+func NewNotFoundError(msg string, stuff ...interface{}) *StoreError {
+	return NewError(notFoundErr, msg, stuff...)
+}
+
 func GetStoreError(err error) *StoreError {
 	obj, ok := err.(*StoreError)
 	if !ok {
@@ -45,6 +53,11 @@ func GetStoreError(err error) *StoreError {
 	return obj
 }
 
+// Create a new connection error, for Store implementations outside this package
+func NewConnectError(msg string, stuff ...interface{}) *StoreError {
+	return NewError(connectionErr, msg, stuff...)
+}
+
 // Return true if the store error is a not found error
 func IsNotFound(err error) bool {
 	return GetStoreError(err).Kind == notFoundErr
@@ -54,3 +67,22 @@ func IsNotFound(err error) bool {
 func IsConnectError(err error) bool {
 	return GetStoreError(err).Kind == connectionErr
 }
+
+// Return true if the store error is a conflict, IE: the message was modified since it was read
+func IsConflict(err error) bool {
+	return GetStoreError(err).Kind == conflictErr
+}
+
+// Return true if the store error is a timeout, IE: the deadline of the context
+// expired or the context was cancelled before the store responded
+func IsTimeout(err error) bool {
+	return GetStoreError(err).Kind == timeoutErr
+}
+
+// Returns a timeout error if the context is done, else nil
+func ContextError(ctx context.Context, msg string, stuff ...interface{}) *StoreError {
+	if err := ctx.Err(); err != nil {
+		return FromError(timeoutErr, err, msg, stuff...)
+	}
+	return nil
+}
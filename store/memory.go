@@ -0,0 +1,321 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thrawn01/detka/models"
+	"golang.org/x/net/context"
+)
+
+// Method names accepted by MemoryStore.Fail()
+const (
+	MethodGetMessage          = "GetMessage"
+	MethodInsertMessage       = "InsertMessage"
+	MethodUpdateMessage       = "UpdateMessage"
+	MethodUpdateMessageIf     = "UpdateMessageIf"
+	MethodExpiredMessages     = "ExpiredMessages"
+	MethodDeleteMessages      = "DeleteMessages"
+	MethodScanMessages        = "ScanMessages"
+	MethodMessagesByRecipient = "MessagesByRecipient"
+)
+
+// A thread safe in-memory store with the same error semantics as RethinkStore, useful for
+// tests and development without rethinkdb. The connection state and errors returned by
+// each method can be controlled to exercise reconnect and retry paths
+type MemoryStore struct {
+	mutex      sync.Mutex
+	messages   map[string]models.Message
+	created    map[string]time.Time
+	recipients map[string][]string
+	connected  bool
+	reconnects int
+	failures   map[string][]error
+}
+
+// Create a new connected in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		messages:   make(map[string]models.Message),
+		created:    make(map[string]time.Time),
+		recipients: make(map[string][]string),
+		connected:  true,
+		failures:   make(map[string][]error),
+	}
+}
+
+func (self *MemoryStore) GetMessage(ctx context.Context, id string) (*models.Message, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.check(ctx, MethodGetMessage); err != nil {
+		return nil, err
+	}
+
+	message, ok := self.messages[id]
+	if !ok {
+		return nil, NewError(notFoundErr, "message id - %s not found", id)
+	}
+	// Return a copy so the caller can't modify what we store
+	return &message, nil
+}
+
+func (self *MemoryStore) InsertMessage(ctx context.Context, msg *models.Message) error {
+	if len(msg.Id) == 0 {
+		msg.Id = models.NewId()
+	}
+	if msg.Version == 0 {
+		msg.Version = 1
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.check(ctx, MethodInsertMessage); err != nil {
+		return err
+	}
+
+	if _, ok := self.messages[msg.Id]; ok {
+		return NewError(internalErr, "changed.Error != 0 - Duplicate primary key `id`: %s", msg.Id)
+	}
+	message := *msg
+	message.RecipientKeys = nil
+	self.messages[msg.Id] = message
+	self.created[msg.Id] = time.Now()
+	self.recipients[msg.Id] = recipientKeysOf(msg)
+	return nil
+}
+
+func (self *MemoryStore) UpdateMessage(ctx context.Context, id string, fields map[string]interface{}) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.check(ctx, MethodUpdateMessage); err != nil {
+		return err
+	}
+	return self.update(id, -1, fields)
+}
+
+func (self *MemoryStore) UpdateMessageIf(ctx context.Context, id string, version int,
+	fields map[string]interface{}) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.check(ctx, MethodUpdateMessageIf); err != nil {
+		return err
+	}
+	return self.update(id, version, fields)
+}
+
+// Apply the update if the message has 'version', any version if 'version' is negative
+func (self *MemoryStore) update(id string, version int, fields map[string]interface{}) error {
+	message, ok := self.messages[id]
+	if !ok {
+		return NewError(notFoundErr, "Message Id - %s not found", id)
+	}
+	if version >= 0 && message.Version != version {
+		return NewError(conflictErr, "Message Id - %s was modified since version %d", id, version)
+	}
+	fields = indexRecipientFields(fields)
+	if err := setFields(&message, fields); err != nil {
+		return err
+	}
+	if _, ok := fields["RecipientKeys"]; ok {
+		self.recipients[id], message.RecipientKeys = message.RecipientKeys, nil
+	}
+	message.Version++
+	self.messages[id] = message
+	return nil
+}
+
+func (self *MemoryStore) ScanMessages(ctx context.Context, after string, limit int) ([]models.Message, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.check(ctx, MethodScanMessages); err != nil {
+		return nil, err
+	}
+
+	var result []models.Message
+	for id, message := range self.messages {
+		if id > after {
+			result = append(result, message)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (self *MemoryStore) MessagesByRecipient(ctx context.Context, recipient string,
+	limit int) ([]models.Message, error) {
+	return self.messagesByRecipientKey(ctx, models.RecipientKey(recipient), limit)
+}
+
+func (self *MemoryStore) messagesByRecipientKey(ctx context.Context, key string,
+	limit int) ([]models.Message, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.check(ctx, MethodMessagesByRecipient); err != nil {
+		return nil, err
+	}
+
+	var result []models.Message
+	for id, message := range self.messages {
+		for _, recipient := range self.recipients[id] {
+			if recipient == key {
+				result = append(result, message)
+				break
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (self *MemoryStore) ExpiredMessages(ctx context.Context, status string, before time.Time,
+	withBody bool, limit int) ([]models.Message, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.check(ctx, MethodExpiredMessages); err != nil {
+		return nil, err
+	}
+
+	var result []models.Message
+	for id, message := range self.messages {
+		if message.Status != status || !self.created[id].Before(before) {
+			continue
+		}
+		if withBody && message.Text == "" && message.BodyRef == "" {
+			continue
+		}
+		result = append(result, message)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return self.created[result[i].Id].Before(self.created[result[j].Id])
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (self *MemoryStore) DeleteMessages(ctx context.Context, ids []string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.check(ctx, MethodDeleteMessages); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		delete(self.messages, id)
+		delete(self.created, id)
+		delete(self.recipients, id)
+	}
+	return nil
+}
+
+// Returns an injected failure, a timeout if the context is done or a
+// connection error if the store is disconnected
+func (self *MemoryStore) check(ctx context.Context, method string) error {
+	if err := ContextError(ctx, "%s()", method); err != nil {
+		return err
+	}
+	if !self.connected {
+		return NewError(connectionErr, "%s() Not Connected", method)
+	}
+
+	if failures := self.failures[method]; len(failures) != 0 {
+		self.failures[method] = failures[1:]
+		return failures[0]
+	}
+	return nil
+}
+
+// Counts the number of times a reconnect was signaled, the connection
+// state only changes when SetConnected() is called
+func (self *MemoryStore) SignalReconnect() {
+	self.mutex.Lock()
+	self.reconnects++
+	self.mutex.Unlock()
+}
+
+func (self *MemoryStore) IsConnected() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.connected
+}
+
+func (self *MemoryStore) Stop() {
+	self.SetConnected(false)
+}
+
+// Simulate losing or regaining the connection to the database, while disconnected
+// every method returns an error for which IsConnectError() is true
+func (self *MemoryStore) SetConnected(set bool) {
+	self.mutex.Lock()
+	self.connected = set
+	self.mutex.Unlock()
+}
+
+// Returns the number of times SignalReconnect() was called
+func (self *MemoryStore) Reconnects() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.reconnects
+}
+
+// The next 'times' calls to 'method' return 'err' without touching the stored messages
+func (self *MemoryStore) Fail(method string, times int, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := 0; i < times; i++ {
+		self.failures[method] = append(self.failures[method], err)
+	}
+}
+
+// Apply the update to the message, like rethink fields may be named by
+// either the struct field name or the json name
+func setFields(message *models.Message, fields map[string]interface{}) error {
+	value := reflect.ValueOf(message).Elem()
+	kind := value.Type()
+
+	for name, update := range fields {
+		found := false
+		for i := 0; i < kind.NumField(); i++ {
+			field := kind.Field(i)
+			tag := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name != field.Name && name != tag {
+				continue
+			}
+			found = true
+
+			// Convert the value the same way the database would
+			payload, err := json.Marshal(update)
+			if err != nil {
+				return FromError(internalErr, err, "json.Marshal() field '%s'", name)
+			}
+			target := reflect.New(field.Type)
+			if err := json.Unmarshal(payload, target.Interface()); err != nil {
+				return FromError(internalErr, err, "invalid value for field '%s'", name)
+			}
+			value.Field(i).Set(target.Elem())
+		}
+		if !found {
+			return NewError(internalErr, "unknown message field '%s'", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package store_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("MemoryStore", func() {
+	var dbStore *store.MemoryStore
+
+	BeforeEach(func() {
+		dbStore = store.NewMemoryStore()
+	})
+
+	Describe("UpdateMessage", func() {
+		It("should update fields by struct or json name", func() {
+			msg := models.Message{To: "devs@mailgun.net", Status: "NEW"}
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+			Expect(msg.Id).NotTo(BeEmpty())
+
+			Expect(dbStore.UpdateMessage(context.Background(), msg.Id, map[string]interface{}{"Status": "SENT"})).To(BeNil())
+			Expect(dbStore.UpdateMessage(context.Background(), msg.Id, map[string]interface{}{"recipients": "ops@mailgun.net"})).To(BeNil())
+
+			updated, err := dbStore.GetMessage(context.Background(), msg.Id)
+			Expect(err).To(BeNil())
+			Expect(updated.Status).To(Equal("SENT"))
+			Expect(updated.To).To(Equal("ops@mailgun.net"))
+		})
+
+		It("should return not found if the message doesn't exist", func() {
+			err := dbStore.UpdateMessage(context.Background(), "no-such-id", map[string]interface{}{"Status": "SENT"})
+			Expect(store.IsNotFound(err)).To(Equal(true))
+		})
+	})
+
+	Context("When disconnected", func() {
+		It("should return connection errors until reconnected", func() {
+			dbStore.SetConnected(false)
+			Expect(dbStore.IsConnected()).To(Equal(false))
+
+			_, err := dbStore.GetMessage(context.Background(), "id-1")
+			Expect(store.IsConnectError(err)).To(Equal(true))
+			Expect(store.IsConnectError(dbStore.InsertMessage(context.Background(), &models.Message{}))).To(Equal(true))
+
+			dbStore.SetConnected(true)
+			_, err = dbStore.GetMessage(context.Background(), "id-1")
+			Expect(store.IsNotFound(err)).To(Equal(true))
+		})
+	})
+
+	Describe("Fail", func() {
+		It("should return the injected error the requested number of times", func() {
+			dbStore.Fail(store.MethodInsertMessage, 2, store.NewConnectError("connection reset"))
+
+			msg := models.Message{Id: "id-1"}
+			Expect(store.IsConnectError(dbStore.InsertMessage(context.Background(), &msg))).To(Equal(true))
+			Expect(store.IsConnectError(dbStore.InsertMessage(context.Background(), &msg))).To(Equal(true))
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+
+			_, err := dbStore.GetMessage(context.Background(), "id-1")
+			Expect(err).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,308 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/detka/blob"
+	"github.com/thrawn01/detka/models"
+	"golang.org/x/net/context"
+)
+
+// Keeps the body of messages larger than the threshold in a blob store, the message only holds
+// the blob key and checksum. GetMessage() and MessagesByRecipient() return the message without
+// reading the body, use OpenBody() to stream it. ScanMessages() and ExpiredMessages() read the
+// body back into Text so re-encryption and retention archives see the whole message.
+//
+// Each write of a body uses a new blob key and the replaced blob is deleted once the message
+// is updated, so a failed write never leaves a message without its body. Two unconditional
+// updates of the same body racing each other may leave an unreferenced blob behind
+type OffloadStore struct {
+	store     Store
+	blobs     blob.Store
+	threshold int
+}
+
+// Adds the Expirer methods when the wrapped store is an Expirer
+type offloadExpirer struct {
+	*OffloadStore
+	expirer Expirer
+}
+
+// Wrap 'dbStore' such that bodies larger than 'threshold' bytes are written to 'blobs'
+func NewOffloadStore(dbStore Store, blobs blob.Store, threshold int) Store {
+	self := &OffloadStore{
+		store:     dbStore,
+		blobs:     blobs,
+		threshold: threshold,
+	}
+	if expirer, ok := dbStore.(Expirer); ok {
+		return &offloadExpirer{OffloadStore: self, expirer: expirer}
+	}
+	return self
+}
+
+func (self *OffloadStore) GetMessage(ctx context.Context, id string) (*models.Message, error) {
+	return self.store.GetMessage(ctx, id)
+}
+
+func (self *OffloadStore) InsertMessage(ctx context.Context, msg *models.Message) error {
+	if len(msg.Id) == 0 {
+		msg.Id = models.NewId()
+	}
+	if len(msg.Text) <= self.threshold {
+		return self.store.InsertMessage(ctx, msg)
+	}
+
+	stored := *msg
+	key, checksum, err := self.put(ctx, msg.Id, msg.Text)
+	if err != nil {
+		return err
+	}
+	stored.Text, stored.BodyRef, stored.BodyChecksum = "", key, checksum
+
+	if err := self.store.InsertMessage(ctx, &stored); err != nil {
+		self.delete(ctx, key)
+		return err
+	}
+	msg.Version = stored.Version
+	return nil
+}
+
+func (self *OffloadStore) UpdateMessage(ctx context.Context, id string, fields map[string]interface{}) error {
+	return self.update(ctx, id, fields, func(fields map[string]interface{}) error {
+		return self.store.UpdateMessage(ctx, id, fields)
+	})
+}
+
+func (self *OffloadStore) UpdateMessageIf(ctx context.Context, id string, version int,
+	fields map[string]interface{}) error {
+	return self.update(ctx, id, fields, func(fields map[string]interface{}) error {
+		return self.store.UpdateMessageIf(ctx, id, version, fields)
+	})
+}
+
+// If the fields update the body, write the body to a new blob when larger than the threshold
+// and delete the blob of the previous body once 'update' succeeds
+func (self *OffloadStore) update(ctx context.Context, id string, fields map[string]interface{},
+	update func(map[string]interface{}) error) error {
+	var name, text string
+	for _, key := range []string{"Text", "text"} {
+		if value, ok := fields[key].(string); ok {
+			name, text = key, value
+		}
+	}
+	if name == "" {
+		return update(fields)
+	}
+
+	current, err := self.store.GetMessage(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	result := make(map[string]interface{}, len(fields)+2)
+	for key, value := range fields {
+		result[key] = value
+	}
+	result["BodyRef"], result["BodyChecksum"] = "", ""
+	if len(text) > self.threshold {
+		key, checksum, err := self.put(ctx, id, text)
+		if err != nil {
+			return err
+		}
+		result[name], result["BodyRef"], result["BodyChecksum"] = "", key, checksum
+	}
+
+	if err := update(result); err != nil {
+		if key := result["BodyRef"].(string); key != "" {
+			self.delete(ctx, key)
+		}
+		return err
+	}
+	if current.BodyRef != "" {
+		self.delete(ctx, current.BodyRef)
+	}
+	return nil
+}
+
+// Returns a reader of the message body, the reader returns an error at the end of the
+// body if the body does not match its checksum
+func (self *OffloadStore) OpenBody(ctx context.Context, msg *models.Message) (io.ReadCloser, error) {
+	if msg.BodyRef == "" {
+		return ioutil.NopCloser(strings.NewReader(msg.Text)), nil
+	}
+	reader, err := self.blobs.Open(ctx, msg.BodyRef)
+	if err != nil {
+		return nil, blobError(ctx, err, "OpenBody() message id - %s", msg.Id)
+	}
+	return &checksumReader{
+		ReadCloser: reader,
+		hash:       sha256.New(),
+		expected:   msg.BodyChecksum,
+		id:         msg.Id,
+	}, nil
+}
+
+func (self *OffloadStore) MessagesByRecipient(ctx context.Context, recipient string,
+	limit int) ([]models.Message, error) {
+	index, ok := self.store.(RecipientIndex)
+	if !ok {
+		return nil, NewError(internalErr, "MessagesByRecipient() the store has no recipient index")
+	}
+	return index.MessagesByRecipient(ctx, recipient, limit)
+}
+
+func (self *OffloadStore) messagesByRecipientKey(ctx context.Context, key string,
+	limit int) ([]models.Message, error) {
+	index, ok := self.store.(recipientKeyIndex)
+	if !ok {
+		return nil, NewError(internalErr, "MessagesByRecipient() the store has no recipient index")
+	}
+	return index.messagesByRecipientKey(ctx, key, limit)
+}
+
+func (self *OffloadStore) ScanMessages(ctx context.Context, after string, limit int) ([]models.Message, error) {
+	scanner, ok := self.store.(Scanner)
+	if !ok {
+		return nil, NewError(internalErr, "ScanMessages() the store can't list messages")
+	}
+	messages, err := scanner.ScanMessages(ctx, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return messages, self.readBodies(ctx, messages)
+}
+
+// The blobs are deleted once the messages are, a failure leaves unreferenced blobs behind
+func (self *OffloadStore) DeleteMessages(ctx context.Context, ids []string) error {
+	deleter, ok := self.store.(Deleter)
+	if !ok {
+		return NewError(internalErr, "DeleteMessages() the store can't delete messages")
+	}
+
+	var keys []string
+	for _, id := range ids {
+		message, err := self.store.GetMessage(ctx, id)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if message.BodyRef != "" {
+			keys = append(keys, message.BodyRef)
+		}
+	}
+
+	if err := deleter.DeleteMessages(ctx, ids); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		self.delete(ctx, key)
+	}
+	return nil
+}
+
+func (self *OffloadStore) SignalReconnect() {
+	self.store.SignalReconnect()
+}
+
+func (self *OffloadStore) Reconfigure() {
+	Reconfigure(self.store)
+}
+
+func (self *OffloadStore) Diagnose() map[string]string {
+	return Diagnose(self.store)
+}
+
+func (self *OffloadStore) IsConnected() bool {
+	return self.store.IsConnected()
+}
+
+func (self *OffloadStore) Stop() {
+	self.store.Stop()
+}
+
+// Write the body to a new blob, returns the key and checksum of the blob
+func (self *OffloadStore) put(ctx context.Context, id, text string) (string, string, error) {
+	sum := sha256.Sum256([]byte(text))
+	key := id + "-" + models.NewId()
+	if err := self.blobs.Put(ctx, key, strings.NewReader(text), int64(len(text))); err != nil {
+		return "", "", blobError(ctx, err, "while writing the body of message id - %s", id)
+	}
+	return key, hex.EncodeToString(sum[:]), nil
+}
+
+// Deleting is best effort, a blob left behind is only wasted space
+func (self *OffloadStore) delete(ctx context.Context, key string) {
+	if err := self.blobs.Delete(ctx, key); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"method": "OffloadStore.delete()",
+			"type":   "blob",
+		}).Warnf("Failed to delete blob '%s' - %s", key, err.Error())
+	}
+}
+
+// Read the offloaded bodies of the messages into Text
+func (self *OffloadStore) readBodies(ctx context.Context, messages []models.Message) error {
+	for i := range messages {
+		if messages[i].BodyRef == "" {
+			continue
+		}
+		reader, err := self.OpenBody(ctx, &messages[i])
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return blobError(ctx, err, "while reading the body of message id - %s", messages[i].Id)
+		}
+		messages[i].Text = string(content)
+	}
+	return nil
+}
+
+func (self *offloadExpirer) ExpiredMessages(ctx context.Context, status string, before time.Time,
+	withBody bool, limit int) ([]models.Message, error) {
+	messages, err := self.expirer.ExpiredMessages(ctx, status, before, withBody, limit)
+	if err != nil {
+		return nil, err
+	}
+	return messages, self.readBodies(ctx, messages)
+}
+
+// Verifies the body matches the checksum once the body is read
+type checksumReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+	id       string
+}
+
+func (self *checksumReader) Read(buf []byte) (int, error) {
+	count, err := self.ReadCloser.Read(buf)
+	self.hash.Write(buf[:count])
+	if err == io.EOF && hex.EncodeToString(self.hash.Sum(nil)) != self.expected {
+		return count, NewError(internalErr, "body of message id - %s does not match its checksum", self.id)
+	}
+	return count, err
+}
+
+func blobError(ctx context.Context, err error, format string, args ...interface{}) error {
+	if err := ContextError(ctx, format, args...); err != nil {
+		return err
+	}
+	if err == blob.ErrNotFound || errors.Cause(err) == blob.ErrNotFound {
+		return FromError(notFoundErr, err, format, args...)
+	}
+	return FromError(internalErr, err, format, args...)
+}
@@ -0,0 +1,84 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/blob"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("OffloadStore", func() {
+	var dir string
+	var memStore *store.MemoryStore
+	var dbStore store.Store
+
+	readBody := func(msg *models.Message) (string, error) {
+		reader, err := dbStore.(store.BodyOpener).OpenBody(context.Background(), msg)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		content, err := ioutil.ReadAll(reader)
+		return string(content), err
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-offload")
+		Expect(err).To(BeNil())
+		blobs, err := blob.NewFileStore(dir)
+		Expect(err).To(BeNil())
+		memStore = store.NewMemoryStore()
+		dbStore = store.NewOffloadStore(memStore, blobs, 10)
+	})
+
+	AfterEach(func() {
+		dbStore.Stop()
+		os.RemoveAll(dir)
+	})
+
+	It("should keep bodies larger than the threshold in the blob store", func() {
+		body := strings.Repeat("large body ", 10)
+		msg := models.Message{Id: "id-1", Text: body, To: "devs@mailgun.net", Status: "NEW"}
+		Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+		Expect(msg.Text).To(Equal(body))
+
+		stored, err := dbStore.GetMessage(context.Background(), "id-1")
+		Expect(err).To(BeNil())
+		Expect(stored.Text).To(Equal(""))
+		Expect(stored.BodyRef).NotTo(Equal(""))
+		Expect(stored.BodyChecksum).NotTo(Equal(""))
+		Expect(readBody(stored)).To(Equal(body))
+
+		// A small body replaces the blob
+		Expect(dbStore.UpdateMessage(context.Background(), "id-1",
+			map[string]interface{}{"Text": "small"})).To(BeNil())
+		updated, err := dbStore.GetMessage(context.Background(), "id-1")
+		Expect(err).To(BeNil())
+		Expect(updated.Text).To(Equal("small"))
+		Expect(updated.BodyRef).To(Equal(""))
+
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).To(BeNil())
+		Expect(files).To(BeEmpty())
+	})
+
+	It("should fail to read a body that does not match its checksum", func() {
+		msg := models.Message{Id: "id-1", Text: strings.Repeat("large body ", 10), Status: "NEW"}
+		Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+
+		stored, err := dbStore.GetMessage(context.Background(), "id-1")
+		Expect(err).To(BeNil())
+		Expect(ioutil.WriteFile(path.Join(dir, stored.BodyRef), []byte("tampered"), 0600)).To(BeNil())
+
+		_, err = readBody(stored)
+		Expect(err).NotTo(BeNil())
+	})
+})
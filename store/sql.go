@@ -0,0 +1,333 @@
+package store
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/sqldb"
+	"golang.org/x/net/context"
+)
+
+// Maps the struct and json names of models.Message fields to their columns
+var messageColumns = map[string]string{
+	"Id": "id", "id": "id",
+	"Subject": "subject", "subject": "subject",
+	"Text": "body", "text": "body",
+	"From": "sender", "from": "sender",
+	"To": "recipients", "recipients": "recipients",
+	"Status": "status", "status": "status",
+	"Priority": "priority", "priority": "priority",
+	"Account": "account", "account": "account",
+	"Version": "version", "version": "version",
+	"BodyRef": "body_ref", "body_ref": "body_ref",
+	"BodyChecksum": "body_checksum", "body_checksum": "body_checksum",
+	"ClaimedAt": "claimed_at", "claimed_at": "claimed_at",
+}
+
+const selectColumns = "SELECT id, subject, body, sender, recipients, status, priority, account, " +
+	"version, body_ref, body_checksum, claimed_at FROM messages"
+
+const selectMessage = selectColumns + " WHERE id = ?"
+
+func NewSQLStore(parser *args.ArgParser, manager *sqldb.Manager) (Store, error) {
+	if manager == nil {
+		var err error
+		manager, err = sqldb.NewManager(parser)
+		if err != nil {
+			return nil, err
+		}
+		manager.Start()
+	}
+
+	return &SQLStore{
+		manager: manager,
+	}, nil
+}
+
+// A Store for PostgreSQL or SQLite
+type SQLStore struct {
+	manager *sqldb.Manager
+}
+
+func (self *SQLStore) GetMessage(ctx context.Context, id string) (*models.Message, error) {
+	db := self.manager.GetDB()
+	if db == nil {
+		return nil, NewError(connectionErr, "GetMessage() Not Connected")
+	}
+
+	var message models.Message
+	err := db.QueryRowContext(ctx, self.manager.GetDialect().Rebind(selectMessage), id).Scan(&message.Id,
+		&message.Subject, &message.Text, &message.From, &message.To, &message.Status,
+		&message.Priority, &message.Account, &message.Version, &message.BodyRef, &message.BodyChecksum,
+		&message.ClaimedAt)
+	if err == sql.ErrNoRows {
+		return nil, NewError(notFoundErr, "message id - %s not found", id)
+	} else if err != nil {
+		return nil, sqlError(ctx, err, "GetMessage()")
+	}
+	return &message, nil
+}
+
+func (self *SQLStore) InsertMessage(ctx context.Context, msg *models.Message) error {
+	if len(msg.Id) == 0 {
+		msg.Id = models.NewId()
+	}
+	if msg.Version == 0 {
+		msg.Version = 1
+	}
+	return self.transaction(ctx, "InsertMessage()", func(tx *sql.Tx, dialect sqldb.Dialect) error {
+		_, err := tx.ExecContext(ctx, dialect.Rebind("INSERT INTO messages "+
+			"(id, subject, body, sender, recipients, status, priority, account, version, body_ref, "+
+			"body_checksum, claimed_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+			msg.Id, msg.Subject, msg.Text, msg.From, msg.To, msg.Status, msg.Priority, msg.Account,
+			msg.Version, msg.BodyRef, msg.BodyChecksum, msg.ClaimedAt, time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+		return insertRecipients(ctx, tx, dialect, msg.Id, recipientKeysOf(msg))
+	})
+}
+
+func (self *SQLStore) UpdateMessage(ctx context.Context, id string, fields map[string]interface{}) error {
+	return self.update(ctx, "UpdateMessage()", id, -1, fields)
+}
+
+func (self *SQLStore) UpdateMessageIf(ctx context.Context, id string, version int,
+	fields map[string]interface{}) error {
+	return self.update(ctx, "UpdateMessageIf()", id, version, fields)
+}
+
+// Apply the update if the message has 'version', any version if 'version' is negative
+func (self *SQLStore) update(ctx context.Context, method, id string, version int,
+	fields map[string]interface{}) error {
+	fields = indexRecipientFields(fields)
+
+	// Sort the fields so the same update always produces the same statement
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	assign := []string{"version = version + 1"}
+	var values []interface{}
+	var recipientKeys []string
+	for _, name := range names {
+		// Kept in the message_recipients table
+		if name == "RecipientKeys" {
+			recipientKeys, _ = fields[name].([]string)
+			continue
+		}
+		column, ok := messageColumns[name]
+		if !ok || column == "version" {
+			return NewError(internalErr, "unknown message field '%s'", name)
+		}
+		assign = append(assign, column+" = ?")
+		values = append(values, fields[name])
+	}
+
+	query := fmt.Sprintf("UPDATE messages SET %s WHERE id = ?", strings.Join(assign, ", "))
+	values = append(values, id)
+	if version >= 0 {
+		query += " AND version = ?"
+		values = append(values, version)
+	}
+
+	var updated bool
+	err := self.transaction(ctx, method, func(tx *sql.Tx, dialect sqldb.Dialect) error {
+		result, err := tx.ExecContext(ctx, dialect.Rebind(query), values...)
+		if err != nil {
+			return err
+		}
+		if count, err := result.RowsAffected(); err == nil && count == 0 {
+			return nil
+		}
+		updated = true
+
+		if _, ok := fields["RecipientKeys"]; !ok {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, dialect.Rebind("DELETE FROM message_recipients WHERE message_id = ?"), id)
+		if err != nil {
+			return err
+		}
+		return insertRecipients(ctx, tx, dialect, id, recipientKeys)
+	})
+	if err != nil || updated {
+		return err
+	}
+
+	if version >= 0 {
+		// Tell a missing message from one with a different version
+		if _, err := self.GetMessage(ctx, id); err != nil {
+			return err
+		}
+		return NewError(conflictErr, "Message Id - %s was modified since version %d", id, version)
+	}
+	return NewError(notFoundErr, "Message Id - %s not found", id)
+}
+
+// Messages inserted before the created_at column existed are never returned
+func (self *SQLStore) ExpiredMessages(ctx context.Context, status string, before time.Time,
+	withBody bool, limit int) ([]models.Message, error) {
+	query := selectColumns + " WHERE status = ? AND created_at > 0 AND created_at < ?"
+	if withBody {
+		query += " AND (body <> '' OR body_ref <> '')"
+	}
+	return self.query(ctx, "ExpiredMessages()", query+" ORDER BY created_at LIMIT ?",
+		status, before.UnixNano(), limit)
+}
+
+func (self *SQLStore) DeleteMessages(ctx context.Context, ids []string) error {
+	return self.transaction(ctx, "DeleteMessages()", func(tx *sql.Tx, dialect sqldb.Dialect) error {
+		for _, id := range ids {
+			_, err := tx.ExecContext(ctx, dialect.Rebind("DELETE FROM message_recipients WHERE message_id = ?"), id)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, dialect.Rebind("DELETE FROM messages WHERE id = ?"), id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (self *SQLStore) MessagesByRecipient(ctx context.Context, recipient string,
+	limit int) ([]models.Message, error) {
+	return self.messagesByRecipientKey(ctx, models.RecipientKey(recipient), limit)
+}
+
+func (self *SQLStore) messagesByRecipientKey(ctx context.Context, key string,
+	limit int) ([]models.Message, error) {
+	return self.query(ctx, "MessagesByRecipient()", selectColumns+" WHERE id IN "+
+		"(SELECT message_id FROM message_recipients WHERE recipient_key = ?) ORDER BY id LIMIT ?", key, limit)
+}
+
+func (self *SQLStore) ScanMessages(ctx context.Context, after string, limit int) ([]models.Message, error) {
+	return self.query(ctx, "ScanMessages()", selectColumns+" WHERE id > ? ORDER BY id LIMIT ?", after, limit)
+}
+
+// Returns the messages selected by a 'selectColumns' query
+func (self *SQLStore) query(ctx context.Context, method, query string, args ...interface{}) ([]models.Message, error) {
+	db := self.manager.GetDB()
+	if db == nil {
+		return nil, NewError(connectionErr, "%s Not Connected", method)
+	}
+
+	rows, err := db.QueryContext(ctx, self.manager.GetDialect().Rebind(query), args...)
+	if err != nil {
+		return nil, sqlError(ctx, err, method)
+	}
+	defer rows.Close()
+
+	var result []models.Message
+	for rows.Next() {
+		var message models.Message
+		err := rows.Scan(&message.Id, &message.Subject, &message.Text, &message.From, &message.To,
+			&message.Status, &message.Priority, &message.Account, &message.Version, &message.BodyRef,
+			&message.BodyChecksum, &message.ClaimedAt)
+		if err != nil {
+			return nil, sqlError(ctx, err, method)
+		}
+		result = append(result, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, sqlError(ctx, err, method)
+	}
+	return result, nil
+}
+
+// Run 'callBack' in a transaction, committed if 'callBack' returns nil
+func (self *SQLStore) transaction(ctx context.Context, method string,
+	callBack func(*sql.Tx, sqldb.Dialect) error) error {
+	db := self.manager.GetDB()
+	if db == nil {
+		return NewError(connectionErr, "%s Not Connected", method)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(ctx, err, method)
+	}
+	if err := callBack(tx, self.manager.GetDialect()); err != nil {
+		tx.Rollback()
+		return sqlError(ctx, err, method)
+	}
+	if err := tx.Commit(); err != nil {
+		return sqlError(ctx, err, method)
+	}
+	return nil
+}
+
+func insertRecipients(ctx context.Context, tx *sql.Tx, dialect sqldb.Dialect, id string, keys []string) error {
+	for _, key := range keys {
+		_, err := tx.ExecContext(ctx, dialect.Rebind("INSERT INTO message_recipients "+
+			"(recipient_key, message_id) VALUES (?, ?)"), key, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *SQLStore) SignalReconnect() {
+	self.manager.Signal()
+}
+
+func (self *SQLStore) Reconfigure() {
+	self.manager.Reconfigure()
+}
+
+func (self *SQLStore) Diagnose() map[string]string {
+	if self.IsConnected() {
+		return nil
+	}
+	return map[string]string{self.manager.GetDialect().Name(): string(self.manager.State())}
+}
+
+func (self *SQLStore) IsConnected() bool {
+	db := self.manager.GetDB()
+	if db == nil || db.Ping() != nil {
+		return false
+	}
+	return true
+}
+
+func (self *SQLStore) Stop() {
+	self.manager.Stop()
+}
+
+// Map database errors to store errors, so callers know when to reconnect
+func sqlError(ctx context.Context, err error, msg string) error {
+	if err := ContextError(ctx, "%s", msg); err != nil {
+		return err
+	}
+	if isConnectError(err) {
+		return FromError(connectionErr, err, "%s", msg)
+	}
+	return FromError(internalErr, err, "%s", msg)
+}
+
+func isConnectError(err error) bool {
+	if err == driver.ErrBadConn || err == sql.ErrConnDone {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// Class 08 - Connection Exception, Class 57 - Operator Intervention (IE: admin shutdown)
+	if pqErr, ok := err.(*pq.Error); ok {
+		class := pqErr.Code.Class()
+		return class == "08" || class == "57"
+	}
+	return false
+}
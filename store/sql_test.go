@@ -0,0 +1,73 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/sqldb"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("SQLStore", func() {
+	var dir string
+	var dbStore store.Store
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "detka-sql")
+		Expect(err).To(BeNil())
+
+		manager, err := sqldb.NewManagerFromConfig(sqldb.Config{
+			Dialect:     sqldb.SQLite,
+			DSN:         path.Join(dir, "detka.db"),
+			AutoMigrate: true,
+		})
+		Expect(err).To(BeNil())
+		manager.Start()
+
+		dbStore, err = store.NewSQLStore(nil, manager)
+		Expect(err).To(BeNil())
+		Expect(dbStore.IsConnected()).To(Equal(true))
+	})
+
+	AfterEach(func() {
+		if dbStore != nil {
+			dbStore.Stop()
+		}
+		os.RemoveAll(dir)
+	})
+
+	It("should insert, update and get messages", func() {
+		msg := models.Message{From: "excited@samples.mailgun.org", To: "devs@mailgun.net",
+			Subject: "Hello", Text: "Testing", Status: "NEW", Priority: "high", Account: "account-1"}
+		Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+
+		Expect(dbStore.UpdateMessage(context.Background(), msg.Id, map[string]interface{}{"Status": "SENT"})).To(BeNil())
+
+		stored, err := dbStore.GetMessage(context.Background(), msg.Id)
+		Expect(err).To(BeNil())
+		msg.Status = "SENT"
+		msg.Version = 2
+		Expect(*stored).To(Equal(msg))
+	})
+
+	It("should return not found for unknown messages", func() {
+		_, err := dbStore.GetMessage(context.Background(), "no-such-id")
+		Expect(store.IsNotFound(err)).To(Equal(true))
+
+		err = dbStore.UpdateMessage(context.Background(), "no-such-id", map[string]interface{}{"Status": "SENT"})
+		Expect(store.IsNotFound(err)).To(Equal(true))
+	})
+
+	It("should return a connection error once stopped", func() {
+		dbStore.Stop()
+		_, err := dbStore.GetMessage(context.Background(), "id-1")
+		Expect(store.IsConnectError(err)).To(Equal(true))
+		dbStore = nil
+	})
+})
@@ -1,15 +1,18 @@
 package store
 
 import (
+	"io"
 	"net/http"
+	"time"
 
-	"github.com/dancannon/gorethink"
 	"github.com/pkg/errors"
 	"github.com/pressly/chi"
 	"github.com/thrawn01/args"
+	"github.com/thrawn01/detka/envelope"
 	"github.com/thrawn01/detka/models"
 	"github.com/thrawn01/detka/rethink"
 	"golang.org/x/net/context"
+	"gopkg.in/gorethink/gorethink.v3"
 )
 
 type contextKey int
@@ -30,15 +33,165 @@ func GetStore(ctx context.Context) Store {
 	return obj
 }
 
+// Every method that accepts a context returns an error for which IsTimeout() is true
+// if the context deadline expires or the context is cancelled
 type Store interface {
-	GetMessage(string) (*models.Message, error)
-	InsertMessage(*models.Message) error
-	UpdateMessage(string, map[string]interface{}) error
+	GetMessage(context.Context, string) (*models.Message, error)
+	InsertMessage(context.Context, *models.Message) error
+	UpdateMessage(context.Context, string, map[string]interface{}) error
+	// Update the message only if the stored version matches, returns an error for which
+	// IsConflict() is true if the message was updated since the version was read
+	UpdateMessageIf(context.Context, string, int, map[string]interface{}) error
 	SignalReconnect()
 	Stop()
 	IsConnected() bool
 }
 
+// Implemented by stores that can find and remove old messages, see detka.Retention
+type Expirer interface {
+	// Returns up to 'limit' messages with 'status' inserted before 'before', oldest first. If
+	// 'withBody' is true only messages that still have a body are returned
+	ExpiredMessages(ctx context.Context, status string, before time.Time, withBody bool,
+		limit int) ([]models.Message, error)
+	Deleter
+}
+
+type Deleter interface {
+	// Delete the messages, ids that don't exist are ignored
+	DeleteMessages(ctx context.Context, ids []string) error
+}
+
+// Implemented by stores that index messages by recipient, see detka.Erasure
+type RecipientIndex interface {
+	// Returns up to 'limit' messages addressed to 'recipient', IE: 'devs@mailgun.net'
+	MessagesByRecipient(ctx context.Context, recipient string, limit int) ([]models.Message, error)
+}
+
+// Looks up messages by one of their Message.RecipientKeys, so EncryptedStore can look
+// up the keys it hashed
+type recipientKeyIndex interface {
+	messagesByRecipientKey(ctx context.Context, key string, limit int) ([]models.Message, error)
+}
+
+// Returns Message.RecipientKeys, or the keys of the recipients if the caller did not set them
+func recipientKeysOf(msg *models.Message) []string {
+	if msg.RecipientKeys == nil {
+		return models.RecipientKeys(msg.To)
+	}
+	return msg.RecipientKeys
+}
+
+// Returns the fields with 'RecipientKeys' added if the recipients are updated without them
+func indexRecipientFields(fields map[string]interface{}) map[string]interface{} {
+	if _, ok := fields["RecipientKeys"]; ok {
+		return fields
+	}
+	for _, name := range []string{"To", "recipients"} {
+		if to, ok := fields[name].(string); ok {
+			result := map[string]interface{}{"RecipientKeys": models.RecipientKeys(to)}
+			for key, value := range fields {
+				result[key] = value
+			}
+			return result
+		}
+	}
+	return fields
+}
+
+// Index the recipients of the messages stored before the store had a RecipientIndex, returns the
+// number of messages indexed. Rewrites the recipients of every message, a message updated while it
+// is indexed was indexed by the update
+func Reindex(ctx context.Context, dbStore Store) (int, error) {
+	scanner, ok := dbStore.(Scanner)
+	if !ok {
+		return 0, NewError(internalErr, "Reindex() the store can't list messages")
+	}
+
+	var count int
+	var after string
+	for {
+		batchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		messages, err := scanner.ScanMessages(batchCtx, after, rotateBatchSize)
+		if err != nil {
+			cancel()
+			return count, err
+		}
+
+		for _, message := range messages {
+			err := dbStore.UpdateMessageIf(batchCtx, message.Id, message.Version,
+				map[string]interface{}{"To": message.To})
+			if err != nil {
+				if IsConflict(err) || IsNotFound(err) {
+					continue
+				}
+				cancel()
+				return count, err
+			}
+			count++
+		}
+		cancel()
+
+		if len(messages) < rotateBatchSize {
+			return count, nil
+		}
+		after = messages[len(messages)-1].Id
+	}
+}
+
+// Implemented by stores that keep large bodies outside the message, see OffloadStore
+type BodyOpener interface {
+	// Returns the body of the message, read from the blob store if the message has a BodyRef
+	OpenBody(ctx context.Context, msg *models.Message) (io.ReadCloser, error)
+}
+
+// Implemented by stores that can list every message, see EncryptedStore.Rotate()
+type Scanner interface {
+	// Returns up to 'limit' messages with an id greater than 'after', ordered by id
+	ScanMessages(ctx context.Context, after string, limit int) ([]models.Message, error)
+}
+
+// Implemented by stores that reconnect only when the options of their connection change
+type Reconfigurer interface {
+	Reconfigure()
+}
+
+// Apply changed options to the store, stores that are not a Reconfigurer reconnect
+func Reconfigure(dbStore Store) {
+	if reconfigurer, ok := dbStore.(Reconfigurer); ok {
+		reconfigurer.Reconfigure()
+		return
+	}
+	dbStore.SignalReconnect()
+}
+
+// Implemented by stores that encrypt messages at rest
+type Encrypter interface {
+	// The master key that wraps the data keys of the messages
+	MasterKey() envelope.MasterKey
+}
+
+// Returns the master key of the store, nil if the store does not encrypt messages
+func MasterKey(dbStore Store) envelope.MasterKey {
+	if encrypter, ok := dbStore.(Encrypter); ok {
+		return encrypter.MasterKey()
+	}
+	return nil
+}
+
+// Implemented by stores that can say why they are not connected, see Healthz()
+type Diagnoser interface {
+	// Returns the state of each connection that is not connected, by backend
+	Diagnose() map[string]string
+}
+
+// Returns the connection states reported by the store, or nil if the store is not a Diagnoser
+func Diagnose(dbStore Store) map[string]string {
+	if diagnoser, ok := dbStore.(Diagnoser); ok {
+		return diagnoser.Diagnose()
+	}
+	return nil
+}
+
 func NewRethinkStore(parser *args.ArgParser, manager *rethink.Manager) Store {
 	if manager == nil {
 		manager = rethink.NewManager(parser)
@@ -54,15 +207,19 @@ type RethinkStore struct {
 	manager *rethink.Manager
 }
 
-func (self *RethinkStore) GetMessage(id string) (*models.Message, error) {
-	session := self.manager.GetSession()
+func (self *RethinkStore) GetMessage(ctx context.Context, id string) (*models.Message, error) {
+	session, release := self.manager.AcquireSession()
+	defer release()
 	if session == nil {
-		return nil, NewError(internalErr, "InsertMessage() Not Connected")
+		return nil, NewError(connectionErr, "GetMessage() Not Connected")
 	}
 
 	var message models.Message
-	cursor, err := gorethink.Table("messages").Get(id).Run(session, rethink.RunOpts)
+	cursor, err := gorethink.Table("messages").Get(id).Run(session, rethink.RunOptsWithContext(ctx))
 	if err != nil {
+		if err := ContextError(ctx, "GetMessage()"); err != nil {
+			return nil, err
+		}
 		return nil, errors.Wrap(err, "GetMessage() ")
 	} else if err := cursor.One(&message); err != nil {
 		if cursor.IsNil() {
@@ -70,20 +227,33 @@ func (self *RethinkStore) GetMessage(id string) (*models.Message, error) {
 		}
 		return nil, FromError(internalErr, err, "Cursor.One() error")
 	}
+	message.RecipientKeys = nil
 	return &message, nil
 }
 
-func (self *RethinkStore) InsertMessage(msg *models.Message) error {
+func (self *RethinkStore) InsertMessage(ctx context.Context, msg *models.Message) error {
 	if len(msg.Id) == 0 {
 		msg.Id = models.NewId()
 	}
-	session := self.manager.GetSession()
+	if msg.Version == 0 {
+		msg.Version = 1
+	}
+	session, release := self.manager.AcquireSession()
+	defer release()
 	if session == nil {
-		return NewError(internalErr, "InsertMessage() Not Connected")
+		return NewError(connectionErr, "InsertMessage() Not Connected")
 	}
 
-	changed, err := gorethink.Table("messages").Insert(msg).RunWrite(session, rethink.RunOpts)
+	// CreatedAt is only stored in rethink, for the 'created_at' index
+	doc := gorethink.Expr(msg).Merge(map[string]interface{}{
+		"CreatedAt":     gorethink.Now(),
+		"RecipientKeys": recipientKeysOf(msg),
+	})
+	changed, err := gorethink.Table("messages").Insert(doc).RunWrite(session, rethink.RunOptsWithContext(ctx))
 	if err != nil {
+		if err := ContextError(ctx, "rethink.Insert()"); err != nil {
+			return err
+		}
 		return FromError(internalErr, err, "rethink.Insert() Error")
 	} else if changed.Errors != 0 {
 		return NewError(internalErr, "changed.Error != 0 - %s", changed.FirstError)
@@ -91,15 +261,20 @@ func (self *RethinkStore) InsertMessage(msg *models.Message) error {
 	return nil
 }
 
-func (self *RethinkStore) UpdateMessage(id string, fields map[string]interface{}) error {
-	session := self.manager.GetSession()
+func (self *RethinkStore) UpdateMessage(ctx context.Context, id string, fields map[string]interface{}) error {
+	session, release := self.manager.AcquireSession()
+	defer release()
 	if session == nil {
-		return NewError(internalErr, "UpdateMessage() Not Connected")
+		return NewError(connectionErr, "UpdateMessage() Not Connected")
 	}
 
-	changed, err := gorethink.Table("messages").Get(id).Update(fields).
-		RunWrite(session, rethink.RunOpts)
+	changed, err := gorethink.Table("messages").Get(id).Update(func(row gorethink.Term) interface{} {
+		return versioned(row, indexRecipientFields(fields))
+	}).RunWrite(session, rethink.RunOptsWithContext(ctx))
 	if err != nil {
+		if err := ContextError(ctx, "rethink.Update()"); err != nil {
+			return err
+		}
 		return FromError(internalErr, err, "rethink.Update()")
 	} else if changed.Skipped != 0 {
 		return NewError(notFoundErr, "Message Id - %s not found", id)
@@ -107,10 +282,155 @@ func (self *RethinkStore) UpdateMessage(id string, fields map[string]interface{}
 	return nil
 }
 
+func (self *RethinkStore) UpdateMessageIf(ctx context.Context, id string, version int,
+	fields map[string]interface{}) error {
+	session, release := self.manager.AcquireSession()
+	defer release()
+	if session == nil {
+		return NewError(connectionErr, "UpdateMessageIf() Not Connected")
+	}
+
+	// Leave the message unchanged if the version doesn't match
+	changed, err := gorethink.Table("messages").Get(id).Update(func(row gorethink.Term) interface{} {
+		return gorethink.Branch(row.Field("Version").Default(0).Eq(version),
+			versioned(row, indexRecipientFields(fields)), map[string]interface{}{})
+	}).RunWrite(session, rethink.RunOptsWithContext(ctx))
+	if err != nil {
+		if err := ContextError(ctx, "rethink.Update()"); err != nil {
+			return err
+		}
+		return FromError(internalErr, err, "rethink.Update()")
+	} else if changed.Skipped != 0 {
+		return NewError(notFoundErr, "Message Id - %s not found", id)
+	} else if changed.Replaced == 0 {
+		return NewError(conflictErr, "Message Id - %s was modified since version %d", id, version)
+	}
+	return nil
+}
+
+// Returns the fields with the version of the row incremented
+func versioned(row gorethink.Term, fields map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{"Version": row.Field("Version").Default(0).Add(1)}
+	for key, value := range fields {
+		result[key] = value
+	}
+	return result
+}
+
+func (self *RethinkStore) ScanMessages(ctx context.Context, after string, limit int) ([]models.Message, error) {
+	session, release := self.manager.AcquireSession()
+	defer release()
+	if session == nil {
+		return nil, NewError(connectionErr, "ScanMessages() Not Connected")
+	}
+
+	var messages []models.Message
+	cursor, err := gorethink.Table("messages").
+		Between(after, gorethink.MaxVal, gorethink.BetweenOpts{LeftBound: "open"}).
+		OrderBy(gorethink.OrderByOpts{Index: "Id"}).Limit(limit).Without("RecipientKeys").
+		Run(session, rethink.RunOptsWithContext(ctx))
+	if err != nil {
+		if err := ContextError(ctx, "ScanMessages()"); err != nil {
+			return nil, err
+		}
+		return nil, FromError(internalErr, err, "rethink.Between()")
+	} else if err := cursor.All(&messages); err != nil {
+		return nil, FromError(internalErr, err, "Cursor.All() error")
+	}
+	return messages, nil
+}
+
+func (self *RethinkStore) MessagesByRecipient(ctx context.Context, recipient string,
+	limit int) ([]models.Message, error) {
+	return self.messagesByRecipientKey(ctx, models.RecipientKey(recipient), limit)
+}
+
+func (self *RethinkStore) messagesByRecipientKey(ctx context.Context, key string,
+	limit int) ([]models.Message, error) {
+	session, release := self.manager.AcquireSession()
+	defer release()
+	if session == nil {
+		return nil, NewError(connectionErr, "MessagesByRecipient() Not Connected")
+	}
+
+	var messages []models.Message
+	cursor, err := gorethink.Table("messages").
+		GetAll(key).OptArgs(gorethink.GetAllOpts{Index: "recipient_keys"}).
+		OrderBy("Id").Limit(limit).Without("RecipientKeys").Run(session, rethink.RunOptsWithContext(ctx))
+	if err != nil {
+		if err := ContextError(ctx, "MessagesByRecipient()"); err != nil {
+			return nil, err
+		}
+		return nil, FromError(internalErr, err, "rethink.GetAll()")
+	} else if err := cursor.All(&messages); err != nil {
+		return nil, FromError(internalErr, err, "Cursor.All() error")
+	}
+	return messages, nil
+}
+
+// Messages inserted before the 'created_at' index was added are never expired
+func (self *RethinkStore) ExpiredMessages(ctx context.Context, status string, before time.Time,
+	withBody bool, limit int) ([]models.Message, error) {
+	session, release := self.manager.AcquireSession()
+	defer release()
+	if session == nil {
+		return nil, NewError(connectionErr, "ExpiredMessages() Not Connected")
+	}
+
+	query := gorethink.Table("messages").
+		Between(gorethink.MinVal, before, gorethink.BetweenOpts{Index: "created_at"}).
+		OrderBy(gorethink.OrderByOpts{Index: "created_at"}).
+		Filter(gorethink.Row.Field("Status").Eq(status))
+	if withBody {
+		query = query.Filter(gorethink.Row.Field("Text").Default("").Ne("").
+			Or(gorethink.Row.Field("BodyRef").Default("").Ne("")))
+	}
+
+	var messages []models.Message
+	cursor, err := query.Limit(limit).Without("RecipientKeys").Run(session, rethink.RunOptsWithContext(ctx))
+	if err != nil {
+		if err := ContextError(ctx, "ExpiredMessages()"); err != nil {
+			return nil, err
+		}
+		return nil, FromError(internalErr, err, "rethink.Between()")
+	} else if err := cursor.All(&messages); err != nil {
+		return nil, FromError(internalErr, err, "Cursor.All() error")
+	}
+	return messages, nil
+}
+
+func (self *RethinkStore) DeleteMessages(ctx context.Context, ids []string) error {
+	session, release := self.manager.AcquireSession()
+	defer release()
+	if session == nil {
+		return NewError(connectionErr, "DeleteMessages() Not Connected")
+	}
+
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = id
+	}
+	changed, err := gorethink.Table("messages").GetAll(keys...).Delete().
+		RunWrite(session, rethink.RunOptsWithContext(ctx))
+	if err != nil {
+		if err := ContextError(ctx, "rethink.Delete()"); err != nil {
+			return err
+		}
+		return FromError(internalErr, err, "rethink.Delete()")
+	} else if changed.Errors != 0 {
+		return NewError(internalErr, "changed.Error != 0 - %s", changed.FirstError)
+	}
+	return nil
+}
+
 func (self *RethinkStore) SignalReconnect() {
 	self.manager.Signal()
 }
 
+func (self *RethinkStore) Reconfigure() {
+	self.manager.Reconfigure()
+}
+
 func (self *RethinkStore) IsConnected() bool {
 	session := self.manager.GetSession()
 	if session == nil || !session.IsConnected() {
@@ -119,6 +439,13 @@ func (self *RethinkStore) IsConnected() bool {
 	return true
 }
 
+func (self *RethinkStore) Diagnose() map[string]string {
+	if self.IsConnected() {
+		return nil
+	}
+	return map[string]string{"rethink": string(self.manager.State())}
+}
+
 func (self *RethinkStore) Stop() {
 	self.manager.Stop()
 }
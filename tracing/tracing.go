@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+	"github.com/thrawn01/args"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+const tracerName = "github.com/thrawn01/detka"
+
+// Install the exporter chosen by the 'tracing-exporter' option as the global tracer provider.
+// The returned function flushes any buffered spans and must be called before exiting
+func Init(opts *args.Options, service string) (func(), error) {
+	// Propagate the trace context in the W3C 'traceparent' header
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch opts.String("tracing-exporter") {
+	case "", "none":
+		return func() {}, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.String("tracing-endpoint"))}
+		if opts.Bool("tracing-insecure") {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		return nil, errors.Errorf("invalid tracing exporter '%s' - must be one of [none stdout otlp]",
+			opts.String("tracing-exporter"))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "while creating tracing exporter")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() {
+		provider.Shutdown(context.Background())
+	}, nil
+}
+
+// Start a new span as a child of any span in the context
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// Record the error on the span, if there was one, and end the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Write the trace context of the span in 'ctx' into the headers
+func Inject(ctx context.Context, headers map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+}
+
+// Returns a context that continues the trace found in the headers
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// Start a span for every request, continuing the trace of the caller if there is one
+func Middleware(next chi.Handler) chi.Handler {
+	return chi.HandlerFunc(func(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(req.Header))
+		ctx, span := Start(ctx, fmt.Sprintf("HTTP %s", req.Method),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", req.Method),
+				attribute.String("http.target", req.URL.Path),
+			))
+		defer span.End()
+
+		next.ServeHTTPC(ctx, resp, req)
+	})
+}
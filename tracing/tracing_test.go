@@ -0,0 +1,41 @@
+package tracing_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Tracing", func() {
+	BeforeEach(func() {
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	})
+
+	Describe("Inject", func() {
+		It("should continue the trace when extracted from the headers", func() {
+			ctx, span := tracing.Start(context.Background(), "Queue.Publish")
+			defer span.End()
+
+			headers := make(map[string]string)
+			tracing.Inject(ctx, headers)
+			Expect(headers).To(HaveKey("traceparent"))
+
+			remote := trace.SpanContextFromContext(tracing.Extract(context.Background(), headers))
+			Expect(remote.TraceID()).To(Equal(span.SpanContext().TraceID()))
+			Expect(remote.SpanID()).To(Equal(span.SpanContext().SpanID()))
+		})
+	})
+
+	Describe("Extract", func() {
+		It("should return the context untouched when there are no headers", func() {
+			ctx := tracing.Extract(context.Background(), nil)
+			Expect(trace.SpanContextFromContext(ctx).IsValid()).To(Equal(false))
+		})
+	})
+})
@@ -0,0 +1,98 @@
+package detka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/store"
+	"github.com/thrawn01/detka/tracing"
+	"golang.org/x/net/context"
+)
+
+// How long the worker waits for the webhook to respond
+var WebhookTimeout = time.Second * 10
+
+// The body POSTed to the webhook when a message reaches a final status
+type WebhookEvent struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// POST the final status of each message to 'url', an empty url disables the webhook
+func (self *Worker) SetWebhook(url string) {
+	self.mutex.Lock()
+	self.webhook = url
+	self.mutex.Unlock()
+}
+
+func (self *Worker) getWebhook() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.webhook
+}
+
+// Queue a 'webhook' message for the message if a webhook is configured, so a slow
+// webhook does not hold up sending
+func (self *Worker) notify(ctx context.Context, email *models.Message) {
+	if self.getWebhook() == "" {
+		return
+	}
+	if err := enqueueType(ctx, self.queue, self.getKeyFunc(), "webhook", email); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"method": "Worker.notify()",
+			"type":   "queue",
+		}).Error(fmt.Sprintf("Message Id '%s' - %s", email.Id, err.Error()))
+	}
+}
+
+// POST the current status of the message to the webhook. Rejected events are not retried
+func (self *Worker) handleWebhook(ctx context.Context, msg *models.QueueMessage) error {
+	url := self.getWebhook()
+	if url == "" {
+		return Discard(errors.Errorf("Message Id '%s' - no webhook configured", msg.Id))
+	}
+
+	storeCtx, span := tracing.Start(ctx, "Store.GetMessage")
+	storeCtx, cancel := context.WithTimeout(storeCtx, StoreTimeout)
+	email, err := self.store.GetMessage(storeCtx, msg.Id)
+	cancel()
+	tracing.End(span, err)
+	if err != nil {
+		if store.IsNotFound(err) {
+			return Discard(errors.Errorf("Queue Message Id not found - %s", msg.Id))
+		}
+		return err
+	}
+
+	payload, err := json.Marshal(&WebhookEvent{Id: email.Id, Status: email.Status})
+	if err != nil {
+		return Fail(errors.Wrap(err, "json.Marshal()"))
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return Fail(errors.Wrap(err, "while creating webhook request"))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	reqCtx, cancel := context.WithTimeout(ctx, WebhookTimeout)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(reqCtx))
+	if err != nil {
+		return errors.Wrap(err, "webhook")
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return errors.Errorf("webhook responded '%s'", resp.Status)
+	case resp.StatusCode >= 300:
+		return Fail(errors.Errorf("webhook rejected the event - '%s'", resp.Status))
+	}
+	return nil
+}
@@ -2,59 +2,126 @@ package detka
 
 import (
 	"fmt"
-
-	"encoding/json"
-
+	"io"
+	"io/ioutil"
+	"sync"
 	"time"
 
-	"github.com/Shopify/sarama"
-	"github.com/Sirupsen/logrus"
-	"github.com/thrawn01/detka/kafka"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/thrawn01/detka/metrics"
 	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
 	"github.com/thrawn01/detka/store"
+	"github.com/thrawn01/detka/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
 )
 
+// Relative weight of each priority lane, when every lane has messages waiting
+// the worker handles 4 high, 2 normal and 1 bulk message in turn; so high priority
+// mail is drained first without starving the bulk lane
+var LaneWeights = map[string]int{
+	models.PriorityHigh:   4,
+	models.PriorityNormal: 2,
+	models.PriorityBulk:   1,
+}
+
+// Number of times a message is attempted before it is sent to the dead letter
+var MaxAttempts = 5
+
+// How long the worker waits for each store call
+var StoreTimeout = time.Second * 5
+
+// How long the worker retries recording the status of a message before giving up
+var StatusRetryLimit = time.Minute
+
+// How long a worker may take to send a message it claimed. A message still SENDING after
+// ClaimTimeout was claimed by a worker that crashed, it is claimed again when redelivered and
+// queued again by RequeueExpiredClaims() if the queue does not redeliver it
+var ClaimTimeout = time.Minute * 10
+
+// Number of messages with an expired claim RequeueExpiredClaims() reads from the store at a time
+var RequeueBatchSize = 500
+
 type Worker struct {
-	mailer   Mailer
-	consumer *kafka.ConsumerManager
-	store    store.Store
-	done     chan struct{}
+	mutex      sync.Mutex
+	mailer     Mailer
+	webhook    string
+	keyFunc    queue.KeyFunc
+	queue      queue.Queue
+	store      store.Store
+	dispatcher *Dispatcher
+	done       chan struct{}
+	wg         sync.WaitGroup
+	// Cancelled by Stop() to interrupt any store calls in progress
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewWorker(cm *kafka.ConsumerManager, store store.Store, mailer Mailer) *Worker {
+func NewWorker(msgQueue queue.Queue, dbStore store.Store, mailer Mailer) *Worker {
 	worker := &Worker{
-		mailer:   mailer,
-		store:    store,
-		consumer: cm,
+		mailer:     mailer,
+		store:      dbStore,
+		queue:      msgQueue,
+		dispatcher: NewDispatcher(NewQueueDeadLetter(msgQueue, dbStore)),
 	}
+	// API is just testing the connection
+	worker.Register("ping", HandlerFunc(func(context.Context, *models.QueueMessage) error { return nil }))
+	worker.Register("email", HandlerFunc(worker.handleEmail))
+	worker.Register("bounce", HandlerFunc(worker.handleBounce))
+	worker.Register("webhook", HandlerFunc(worker.handleWebhook))
 	worker.Start()
 	return worker
 }
 
+// Register a handler for a queue message type
+func (self *Worker) Register(kind string, handler Handler) {
+	self.dispatcher.Register(kind, handler)
+}
+
 func (self *Worker) Start() {
-	consumerChan := self.consumer.GetConsumerChannel()
 	self.done = make(chan struct{})
+	self.ctx, self.cancel = context.WithCancel(context.Background())
+	schedule := laneSchedule(LaneWeights)
 
-	go func() {
-		var messages <-chan *sarama.ConsumerMessage
-		var errors <-chan *sarama.ConsumerError
+	lanes := make(map[string]<-chan *queue.Record)
+	for _, priority := range models.Priorities {
+		records, err := self.queue.Subscribe(queue.LaneTopic(priority))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"type":   "queue",
+				"method": "Worker.Start()",
+			}).Errorf("Subscribe to '%s' failed - %s", priority, err.Error())
+			continue
+		}
+		lanes[priority] = records
+	}
 
+	self.wg.Add(2)
+	go self.requeueClaims(self.done, ClaimTimeout)
+	go func() {
+		defer self.wg.Done()
 		for {
-			select {
-			case consumer := <-consumerChan:
-				// Consumer might be closed before self.done, if this is the
-				if consumer != nil {
-					messages = consumer.Messages()
-					errors = consumer.Errors()
+			// Handle any waiting records in weighted lane order
+			if drainLanes(schedule, lanes, self.handleRecord) {
+				select {
+				case <-self.done:
+					return
+				default:
 				}
-			case msg := <-messages:
-				self.handleMessage(msg)
-			case err := <-errors:
-				logrus.WithFields(logrus.Fields{
-					"type":   "kafka",
-					"method": "Start()",
-				}).Error("Received Error - ", err.Error())
-				self.consumer.Signal()
+				continue
+			}
+
+			// All lanes are empty, wait for something to happen
+			select {
+			case record := <-lanes[models.PriorityHigh]:
+				self.handleRecord(record)
+			case record := <-lanes[models.PriorityNormal]:
+				self.handleRecord(record)
+			case record := <-lanes[models.PriorityBulk]:
+				self.handleRecord(record)
 			case <-self.done:
 				return
 			}
@@ -62,15 +129,106 @@ func (self *Worker) Start() {
 	}()
 }
 
+// Pass at most one waiting record from each slot in the schedule to 'handle', returns
+// true if any record was handled
+func drainLanes(schedule []string, lanes map[string]<-chan *queue.Record, handle func(*queue.Record)) bool {
+	var handled bool
+	for _, priority := range schedule {
+		select {
+		case record := <-lanes[priority]:
+			handle(record)
+			handled = true
+		default:
+		}
+	}
+	return handled
+}
+
+// Call RequeueExpiredClaims() every 'interval' until 'done' is closed
+func (self *Worker) requeueClaims(done chan struct{}, interval time.Duration) {
+	defer self.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		count, err := self.RequeueExpiredClaims(self.ctx)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"method": "Worker.requeueClaims()",
+				"type":   "store",
+			}).Error(err.Error())
+		}
+		if count != 0 {
+			logrus.WithFields(logrus.Fields{
+				"method": "Worker.requeueClaims()",
+				"type":   "store",
+			}).Warnf("Queued %d messages claimed by a worker that did not finish sending them", count)
+		}
+	}
+}
+
+// Waits for the record being handled, the status of a message that was sent is still recorded
 func (self *Worker) Stop() {
+	self.cancel()
 	close(self.done)
+	self.wg.Wait()
+}
+
+// Replace the mailer used for the messages handled from now on, IE: when the config changed
+func (self *Worker) SetMailer(mailer Mailer) {
+	self.mutex.Lock()
+	self.mailer = mailer
+	self.mutex.Unlock()
 }
 
-func (self *Worker) updateStatus(id, status string) {
+func (self *Worker) getMailer() Mailer {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.mailer
+}
+
+// Key the messages the worker queues ('webhook' and requeued claims) as the API keys them,
+// nil leaves them unkeyed
+func (self *Worker) SetKeyFunc(keyFunc queue.KeyFunc) {
+	self.mutex.Lock()
+	self.keyFunc = keyFunc
+	self.mutex.Unlock()
+}
+
+func (self *Worker) getKeyFunc() queue.KeyFunc {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.keyFunc
+}
+
+// Has the values of the parent but is never cancelled, so the result of a message that was
+// sent is recorded even if the worker is stopped
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// Record the status of the message, retries until the status is recorded or StatusRetryLimit
+// expires. Stopping the worker does not interrupt the retries
+func (self *Worker) updateStatus(ctx context.Context, id, status string) {
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, StatusRetryLimit)
+	defer cancel()
+
 	for {
-		err := self.store.UpdateMessage(id, map[string]interface{}{
+		storeCtx, span := tracing.Start(ctx, "Store.UpdateMessage")
+		storeCtx, cancelCall := context.WithTimeout(storeCtx, StoreTimeout)
+		err := self.store.UpdateMessage(storeCtx, id, map[string]interface{}{
 			"Status": status,
 		})
+		cancelCall()
+		tracing.End(span, err)
 		if err == nil {
 			return
 		}
@@ -99,45 +257,325 @@ func (self *Worker) updateStatus(id, status string) {
 		timer := time.NewTimer(time.Second).C
 		select {
 		case <-timer:
-		case <-self.done:
+		case <-ctx.Done():
+			logrus.WithFields(logrus.Fields{
+				"method": "Worker.updateStatus",
+				"type":   "store",
+				"result": "abandoned",
+			}).Errorf("Status '%s' of message id '%s' not recorded - %s", status, id, ctx.Err())
 			return
 		}
 	}
 }
 
-func (self *Worker) handleMessage(payload *sarama.ConsumerMessage) {
-	logrus.Debugf("Got new message -> %s", payload.Value)
+func (self *Worker) handleRecord(record *queue.Record) {
+	logrus.Debugf("Got new message -> %s", record.Value)
+	metrics.LaneConsumed.WithLabelValues(record.Topic).Inc()
 
-	var msg models.QueueMessage
-	if err := json.Unmarshal(payload.Value, &msg); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"method": "Worker.handleMessage()",
-			"type":   "json",
-			"result": "discarded",
-		}).Error(fmt.Sprintf("Unmarshal failed on payload - %s", string(payload.Value)))
+	msg, err := queue.Decode(record)
+	if err != nil {
+		self.dispatcher.DeadLetter(self.ctx, record, nil, err)
+		self.ack(record)
+		metrics.HandleOutcomes.WithLabelValues("unknown", OutcomeFailed).Inc()
 		return
 	}
 
-	// API is just testing the connection
-	if msg.Type == "ping" {
-		return
+	if !msg.EnqueuedAt.IsZero() {
+		elapsed := time.Now().Sub(msg.EnqueuedAt)
+		metrics.LaneQueueLatency.WithLabelValues(record.Topic).
+			Observe(float64(elapsed) / float64(time.Millisecond))
+	}
+
+	// Continue the trace started by the API, the headers take precedence over the envelope
+	ctx := tracing.Extract(tracing.Extract(self.ctx, msg.Trace), record.Headers)
+	ctx, span := tracing.Start(ctx,
+		"Worker.handleRecord", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("message.id", msg.Id),
+			attribute.String("message.type", msg.Type),
+			attribute.String("message.priority", msg.Priority),
+			attribute.Int("message.attempt", msg.Attempt),
+		))
+
+	start := time.Now()
+	err = self.dispatcher.Dispatch(ctx, record, &msg)
+	elapsed := time.Now().Sub(start)
+	tracing.End(span, err)
+	metrics.HandleLatency.WithLabelValues(msg.Type).Observe(float64(elapsed) / float64(time.Millisecond))
+
+	outcome := Outcome(err)
+	switch outcome {
+	case OutcomeDeferred:
+		logrus.WithFields(logrus.Fields{
+			"method": "Worker.handleRecord()",
+			"type":   msg.Type,
+			"result": "failed",
+		}).Error(fmt.Sprintf("Message Id '%s' - %s", msg.Id, err.Error()))
+		outcome = self.retry(ctx, record, &msg)
+	case OutcomeFailed, OutcomeDiscarded:
+		logrus.WithFields(logrus.Fields{
+			"method": "Worker.handleRecord()",
+			"type":   msg.Type,
+			"result": outcome,
+		}).Error(fmt.Sprintf("Message Id '%s' - %s", msg.Id, err.Error()))
+		self.ack(record)
+	default:
+		self.ack(record)
+	}
+	metrics.HandleOutcomes.WithLabelValues(msg.Type, outcome).Inc()
+}
+
+// Ask the queue to deliver the message again, unless we have run out of
+// attempts. Returns the outcome of the message
+func (self *Worker) retry(ctx context.Context, record *queue.Record, msg *models.QueueMessage) string {
+	if msg.Attempt >= MaxAttempts {
+		self.dispatcher.DeadLetter(ctx, record, msg,
+			errors.Errorf("giving up after %d attempts", msg.Attempt))
+		self.ack(record)
+		return OutcomeFailed
+	}
+
+	// Retry using the encoding of the original, older workers may not understand newer encodings
+	msg.Attempt++
+	retry, err := queue.Encode(*msg, queue.ContentTypeOf(record))
+	if err != nil {
+		self.dispatcher.DeadLetter(ctx, record, msg, err)
+		self.ack(record)
+		return OutcomeFailed
+	}
+	record.Value = retry.Value
+	// Keep the trace context of the original
+	if record.Headers == nil {
+		record.Headers = make(map[string]string)
+	}
+	for key, value := range retry.Headers {
+		record.Headers[key] = value
+	}
+
+	if err := self.queue.Nack(record); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"method": "Worker.retry()",
+			"type":   "queue",
+		}).Error(fmt.Sprintf("Nack failed for message id '%s' - %s", msg.Id, err.Error()))
+	}
+	return OutcomeDeferred
+}
+
+func (self *Worker) ack(record *queue.Record) {
+	if err := self.queue.Ack(record); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"method": "Worker.ack()",
+			"type":   "queue",
+		}).Error(err.Error())
 	}
+}
 
+func (self *Worker) handleEmail(ctx context.Context, msg *models.QueueMessage) error {
 	// Get the message from the database
-	email, err := self.store.GetMessage(msg.Id)
+	storeCtx, span := tracing.Start(ctx, "Store.GetMessage")
+	storeCtx, cancel := context.WithTimeout(storeCtx, StoreTimeout)
+	email, err := self.store.GetMessage(storeCtx, msg.Id)
+	cancel()
+	tracing.End(span, err)
 	if err != nil {
 		if store.IsNotFound(err) {
-			logrus.WithFields(logrus.Fields{
-				"method": "Worker.handleMessage()",
-				"type":   "store",
-				"result": "discarded",
-			}).Error(fmt.Sprintf("Queue Message Id not found - %s", msg.Id))
+			return Discard(errors.Errorf("Queue Message Id not found - %s", msg.Id))
 		}
+		return err
 	}
 
-	if err := self.mailer.Send(email); err != nil {
-		self.updateStatus(msg.Id, "UN-DELIVERABLE")
-		return
+	// Claim the message, so a copy redelivered to another worker is not sent twice
+	if email.Status != "NEW" && !claimExpired(email, time.Now()) {
+		return Discard(errors.Errorf("Message Id '%s' already claimed, status '%s'", msg.Id, email.Status))
+	}
+
+	// Open the body before claiming, so an unavailable blob store is retried
+	body, closeBody, err := self.openBody(ctx, email)
+	if err != nil {
+		return err
+	}
+	defer closeBody()
+
+	storeCtx, span = tracing.Start(ctx, "Store.UpdateMessageIf")
+	storeCtx, cancel = context.WithTimeout(storeCtx, StoreTimeout)
+	err = self.store.UpdateMessageIf(storeCtx, msg.Id, email.Version, map[string]interface{}{
+		"Status":    "SENDING",
+		"ClaimedAt": time.Now().Unix(),
+	})
+	cancel()
+	tracing.End(span, err)
+	if err != nil {
+		// Modified since we read it, retry to find out if it was claimed by another worker
+		if store.IsConflict(err) {
+			return errors.Errorf("Message Id '%s' modified while claiming", msg.Id)
+		}
+		return err
+	}
+
+	_, span = tracing.Start(ctx, "Mailer.Send")
+	err = self.send(email, body)
+	tracing.End(span, err)
+	if err != nil {
+		self.updateStatus(ctx, msg.Id, "UN-DELIVERABLE")
+		self.notify(ctx, email)
+		return Fail(err)
+	}
+	self.updateStatus(ctx, msg.Id, "DELIVERED")
+	self.notify(ctx, email)
+	return nil
+}
+
+// Returns true if the message was claimed by a worker that did not record the result within
+// ClaimTimeout. Messages claimed before the claim time was recorded are considered expired
+func claimExpired(email *models.Message, now time.Time) bool {
+	if email.Status != "SENDING" {
+		return false
+	}
+	return now.Sub(time.Unix(email.ClaimedAt, 0)) > ClaimTimeout
+}
+
+// Queue the messages with an expired claim again, so a message claimed by a worker that crashed
+// is sent even if the queue never redelivers it. Does nothing if the store can't list messages
+// by status. Returns the number of messages queued
+func (self *Worker) RequeueExpiredClaims(ctx context.Context) (int, error) {
+	expirer, ok := self.store.(store.Expirer)
+	if !ok {
+		return 0, nil
+	}
+
+	now := time.Now()
+	var total int
+	for {
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		default:
+		}
+
+		count, found, err := self.requeueBatch(ctx, expirer, now)
+		total += count
+		if err != nil {
+			return total, err
+		}
+		// Queued claims are released, so the next batch starts after them. A full batch
+		// without an expired claim holds claims still being sent, reading it again won't help
+		if found < RequeueBatchSize || count == 0 {
+			return total, nil
+		}
+	}
+}
+
+// Returns the number of messages queued and the number of SENDING messages read
+func (self *Worker) requeueBatch(ctx context.Context, expirer store.Expirer, now time.Time) (int, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, StoreTimeout)
+	defer cancel()
+
+	// A message is claimed after it is inserted, so every expired claim was inserted before
+	// the claim timeout
+	messages, err := expirer.ExpiredMessages(ctx, "SENDING", now.Add(-ClaimTimeout), false, RequeueBatchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var count int
+	for i := range messages {
+		if !claimExpired(&messages[i], now) {
+			continue
+		}
+		if err := Enqueue(ctx, self.queue, self.getKeyFunc(), &messages[i]); err != nil {
+			return count, len(messages), err
+		}
+		count++
+
+		// Release the claim so the message is not read again, a conflict means the message
+		// was claimed since we read it, the copy we queued is discarded when handled
+		err := self.store.UpdateMessageIf(ctx, messages[i].Id, messages[i].Version, map[string]interface{}{
+			"Status":    "NEW",
+			"ClaimedAt": 0,
+		})
+		if err != nil && !store.IsConflict(err) && !store.IsNotFound(err) {
+			return count, len(messages), err
+		}
+	}
+	return count, len(messages), nil
+}
+
+// Returns the body of a message kept in the blob store, nil if the body is in Text. The
+// first call of the BodyFunc returns the reader opened here, the returned func closes it if unused
+func (self *Worker) openBody(ctx context.Context, email *models.Message) (BodyFunc, func(), error) {
+	if email.BodyRef == "" {
+		return nil, func() {}, nil
+	}
+	opener, ok := self.store.(store.BodyOpener)
+	if !ok {
+		return nil, nil, errors.Errorf("Message Id '%s' has a body in the blob store, "+
+			"but no blob store is configured", email.Id)
+	}
+
+	first, err := opener.OpenBody(ctx, email)
+	if err != nil {
+		return nil, nil, err
+	}
+	body := func() (io.ReadCloser, error) {
+		if first != nil {
+			reader := first
+			first = nil
+			return reader, nil
+		}
+		return opener.OpenBody(ctx, email)
+	}
+	return body, func() {
+		if first != nil {
+			first.Close()
+		}
+	}, nil
+}
+
+// Stream the body to mailers that can, other mailers are given the body in Text
+func (self *Worker) send(email *models.Message, body BodyFunc) error {
+	mailer := self.getMailer()
+	if body == nil {
+		return mailer.Send(email)
+	}
+	if mailer, ok := mailer.(BodyMailer); ok {
+		return mailer.SendBody(email, body)
+	}
+
+	reader, err := body()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	email.Text = string(content)
+	return mailer.Send(email)
+}
+
+// The transport reported the message could not be delivered to the recipient
+func (self *Worker) handleBounce(ctx context.Context, msg *models.QueueMessage) error {
+	self.updateStatus(ctx, msg.Id, "BOUNCED")
+	self.notify(ctx, &models.Message{Id: msg.Id, Priority: msg.Priority})
+	return nil
+}
+
+// Interleave the lanes according to their weights such that higher priority
+// lanes are visited first and most often
+// IE: {high: 4, normal: 2, bulk: 1} = [high normal bulk high normal high high]
+func laneSchedule(weights map[string]int) []string {
+	var schedule []string
+	for round := 0; ; round++ {
+		var added bool
+		for _, priority := range models.Priorities {
+			if weights[priority] > round {
+				schedule = append(schedule, priority)
+				added = true
+			}
+		}
+		if !added {
+			return schedule
+		}
 	}
-	self.updateStatus(msg.Id, "DELIVERED")
 }
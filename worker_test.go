@@ -0,0 +1,261 @@
+package detka_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/thrawn01/detka"
+	"github.com/thrawn01/detka/models"
+	"github.com/thrawn01/detka/queue"
+	"github.com/thrawn01/detka/store"
+	"golang.org/x/net/context"
+)
+
+// Counts the messages sent
+type countingMailer struct {
+	sent int32
+}
+
+func (self *countingMailer) Send(*models.Message) error {
+	atomic.AddInt32(&self.sent, 1)
+	return nil
+}
+
+// Blocks each send until 'release' is closed
+type blockingMailer struct {
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (self *blockingMailer) Send(*models.Message) error {
+	close(self.sending)
+	<-self.release
+	return nil
+}
+
+// Records the key of each record published
+type keyRecordingQueue struct {
+	*queue.MemoryQueue
+	keys chan string
+}
+
+func (self *keyRecordingQueue) Publish(record *queue.Record) error {
+	self.keys <- string(record.Key)
+	return self.MemoryQueue.Publish(record)
+}
+
+var _ = Describe("Worker", func() {
+	Context("When the worker is stopped while sending a message", func() {
+		It("should record the status of the message before Stop returns", func() {
+			dbStore := store.NewMemoryStore()
+			msgQueue := queue.NewMemoryQueue(10)
+			mailer := &blockingMailer{sending: make(chan struct{}), release: make(chan struct{})}
+			worker := detka.NewWorker(msgQueue, dbStore, mailer)
+			defer msgQueue.Stop()
+
+			msg := models.Message{Id: "id-1", To: "devs@mailgun.net", Status: "NEW"}
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+			record, err := queue.NewRecord(models.NewQueueMessage("email", "id-1"))
+			Expect(err).To(BeNil())
+			Expect(msgQueue.Publish(record)).To(BeNil())
+
+			Eventually(mailer.sending).Should(BeClosed())
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				close(mailer.release)
+			}()
+			worker.Stop()
+
+			stored, err := dbStore.GetMessage(context.Background(), "id-1")
+			Expect(err).To(BeNil())
+			Expect(stored.Status).To(Equal("DELIVERED"))
+		})
+	})
+
+	Context("When a message is delivered to the worker twice", func() {
+		It("should send the message once", func() {
+			dbStore := store.NewMemoryStore()
+			msgQueue := queue.NewMemoryQueue(10)
+			mailer := &countingMailer{}
+			worker := detka.NewWorker(msgQueue, dbStore, mailer)
+			defer msgQueue.Stop()
+			defer worker.Stop()
+
+			msg := models.Message{Id: "id-1", To: "devs@mailgun.net", Status: "NEW"}
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+
+			for i := 0; i < 2; i++ {
+				record, err := queue.NewRecord(models.NewQueueMessage("email", "id-1"))
+				Expect(err).To(BeNil())
+				Expect(msgQueue.Publish(record)).To(BeNil())
+			}
+
+			Eventually(func() string {
+				stored, _ := dbStore.GetMessage(context.Background(), "id-1")
+				return stored.Status
+			}).Should(Equal("DELIVERED"))
+			Consistently(func() int32 { return atomic.LoadInt32(&mailer.sent) }, 50*time.Millisecond).
+				Should(Equal(int32(1)))
+		})
+	})
+
+	Context("When a webhook is configured", func() {
+		It("should POST the final status of the message to the webhook", func() {
+			events := make(chan detka.WebhookEvent, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				var event detka.WebhookEvent
+				json.NewDecoder(req.Body).Decode(&event)
+				events <- event
+			}))
+			defer server.Close()
+
+			dbStore := store.NewMemoryStore()
+			msgQueue := queue.NewMemoryQueue(10)
+			worker := detka.NewWorker(msgQueue, dbStore, &countingMailer{})
+			worker.SetWebhook(server.URL)
+			defer msgQueue.Stop()
+			defer worker.Stop()
+
+			msg := models.Message{Id: "id-1", To: "devs@mailgun.net", Status: "NEW"}
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+			Expect(detka.Enqueue(context.Background(), msgQueue, nil, &msg)).To(BeNil())
+
+			Eventually(events).Should(Receive(Equal(detka.WebhookEvent{Id: "id-1", Status: "DELIVERED"})))
+		})
+
+		It("should not mark the email as dead when the webhook fails every attempt", func() {
+			defer func(previous int) { detka.MaxAttempts = previous }(detka.MaxAttempts)
+			detka.MaxAttempts = 2
+
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				resp.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			dbStore := store.NewMemoryStore()
+			msgQueue := queue.NewMemoryQueue(10)
+			deadLetters, err := msgQueue.Subscribe(queue.DeadLetterTopic)
+			Expect(err).To(BeNil())
+			worker := detka.NewWorker(msgQueue, dbStore, &countingMailer{})
+			worker.SetWebhook(server.URL)
+			defer msgQueue.Stop()
+			defer worker.Stop()
+
+			msg := models.Message{Id: "id-1", To: "devs@mailgun.net", Status: "NEW"}
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+			Expect(detka.Enqueue(context.Background(), msgQueue, nil, &msg)).To(BeNil())
+
+			var record *queue.Record
+			Eventually(deadLetters, time.Second*5).Should(Receive(&record))
+			dead, err := queue.Decode(record)
+			Expect(err).To(BeNil())
+			Expect(dead.Type).To(Equal("webhook"))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(detka.MaxAttempts)))
+
+			stored, err := dbStore.GetMessage(context.Background(), "id-1")
+			Expect(err).To(BeNil())
+			Expect(stored.Status).To(Equal("DELIVERED"))
+		})
+	})
+
+	Context("When the worker that claimed a message crashed", func() {
+		var dbStore *store.MemoryStore
+		var msgQueue *queue.MemoryQueue
+		var mailer *countingMailer
+		var worker *detka.Worker
+
+		BeforeEach(func() {
+			dbStore = store.NewMemoryStore()
+			msgQueue = queue.NewMemoryQueue(10)
+			mailer = &countingMailer{}
+			worker = detka.NewWorker(msgQueue, dbStore, mailer)
+
+			// Left SENDING by a worker that crashed before recording the result
+			msg := models.Message{Id: "id-1", To: "devs@mailgun.net", Status: "SENDING",
+				ClaimedAt: time.Now().Add(-detka.ClaimTimeout * 2).Unix()}
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+		})
+
+		AfterEach(func() {
+			worker.Stop()
+			msgQueue.Stop()
+		})
+
+		delivered := func() string {
+			stored, _ := dbStore.GetMessage(context.Background(), "id-1")
+			return stored.Status
+		}
+
+		It("should claim the message again when redelivered", func() {
+			record, err := queue.NewRecord(models.NewQueueMessage("email", "id-1"))
+			Expect(err).To(BeNil())
+			Expect(msgQueue.Publish(record)).To(BeNil())
+
+			Eventually(delivered).Should(Equal("DELIVERED"))
+			Expect(atomic.LoadInt32(&mailer.sent)).To(Equal(int32(1)))
+		})
+
+		It("should queue the message again if it is not redelivered", func() {
+			timeout := detka.ClaimTimeout
+			detka.ClaimTimeout = 10 * time.Millisecond
+			defer func() { detka.ClaimTimeout = timeout }()
+			time.Sleep(20 * time.Millisecond)
+
+			count, err := worker.RequeueExpiredClaims(context.Background())
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(1))
+			Eventually(delivered).Should(Equal("DELIVERED"))
+		})
+
+		It("should queue every expired claim, not just the first batch", func() {
+			timeout, batchSize := detka.ClaimTimeout, detka.RequeueBatchSize
+			detka.ClaimTimeout, detka.RequeueBatchSize = 10*time.Millisecond, 2
+			defer func() { detka.ClaimTimeout, detka.RequeueBatchSize = timeout, batchSize }()
+
+			for _, id := range []string{"id-2", "id-3", "id-4", "id-5"} {
+				msg := models.Message{Id: id, To: "devs@mailgun.net", Status: "SENDING"}
+				Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+			}
+			time.Sleep(20 * time.Millisecond)
+
+			count, err := worker.RequeueExpiredClaims(context.Background())
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(5))
+			Eventually(func() int32 { return atomic.LoadInt32(&mailer.sent) }).Should(Equal(int32(5)))
+		})
+	})
+
+	Context("When a partition key is configured", func() {
+		It("should key the messages the worker queues", func() {
+			dbStore := store.NewMemoryStore()
+			msgQueue := &keyRecordingQueue{MemoryQueue: queue.NewMemoryQueue(10), keys: make(chan string, 10)}
+			worker := detka.NewWorker(msgQueue, dbStore, &countingMailer{})
+			keyFunc, err := queue.NewKeyFunc(queue.KeyDomain)
+			Expect(err).To(BeNil())
+			worker.SetKeyFunc(keyFunc)
+			defer msgQueue.Stop()
+			defer worker.Stop()
+
+			// After NewWorker(), so the worker does not requeue the claim before we do
+			timeout := detka.ClaimTimeout
+			detka.ClaimTimeout = 10 * time.Millisecond
+			defer func() { detka.ClaimTimeout = timeout }()
+
+			msg := models.Message{Id: "id-1", To: "devs@mailgun.net", Status: "SENDING"}
+			Expect(dbStore.InsertMessage(context.Background(), &msg)).To(BeNil())
+			time.Sleep(20 * time.Millisecond)
+
+			count, err := worker.RequeueExpiredClaims(context.Background())
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(1))
+			Eventually(msgQueue.keys).Should(Receive(Equal("mailgun.net")))
+		})
+	})
+})